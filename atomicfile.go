@@ -5,9 +5,15 @@ package atomicfile
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"hash"
 	"io"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -16,294 +22,1061 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// Option is the interface for options passed to Create.
-type Option interface {
-	apply(*config) error
+// SyncParentDirs enables the invocation of fsync() on the directory
+// containing the target file, and on all its parent directories up to the
+// mount point of the filesystem, after the target file has been linked.
+// This is useful when some of the parent directories have just been created,
+// and they also need to be durable. Unlike DurabilityParanoid, it does not
+// imply the invocation of fsync() on the target file.
+func SyncParentDirs() Option {
+	return optionFunc(func(c *config) error {
+		c.syncParents = true
+		return nil
+	})
 }
 
-type optionFunc func(*config) error
-
-func (o optionFunc) apply(cfg *config) error {
-	return o(cfg)
+// Preallocate allocates the specified amount of bytes in the target
+// file, regardless of the amount of content written (see PreallocateMode and
+// TrimPreallocation).
+// Not all filesystems and kernel versions support preallocating space.
+func Preallocate(size int64) Option {
+	return optionFunc(func(c *config) error {
+		if c.prealloc != defaultConfig().prealloc {
+			return &werror{"multiple preallocations", nil}
+		}
+		if size < 0 {
+			return &werror{"invalid preallocation size", nil}
+		}
+		c.prealloc = size
+		return nil
+	})
 }
 
-// Contents specifies the contents to be written to the target file.
-func Contents(r io.Reader) Option {
+// ContentSize specifies the expected size of the contents, for cases in which
+// it can not be determined automatically from the reader passed to Contents
+// (e.g. pipes, or HTTP response bodies with a known Content-Length).
+// The size is used as a hint to preallocate space for the target file, in
+// order to reduce fragmentation: if fewer bytes are written, the excess
+// allocation is released.
+func ContentSize(n int64) Option {
 	return optionFunc(func(c *config) error {
-		if c.contents != defaultConfig().contents {
-			return &werror{"multiple contents", nil}
+		if c.sizeHint != defaultConfig().sizeHint {
+			return &werror{"multiple content sizes", nil}
 		}
-		c.contents = r
+		if n < 0 {
+			return &werror{"invalid content size", nil}
+		}
+		c.sizeHint = n
 		return nil
 	})
 }
 
-// Fsync enables the invocation of fsync() on the target file and
-// its containing directory.
-func Fsync() Option {
+// ExpectSize specifies the exact size of the contents: if the number of bytes
+// read from the reader passed to Contents differs from n (e.g. because of a
+// truncated upload), the target file is not created and ErrSizeMismatch is
+// returned. At most n+1 bytes are read from the reader passed to Contents.
+// Unless ContentSize is specified, n is also used as the expected size of
+// the contents.
+func ExpectSize(n int64) Option {
 	return optionFunc(func(c *config) error {
-		c.fsync = true
+		if c.expectSize != defaultConfig().expectSize {
+			return &werror{"multiple expected sizes", nil}
+		}
+		if n < 0 {
+			return &werror{"invalid expected size", nil}
+		}
+		c.expectSize = n
 		return nil
 	})
 }
 
-// Preallocate allocates the specified amount of bytes in the target
-// file, regardless of the amount of content written.
-// Not all filesystems and kernel versions support preallocating space.
-func Preallocate(size int64) Option {
+// SELinuxContext specifies the SELinux security context of the target file
+// (e.g. "system_u:object_r:etc_t:s0"). The context is set, like other
+// extended attributes, before the target file is linked, so that the file
+// never appears with the wrong context.
+// Setting the context requires SELinux to be enabled, and the process to be
+// allowed to relabel the file.
+func SELinuxContext(label string) Option {
 	return optionFunc(func(c *config) error {
-		if c.prealloc != defaultConfig().prealloc {
-			return &werror{"multiple preallocations", nil}
+		if hasXattr(c.xattrs, selinuxXattr) {
+			return &werror{"multiple SELinux contexts", nil}
 		}
-		if size < 0 {
-			return &werror{"invalid preallocation size", nil}
+		if label == "" {
+			return &werror{"invalid SELinux context", nil}
 		}
-		c.prealloc = size
+		// like setfilecon, include the terminating NUL in the value
+		c.xattrs = append(c.xattrs, xattr{selinuxXattr, append([]byte(label), 0)})
 		return nil
 	})
 }
 
-// Xattr specifies an extended attribute to be added to the target file.
-// Multiple externded attributes can be added to the same file.
-// Not all filesystems and kernel versions support extended attributes.
-func Xattr(name string, value []byte) Option {
+const selinuxXattr = "security.selinux"
+
+// DontNeed signals to the OS that the target file should not remain in the block cache.
+// This is useful in case the file will not be accessed/read in the near future.
+// DontNeed is equivalent to FadviseDontNeed.
+func DontNeed() Option {
+	return FadviseDontNeed()
+}
+
+// FadviseDontNeed signals to the OS, using POSIX_FADV_DONTNEED, that the pages
+// of the target file should be dropped from the page cache once the file
+// has been created. This is useful in case the file will not be accessed/read
+// in the near future (e.g. backups).
+// Dirty pages can not be dropped until they have been written back, so this
+// is most effective when combined with Fsync.
+func FadviseDontNeed() Option {
 	return optionFunc(func(c *config) error {
-		c.xattrs = append(c.xattrs, struct {
-			name  string
-			value []byte
-		}{name, value})
+		if c.willNeed {
+			return &werror{"conflicting fadvise hints", nil}
+		}
+		c.dontNeed = true
 		return nil
 	})
 }
 
-// Permissions specifies the Unix permissions to be set on the target file.
-func Permissions(mode os.FileMode) Option {
+// FadviseWillNeed signals to the OS, using POSIX_FADV_WILLNEED, that the
+// target file will be accessed in the near future, so that its pages are
+// kept in (or read into) the page cache once the file has been created.
+func FadviseWillNeed() Option {
 	return optionFunc(func(c *config) error {
-		if c.perm != defaultConfig().perm {
-			return &werror{"multiple permissions", nil}
+		if c.dontNeed {
+			return &werror{"conflicting fadvise hints", nil}
 		}
-		c.perm = uint32(mode.Perm())
+		c.willNeed = true
+		return nil
+	})
+}
+
+// FadviseSequential signals to the OS, using POSIX_FADV_SEQUENTIAL, that the
+// target file will be accessed sequentially. The hint applies to the file
+// descriptor used to create the file.
+func FadviseSequential() Option {
+	return optionFunc(func(c *config) error {
+		c.sequential = true
 		return nil
 	})
 }
 
-// Ownership specifies the target file owner UID and GID.
-func Ownership(uid, gid int) Option {
+// FlushEvery starts the writeback of the target file contents every n bytes
+// written, using sync_file_range, and waits for the writeback of the
+// previous n bytes to complete. This bounds the amount of dirty pages
+// accumulated while writing large files, and the time spent by the final
+// fsync (if Fsync or Durability are specified).
+// Note that this does not provide any durability guarantee by itself.
+func FlushEvery(n int64) Option {
 	return optionFunc(func(c *config) error {
-		if c.uid != defaultConfig().uid || c.gid != defaultConfig().gid {
-			return &werror{"multiple ownership", nil}
+		if c.flushEvery != defaultConfig().flushEvery {
+			return &werror{"multiple flush intervals", nil}
 		}
-		c.uid, c.gid = uid, gid
+		if n <= 0 {
+			return &werror{"invalid flush interval", nil}
+		}
+		c.flushEvery = n
 		return nil
 	})
 }
 
-// ModificationTime specifies the modification time of the target file.
-func ModificationTime(t time.Time) Option {
+// CopyBufferSize specifies the size of the buffer used to copy the contents
+// when they have to be copied in userspace (i.e. when zero-copy mechanisms
+// can not be used). Buffers are pooled and reused across calls to Create.
+// The default size is 1MiB.
+func CopyBufferSize(n int) Option {
 	return optionFunc(func(c *config) error {
-		if c.mtime != defaultConfig().mtime {
-			return &werror{"multiple modification times", nil}
+		if c.copyBuffer != defaultConfig().copyBuffer {
+			return &werror{"multiple copy buffer sizes", nil}
 		}
-		ts, err := unix.TimeToTimespec(t)
-		if err != nil {
-			return &werror{"invalid modification time", err}
+		if n <= 0 {
+			return &werror{"invalid copy buffer size", nil}
 		}
-		c.mtime = ts
+		c.copyBuffer = n
 		return nil
 	})
 }
 
-// AccessTime specifies the access time of the target file.
-func AccessTime(t time.Time) Option {
+// VerifyChecksum computes the digest of the contents, using the hash function
+// algo, while they are written to the target file; if the digest does not
+// match the expected one, the target file is not created and ErrChecksumMismatch
+// is returned. The hash function must be linked into the binary (e.g. by
+// importing crypto/sha256 for crypto.SHA256).
+// As the contents need to be read in userspace, specifying VerifyChecksum
+// prevents the use of zero-copy mechanisms to populate the target file.
+func VerifyChecksum(algo crypto.Hash, expected []byte) Option {
 	return optionFunc(func(c *config) error {
-		if c.atime != defaultConfig().atime {
-			return &werror{"multiple access times", nil}
+		if !algo.Available() {
+			return &werror{"unavailable hash function", nil}
 		}
-		ts, err := unix.TimeToTimespec(t)
-		if err != nil {
-			return &werror{"invalid access time", err}
+		c.checksums = append(c.checksums, checksum{algo, algo.New(), expected})
+		return nil
+	})
+}
+
+// ChecksumXattr computes the digest of the contents, using the hash function
+// algo, while they are written to the target file, and stores it in an
+// extended attribute of the target file (e.g. "user.atomicfile.sha256" for
+// crypto.SHA256), so that the file can later be verified by ReadFileVerified.
+// The hash function must be linked into the binary (e.g. by importing
+// crypto/sha256 for crypto.SHA256).
+// As the contents need to be read in userspace, specifying ChecksumXattr
+// prevents the use of zero-copy mechanisms to populate the target file.
+func ChecksumXattr(algo crypto.Hash) Option {
+	return optionFunc(func(c *config) error {
+		if !algo.Available() {
+			return &werror{"unavailable hash function", nil}
+		}
+		name := checksumXattrName(algo)
+		if name == "" {
+			return &werror{"unsupported hash function", nil}
 		}
-		c.atime = ts
+		c.checksumXattrs = append(c.checksumXattrs, checksum{algo, algo.New(), nil})
 		return nil
 	})
 }
 
-// DontNeed signals to the OS that the target file should not remain in the block cache.
-// This is useful in case the file will not be accessed/read in the near future.
-func DontNeed() Option {
+// Lock makes Create acquire an exclusive flock(2) lock on the target file
+// before it is populated, and keep holding it after the target file has been
+// linked: the locked target file is returned in Result.File, so Lock requires
+// Report. Readers that acquire a shared lock on the target file before
+// reading it are therefore blocked until the caller releases the lock (e.g.
+// by closing Result.File).
+// If the target file is left untouched (see OnlyIfChanged), Result.File
+// is nil.
+func Lock() Option {
 	return optionFunc(func(c *config) error {
-		c.dontNeed = true
+		c.lock = true
+		return nil
+	})
+}
+
+// Validate specifies a function to be invoked with the populated temporary
+// file before it is linked: if the function returns an error, the target
+// file is not created and the error is returned by Create. The file is
+// positioned at its beginning when the function is invoked, and its contents,
+// permissions and extended attributes have already been set.
+// Validate can be specified multiple times: the functions are invoked in the
+// order in which they are specified, stopping at the first one that returns
+// an error.
+func Validate(fn func(f *os.File) error) Option {
+	return optionFunc(func(c *config) error {
+		c.validate = append(c.validate, fn)
+		return nil
+	})
+}
+
+// AfterCommit specifies a function to be invoked with the Result of Create
+// once the target file has been linked and, depending on the durability
+// level, synced to stable storage together with its containing directory
+// (e.g. to notify a daemon that it should reload the target file).
+// AfterCommit can be specified multiple times: the functions are invoked in
+// the order in which they are specified, stopping at the first one that
+// returns an error. As the target file has already been created, an error
+// returned by the function is reported by Create but does not cause the
+// target file to be removed.
+// The functions are not invoked if the target file is left untouched (see
+// OnlyIfChanged).
+func AfterCommit(fn func(r Result) error) Option {
+	return optionFunc(func(c *config) error {
+		c.afterCommit = append(c.afterCommit, fn)
 		return nil
 	})
 }
 
-// TODO: owner/group, permissions, file times, lock, xattr, fadvise flags, fsync, ...
+// KeepOpen makes Create return the target file, still open for reading and
+// writing, in Result.File, so KeepOpen requires Report. The returned file is
+// the same one that was used to populate the target file, so that the caller
+// can immediately use it (e.g. to mmap it) without re-opening the target file
+// by name, that could have been replaced in the meantime.
+// If the target file is left untouched (see OnlyIfChanged), Result.File
+// is nil.
+func KeepOpen() Option {
+	return optionFunc(func(c *config) error {
+		c.keepOpen = true
+		return nil
+	})
+}
+
+// NoReplace makes Rename and Symlink fail if the destination already exists,
+// using RENAME_NOREPLACE.
+// Not all filesystems and kernel versions support RENAME_NOREPLACE.
+func NoReplace() Option {
+	return optionFunc(func(c *config) error {
+		c.noReplace = true
+		return nil
+	})
+}
+
+// OnlyIfChanged makes Create, when used together with Replace, compare the
+// new contents with the ones of the existing target file: if they are
+// identical, the target file is left untouched (preserving its inode and
+// modification time) and Result.Unchanged is set (see Report).
+// Only the contents are compared: differences in other attributes (e.g.
+// permissions, ownership or xattrs) do not cause the target file to be
+// replaced. The comparison is made using the SHA-256 digest of the contents
+// written to the target file.
+// As the contents need to be read in userspace, specifying OnlyIfChanged
+// prevents the use of zero-copy mechanisms to populate the target file.
+func OnlyIfChanged() Option {
+	return optionFunc(func(c *config) error {
+		c.onlyIfChanged = true
+		return nil
+	})
+}
 
 type config struct {
-	contents io.Reader
-	dontNeed bool
-	fsync    bool
-	prealloc int64
-	xattrs   []struct {
-		name  string
-		value []byte
-	}
-	perm  uint32
-	uid   int
-	gid   int
-	mtime unix.Timespec
-	atime unix.Timespec
+	contents       io.Reader
+	dontNeed       bool
+	willNeed       bool
+	sequential     bool
+	durability     DurabilityLevel
+	syncParents    bool
+	flushEvery     int64
+	noReplace      bool
+	replace        bool
+	onlyIfChanged  bool
+	changeHash     hash.Hash
+	verifyWrite    bool
+	verifyDirect   bool
+	verifyHash     hash.Hash
+	verifyCommit   bool
+	preconditions  []Precondition
+	backupSuffix   string
+	backupRotate   int
+	secureResolve  bool
+	noForeignLinks bool
+	dirOwner       int
+	dirMode        uint32
+	inodeSet       uint32
+	inodeClear     uint32
+	metadataFrom   string
+	preserve       int
+	prealloc       int64
+	sizeHint       int64
+	maxSize        int64
+	expectSize     int64
+	hashes         []hash.Hash
+	checksums      []checksum
+	checksumXattrs []checksum
+	transforms     []func(io.Writer) (io.WriteCloser, error)
+	symlinkOptions []Option
+	// dirCache, if not nil, caches the mechanisms supported in the target
+	// directory (see Creator).
+	dirCache      *dirCache
+	compressed    bool
+	result        *Result
+	validate      []func(*os.File) error
+	observers     []func(Stage, time.Duration, error)
+	fault         func(Stage) Fault
+	logger        debugLogger
+	retry         RetryPolicy
+	ctx           context.Context
+	rateLimit     int64
+	progress      func(written, total int64)
+	ioUring       bool
+	parallel      int
+	copyBuffer    int
+	sparse        bool
+	strategy      Strategy
+	procMount     string
+	noProcLink    bool
+	stageDir      string
+	tempPattern   string
+	keepOnError   bool
+	preallocMode  PreallocMode
+	preallocTrim  int
+	reserve       bool
+	preallocChunk int64
+	ring          *uring
+	afterCommit   []func(Result) error
+	xattrs        []xattr
+	perm          uint32
+	permMasked    bool
+	executable    bool
+	dirGroup      bool
+	lock          bool
+	keepOpen      bool
+	lockfile      string
+	lockTimeout   time.Duration
+	uid           int
+	gid           int
+	mtime         unix.Timespec
+	atime         unix.Timespec
+
+	// ownershipBestEffort ignores permission errors when setting ownership.
+	ownershipBestEffort bool
+	// unique, if not nil, makes create treat the base name of the target
+	// file as a CreateUnique pattern, and receives the chosen name.
+	unique *string
 }
 
 func defaultConfig() config {
 	return config{
-		perm:  ^uint32(0),
-		uid:   -1,
-		gid:   -1,
-		mtime: unix.Timespec{Nsec: unix.UTIME_OMIT},
-		atime: unix.Timespec{Nsec: unix.UTIME_OMIT},
+		sizeHint:   -1,
+		maxSize:    -1,
+		expectSize: -1,
+		perm:       ^uint32(0),
+		dirOwner:   -1,
+		dirMode:    ^uint32(0),
+		uid:        -1,
+		gid:        -1,
+		mtime:      unix.Timespec{Nsec: unix.UTIME_OMIT},
+		atime:      unix.Timespec{Nsec: unix.UTIME_OMIT},
 	}
 }
 
-// Create creates the specified file with the provided options.
-// The file is created atomically in a fully-formed state using
-// O_TMPFILE/linkat.
-// Create fails if the file already exists.
-func Create(filename string, options ...Option) error {
+func newConfig(options []Option) (config, error) {
 	cfg := defaultConfig()
 	for _, o := range options {
 		if err := o.apply(&cfg); err != nil {
-			return &werror{"options", err}
+			return cfg, &werror{"options", err}
+		}
+	}
+	if cfg.replace && cfg.noReplace {
+		return cfg, &werror{"options", &werror{"conflicting Replace and NoReplace", nil}}
+	}
+	if cfg.noProcLink && (cfg.procMount != "" || cfg.strategy == tmpFileStrategy{mode: StrategyProcLink}) {
+		return cfg, &werror{"options", &werror{"conflicting NoProcLink and /proc/self/fd linking", nil}}
+	}
+	if cfg.onlyIfChanged && !cfg.replace {
+		return cfg, &werror{"options", &werror{"OnlyIfChanged requires Replace", nil}}
+	}
+	if cfg.lock && cfg.result == nil {
+		return cfg, &werror{"options", &werror{"Lock requires Report", nil}}
+	}
+	if cfg.keepOpen && cfg.result == nil {
+		return cfg, &werror{"options", &werror{"KeepOpen requires Report", nil}}
+	}
+	if cfg.preserve != 0 && !cfg.replace {
+		return cfg, &werror{"options", &werror{"PreserveMetadata and PreserveTimes require Replace", nil}}
+	}
+	if (cfg.backupSuffix != "" || cfg.backupRotate > 0) && !cfg.replace {
+		return cfg, &werror{"options", &werror{"Backup requires Replace", nil}}
+	}
+	if _, ok := cfg.strategy.(renameStrategy); cfg.stageDir != "" && cfg.strategy != nil && !ok {
+		return cfg, &werror{"options", &werror{"StageDir requires RenameStrategy", nil}}
+	}
+	return cfg, nil
+}
+
+// Create creates the specified file with the provided options.
+// The file is created atomically in a fully-formed state using
+// O_TMPFILE/linkat (unless a different Strategy is specified).
+// Create fails if the file already exists, unless Replace is specified.
+// If Create fails after the file has been published (e.g. because the
+// directory containing it could not be synced), the error matches
+// ErrPublished.
+func Create(filename string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	return create(unix.AT_FDCWD, filename, cfg)
+}
+
+// CreateAt is like Create, but if name is a relative path it is resolved
+// relative to the directory dir, instead of the current working directory.
+// The directory containing the target file is resolved only once, so
+// all the operations needed to create the target file (including the
+// ones required by Replace, Backup and ReplaceIf) are performed in the
+// same directory even if it is concurrently renamed.
+func CreateAt(dir *os.File, name string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	err = create(int(dir.Fd()), name, cfg)
+	runtime.KeepAlive(dir)
+	return err
+}
+
+// create creates filename, resolved relative to dirfd, as specified by cfg.
+// All operations are performed relative to the directory containing
+// filename, that is opened only once.
+func create(dirfd int, filename string, cfg config) error {
+	p, err := stage(dirfd, filename, cfg)
+	if err != nil {
+		return err
+	}
+	return p.Commit()
+}
+
+// stageOnce creates and populates the temporary file that will become
+// filename, resolved relative to dirfd, as specified by cfg. The returned
+// Pending holds the open temporary file and target directory, that are
+// closed by Commit/Discard, or immediately if stageOnce fails.
+func stageOnce(dirfd int, filename string, cfg config) (_ *Pending, err error) {
+	p := &Pending{filename: filename}
+	defer func() {
+		if err != nil {
+			p.crashed = errors.Is(err, ErrSimulatedCrash)
+			err = p.keepOnError(err, &cfg)
+			p.close(false)
+		}
+	}()
+
+	dir, base := path.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	p.dir, p.base = dir, base
+
+	if err := cfg.canceled(); err != nil {
+		return nil, err
+	}
+
+	if cfg.lockfile != "" {
+		l, err := acquireLockfile(cfg.lockfile, cfg.lockTimeout)
+		if err != nil {
+			return nil, &werror{"locking lock file", err}
 		}
+		p.lockfile = l
 	}
 
-	dir := path.Dir(filename)
+	if cfg.metadataFrom != "" {
+		err := cfg.inheritFrom(unix.AT_FDCWD, cfg.metadataFrom, true, inheritMetadata|inheritTimes)
+		if err != nil {
+			return nil, &werror{"reading reference file metadata", err}
+		}
+	}
 
+	// on Linux the directory fd can be opened as read-only for fsync
 	var d *os.File
-	var err error
-	if cfg.fsync {
-		// on Linux the directory fd can be opened as read-only for fsync
-		d, err = os.OpenFile(dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	start := time.Now()
+	if cfg.secureResolve {
+		d, err = openBeneath(dirfd, dir)
+	} else {
+		d, err = openAt(dirfd, dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	}
+	err = cfg.observe(StageOpenDir, start, err)
+	if err != nil {
+		return nil, &werror{"opening directory", err}
+	}
+	p.d = d
+	if cfg.noForeignLinks {
+		err := checkForeignSymlinks(dirfd, dir, d)
 		if err != nil {
-			return &werror{"opening directory", err}
+			return nil, &werror{"checking directory", err}
 		}
-		// TODO: check error
-		defer d.Close()
 	}
+	dirfd = int(d.Fd())
 
-	f, err := os.OpenFile(dir, unix.O_TMPFILE|os.O_APPEND|os.O_WRONLY, 0o666)
+	if cfg.preserve != 0 {
+		err := cfg.inheritFrom(dirfd, base, false, cfg.preserve)
+		if err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.ELOOP) {
+			return nil, &werror{"reading target file metadata", err}
+		}
+	}
+
+	if cfg.dirGroup {
+		var st unix.Stat_t
+		if err := unix.Fstat(dirfd, &st); err != nil {
+			return nil, &werror{"reading directory metadata", err}
+		}
+		if st.Mode&unix.S_ISGID != 0 {
+			cfg.gid = int(st.Gid)
+		}
+	}
+
+	start = time.Now()
+	staged, err := stageFile(d, base, &cfg)
+	if err == nil {
+		// set before observing the stage, so that the staged file is cleaned
+		// up if a fault is injected (see InjectFault)
+		p.staged, p.f = staged, staged.File()
+	}
+	err = cfg.observe(StageOpen, start, err)
 	if err != nil {
-		return &werror{"opening file", err}
+		return nil, &werror{"opening file", err}
 	}
-	// TODO: check error
-	defer f.Close()
+	f := p.f
 
-	if cfg.uid != defaultConfig().uid || cfg.gid != defaultConfig().gid {
-		err := unix.Fchown(int(f.Fd()), cfg.uid, cfg.gid)
+	if cfg.ioUring {
+		ring, err := newURing()
+		if err != nil {
+			cfg.debug("io_uring not available, falling back to regular system calls", "error", err)
+		} else {
+			cfg.ring = ring
+			defer ring.close()
+		}
+	}
+
+	if cfg.lock {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX)
 		if err != nil {
-			return &werror{"setting ownership", err}
+			return nil, &werror{"locking file", err}
 		}
 	}
 
-	if cfg.perm != defaultConfig().perm {
-		err := unix.Fchmod(int(f.Fd()), cfg.perm)
+	if cfg.sequential {
+		_ = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+	}
+
+	if set := cfg.inodeSet &^ lateInodeFlags; set != 0 || cfg.inodeClear != 0 {
+		err := setInodeFlags(int(f.Fd()), set, cfg.inodeClear)
 		if err != nil {
-			return &werror{"setting permissions", err}
+			return nil, &werror{"setting inode flags", err}
+		}
+	}
+
+	if cfg.uid != defaultConfig().uid || cfg.gid != defaultConfig().gid {
+		start := time.Now()
+		err := unix.Fchown(int(f.Fd()), cfg.uid, cfg.gid)
+		if err == unix.EPERM && cfg.ownershipBestEffort {
+			cfg.debug("ignoring permission error setting ownership", "uid", cfg.uid, "gid", cfg.gid)
+			err = nil
+		}
+		err = cfg.observe(StageChown, start, err)
+		if err != nil {
+			return nil, &werror{"setting ownership", err}
 		}
 	}
 
 	prealloc := cfg.prealloc
-	if prealloc == defaultConfig().prealloc && cfg.contents != nil {
-		if guess := guessContentSize(cfg.contents); guess > 0 {
+	if prealloc == defaultConfig().prealloc && cfg.contents != nil && !cfg.sparse {
+		if guess := cfg.contentSize(); guess > 0 {
 			prealloc = guess
 		}
 	}
 	if prealloc > 0 {
-		err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, prealloc)
+		start := time.Now()
+		err := cfg.fallocate(f, prealloc)
+		err = cfg.observe(StagePrealloc, start, err)
 		if err != nil {
-			prealloc = 0
-			if cfg.prealloc > 0 {
-				return &werror{"preallocating file", err}
+			if cfg.reserve && (err == unix.ENOSPC || err == unix.EDQUOT) {
+				return nil, &werror{"reserving space", ErrNoSpace}
+			} else if cfg.reserve {
+				return nil, &werror{"reserving space", err}
+			} else if cfg.prealloc > 0 || err == ErrInjectedFault || err == ErrSimulatedCrash {
+				// a guessed preallocation is best-effort, but the faults
+				// injected with InjectFault must not be ignored
+				return nil, &werror{"preallocating file", err}
 			}
+			cfg.debug("ignoring preallocation error", "size", prealloc, "error", err)
+			prealloc = 0
 		}
 	}
 
-	var written int64
+	if cfg.onlyIfChanged {
+		cfg.changeHash = sha256.New()
+	}
+	if cfg.verifyWrite {
+		cfg.verifyHash = sha256.New()
+	}
+
+	var read, written int64
 	if cfg.contents != nil {
-		written, err = io.Copy(f, cfg.contents)
+		start := time.Now()
+		read, written, err = populateFile(f, &cfg)
+		err = cfg.observe(StageCopy, start, err)
 		if err != nil {
-			return &werror{"populating file", err}
+			return nil, &werror{"populating file", err}
+		}
+		if cfg.maxSize >= 0 && read > cfg.maxSize {
+			return nil, &werror{"populating file", ErrTooLarge}
+		}
+	}
+
+	if cfg.expectSize >= 0 && read != cfg.expectSize {
+		return nil, &werror{"populating file", ErrSizeMismatch}
+	}
+
+	for _, c := range cfg.checksums {
+		if !bytes.Equal(c.h.Sum(nil), c.expected) {
+			return nil, &werror{"verifying " + c.algo.String() + " checksum", ErrChecksumMismatch}
 		}
 	}
 
-	if written < prealloc && cfg.prealloc == 0 {
-		// The user did not request prealloc, and our guess was too big:
-		// trim the excess allocation so that we don't waste space in case
-		// the fs honoured our request.
-		// TODO: should we fail in this case?
-		_ = unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, written, prealloc-written)
+	if written < prealloc {
+		// If the user did not request prealloc, our guess was too big: trim
+		// the excess allocation so that we don't waste space in case the fs
+		// honoured our request.
+		if err := cfg.trimPreallocation(f, prealloc, written, cfg.prealloc == 0); err != nil {
+			return nil, &werror{"truncating file", err}
+		}
 	}
 
-	for _, xattr := range cfg.xattrs {
-		err := unix.Fsetxattr(int(f.Fd()), xattr.name, xattr.value, 0)
+	if cfg.onlyIfChanged {
+		unchanged, err := hasContents(dirfd, base, written, cfg.changeHash.Sum(nil))
 		if err != nil {
-			return &werror{"setting xattr", err}
+			return nil, &werror{"comparing contents", err}
+		}
+		if unchanged {
+			p.cfg, p.written, p.unchanged = cfg, written, true
+			return p, nil
+		}
+	}
+
+	// Permissions are set after the file has been populated, as writing to
+	// the file may clear the setuid/setgid bits.
+	if cfg.perm != defaultConfig().perm || cfg.executable {
+		perm := cfg.perm
+		if perm == defaultConfig().perm {
+			var st unix.Stat_t
+			if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+				return nil, &werror{"reading file metadata", err}
+			}
+			perm = st.Mode & 0o7777
+		} else if cfg.permMasked {
+			perm &^= umask()
+		}
+		if cfg.executable {
+			perm |= (perm & 0o444) >> 2
+		}
+		err := unix.Fchmod(int(f.Fd()), perm)
+		if err != nil {
+			return nil, &werror{"setting permissions", err}
+		}
+	}
+
+	for _, c := range cfg.checksumXattrs {
+		cfg.xattrs = append(cfg.xattrs, xattr{checksumXattrName(c.algo), c.h.Sum(nil)})
+	}
+
+	if len(cfg.xattrs) > 0 {
+		start := time.Now()
+		for _, xattr := range cfg.xattrs {
+			err := unix.Fsetxattr(int(f.Fd()), xattr.name, xattr.value, 0)
+			if err != nil {
+				cfg.observe(StageXattr, start, err)
+				return nil, &werror{"setting xattr", err}
+			}
+		}
+		if err := cfg.observe(StageXattr, start, nil); err != nil {
+			return nil, &werror{"setting xattr", err}
+		}
+	}
+
+	// Validation is performed before setting the times, as reading the file
+	// may update its access time.
+	for _, fn := range cfg.validate {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, &werror{"seeking file", err}
+		}
+		if err := fn(f); err != nil {
+			return nil, &werror{"validating file", err}
 		}
 	}
 
 	if cfg.mtime != defaultConfig().mtime || cfg.atime != defaultConfig().atime {
 		err := futimens(int(f.Fd()), &[2]unix.Timespec{cfg.atime, cfg.mtime})
 		if err != nil {
-			return &werror{"setting access/modification time", err}
+			return nil, &werror{"setting access/modification time", err}
 		}
 	}
 
-	if cfg.dontNeed {
-		// TODO: this should be done incrementally in the io.Copy loop
-		_ = unix.Fadvise(int(f.Fd()), 0, written, unix.FADV_DONTNEED)
+	if cfg.durability == DurabilityData {
+		start := time.Now()
+		var err error
+		if cfg.ring != nil {
+			err = cfg.ring.fsync(int(f.Fd()), true)
+		} else {
+			err = unix.Fdatasync(int(f.Fd()))
+		}
+		err = cfg.observe(StageFsync, start, err)
+		if err != nil {
+			return nil, &werror{"fdatasync file", err}
+		}
+	} else if cfg.durability >= DurabilityFull {
+		start := time.Now()
+		var err error
+		if cfg.ring != nil {
+			err = cfg.ring.fsync(int(f.Fd()), false)
+		} else {
+			err = f.Sync()
+		}
+		err = cfg.observe(StageFsync, start, err)
+		if err != nil {
+			return nil, &werror{"fsync file", err}
+		}
+	}
+
+	if cfg.verifyWrite {
+		if err := verifyFile(f, p.filename, &cfg); err != nil {
+			return nil, &werror{"verifying file", err}
+		}
+	}
+
+	p.cfg, p.written = cfg, written
+	return p, nil
+}
+
+// commit publishes the staged file. It returns whether the temporary file
+// must be kept open as it is returned to the caller in Result.File.
+func (p *Pending) commit() (keepOpen bool, err error) {
+	cfg, d, f := &p.cfg, p.d, p.f
+	dir, base, filename := p.dir, p.base, p.filename
+	dirfd := int(d.Fd())
+
+	if p.unchanged {
+		p.result = Result{Written: p.written, Unchanged: true}
+		cfg.report(&p.result)
+		return false, nil
 	}
 
-	if cfg.fsync {
-		err := f.Sync()
+	if cfg.dirOwner != defaultConfig().dirOwner || cfg.dirMode != defaultConfig().dirMode {
+		err := checkDir(d, path.Clean(dir), cfg)
 		if err != nil {
-			return &werror{"fsync file", err}
+			return false, &werror{"checking directory", err}
 		}
 	}
 
-	const AT_EMPTY_PATH = 0x1000
-	err = unix.Linkat(int(f.Fd()), "", unix.AT_FDCWD, filename, AT_EMPTY_PATH)
-	if err != nil {
-		procPath := "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
-		err2 := unix.Linkat(unix.AT_FDCWD, procPath, unix.AT_FDCWD, filename, unix.AT_SYMLINK_FOLLOW)
-		if err2 != nil {
-			return &werror{"linking file", err2}
+	if err := cfg.canceled(); err != nil {
+		return false, err
+	}
+
+	// the errors that occur once the file has been published are reported
+	// as such, as the caller can not assume that the target file is unchanged
+	published := false
+	defer func() {
+		if err != nil && published {
+			err = &publishedError{err}
+		}
+	}()
+
+	var backup string
+	linked := base
+	start := time.Now()
+	if cfg.unique != nil {
+		cfg.debug("linking file", "strategy", "unique", "pattern", filename)
+		name, err := linkUnique(p.staged, base)
+		published = err == nil
+		err = cfg.observe(StageLink, start, err)
+		if err != nil {
+			return false, &werror{"linking file", err}
+		}
+		*cfg.unique = strings.TrimSuffix(filename, base) + name
+		linked = name
+	} else if cfg.replace {
+		cfg.debug("linking file", "strategy", "replace", "name", filename)
+		backup, published, err = replaceFile(p.staged, dirfd, base, cfg)
+		err = cfg.observe(StageReplace, start, err)
+		if err != nil {
+			return false, err
+		}
+		if backup != "" {
+			backup = strings.TrimSuffix(filename, base) + backup
+		}
+	} else {
+		cfg.debug("linking file", "strategy", "link", "name", filename)
+		err := p.staged.Link(base)
+		published = err == nil
+		err = cfg.observe(StageLink, start, err)
+		if err != nil {
+			return false, &werror{"linking file", err}
+		}
+	}
+
+	if set := cfg.inodeSet & lateInodeFlags; set != 0 {
+		err := setInodeFlags(int(f.Fd()), set, 0)
+		if err != nil {
+			return false, &werror{"setting inode flags", err}
+		}
+		if cfg.durability >= DurabilityFull {
+			err := f.Sync()
+			if err != nil {
+				return false, &werror{"fsync file", err}
+			}
 		}
 	}
 
-	if cfg.fsync {
+	if !p.deferSync && (cfg.durability >= DurabilityFull || cfg.syncParents) {
+		start := time.Now()
 		err := d.Sync()
 		if err != nil {
-			return &werror{"fsync directory", err}
+			cfg.observe(StageDirSync, start, err)
+			return false, &werror{"fsync directory", err}
+		}
+		if cfg.durability >= DurabilityParanoid || cfg.syncParents {
+			err := syncParentsAt(dirfd)
+			if err != nil {
+				cfg.observe(StageDirSync, start, err)
+				return false, &werror{"fsync parent directories", err}
+			}
+		}
+		if err := cfg.observe(StageDirSync, start, nil); err != nil {
+			return false, &werror{"fsync directory", err}
 		}
 	}
 
+	if cfg.dontNeed {
+		// TODO: this should be done incrementally in the io.Copy loop
+		_ = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+	} else if cfg.willNeed {
+		_ = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_WILLNEED)
+	}
+
+	r := Result{Written: p.written, Backup: backup}
+	if m, ok := p.staged.(mechanism); ok {
+		r.Strategy = m.mechanism()
+	}
+	if cfg.verifyCommit {
+		if err := checkLinked(dirfd, linked, f); err != nil {
+			// the file has been committed, so the result is reported anyway
+			cfg.report(&r)
+			return false, &werror{"verifying target file", &os.PathError{Op: "statx", Path: strings.TrimSuffix(filename, base) + linked, Err: err}}
+		}
+	}
+	if cfg.lock || cfg.keepOpen {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, &werror{"seeking file", err}
+		}
+		r.File = f
+	}
+	p.result = r
+	if p.deferSync {
+		return r.File != nil, nil
+	}
+	return r.File != nil, p.finish()
+}
+
+// finish reports the result of the creation of the committed file, and
+// invokes the AfterCommit hooks.
+func (p *Pending) finish() error {
+	p.cfg.report(&p.result)
+	for _, fn := range p.cfg.afterCommit {
+		if err := fn(p.result); err != nil {
+			return &werror{"running AfterCommit hook", err}
+		}
+	}
 	return nil
 }
 
-type werror struct {
-	msg   string
-	cause error
+// report adds to r the digests computed by the Hash options, and stores it
+// in the Result specified with Report, if any.
+func (c *config) report(r *Result) {
+	for _, h := range c.hashes {
+		r.Sums = append(r.Sums, h.Sum(nil))
+	}
+	if c.result != nil {
+		*c.result = *r
+	}
+}
+
+// linkFile links the unnamed file f as name in the directory dirfd, using
+// linkat with AT_EMPTY_PATH or, if that fails, through /proc/self/fd (unless
+// NoProcLink is specified), and returns the mechanism that was used. If mode
+// is StrategyLinkat or StrategyProcLink, only the corresponding mechanism is
+// used (see ForceStrategy). If linkat with AT_EMPTY_PATH already failed in
+// the same directory (see dirCache), /proc/self/fd is used directly.
+func linkFile(f *os.File, dirfd int, name string, mode BuiltinStrategy, cfg *config) (BuiltinStrategy, error) {
+	const AT_EMPTY_PATH = 0x1000
+	fallback := false
+	if mode != StrategyProcLink && (!cfg.dirCache.has(noEmptyPath) || mode == StrategyLinkat || cfg.noProcLink) {
+		err := unix.Linkat(int(f.Fd()), "", dirfd, name, AT_EMPTY_PATH)
+		if err == nil || err == unix.EEXIST || mode == StrategyLinkat || cfg.noProcLink {
+			return StrategyLinkat, err
+		}
+		cfg.debug("linkat with AT_EMPTY_PATH failed, falling back to /proc/self/fd", "error", err)
+		fallback = true
+	}
+	proc := cfg.procMount
+	if proc == "" {
+		proc = "/proc"
+	}
+	procPath := path.Join(proc, "self/fd", strconv.Itoa(int(f.Fd())))
+	err := unix.Linkat(unix.AT_FDCWD, procPath, dirfd, name, unix.AT_SYMLINK_FOLLOW)
+	if err != nil && err != unix.EEXIST {
+		// report the path used, as the failure is often caused by procfs
+		// not being mounted (or being masked) in containers
+		return StrategyProcLink, &os.LinkError{Op: "linkat", Old: procPath, New: name, Err: err}
+	}
+	if fallback && err == nil {
+		// the fallback works where AT_EMPTY_PATH does not, so it is used
+		// directly for the next files
+		cfg.dirCache.set(noEmptyPath)
+	}
+	return StrategyProcLink, err
+}
+
+// replaceFile publishes the staged file s as name in the directory dirfd,
+// replacing the existing file if all the preconditions hold. Unless only
+// a plain replacement is requested, s is first linked with a temporary name
+// that is then renamed over name. If a backup is requested, its name is
+// returned. replaceFile also reports whether s has been published as name,
+// as it may fail afterwards (e.g. if the backup can not be renamed).
+func replaceFile(s Staged, dirfd int, name string, cfg *config) (string, bool, error) {
+	if len(cfg.preconditions) == 0 && cfg.backupSuffix == "" && cfg.backupRotate == 0 {
+		if err := s.Replace(name); err != nil {
+			return "", false, &werror{"renaming file", err}
+		}
+		return "", true, nil
+	}
+
+	tmp, err := linkTemp(s, name, cfg)
+	if err != nil {
+		return "", false, &werror{"linking file", err}
+	}
+
+	if len(cfg.preconditions) > 0 {
+		err := checkPreconditions(dirfd, name, cfg.preconditions)
+		if err != nil {
+			_ = unix.Unlinkat(dirfd, tmp, 0)
+			return "", false, &werror{"checking preconditions", err}
+		}
+	}
+
+	if cfg.backupSuffix != "" || cfg.backupRotate > 0 {
+		return backupFile(dirfd, tmp, name, cfg)
+	}
+
+	err = renameAt(dirfd, tmp, name, false)
+	if err != nil {
+		_ = unix.Unlinkat(dirfd, tmp, 0)
+		return "", false, &werror{"renaming file", err}
+	}
+	return "", true, nil
 }
 
-func (e *werror) Error() string {
-	if e.cause == nil {
-		return e.msg
+// hasContents reports whether name in the directory dirfd is a regular file
+// with the specified size whose contents have the specified SHA-256 digest.
+// If name does not exist, hasContents returns false.
+func hasContents(dirfd int, name string, size int64, sum []byte) (bool, error) {
+	f, err := openAt(dirfd, name, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ELOOP) {
+		return false, nil
+	} else if err != nil {
+		return false, err
 	}
-	return e.msg + ": " + e.cause.Error()
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !fi.Mode().IsRegular() || fi.Size() != size {
+		return false, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return bytes.Equal(h.Sum(nil), sum), nil
 }
 
-func (e *werror) Unwrap() error {
-	return e.cause
+// debugLogger is the interface used to emit debug logs (see WithLogger).
+// It is implemented by *slog.Logger.
+type debugLogger interface {
+	Debug(msg string, args ...interface{})
+}
+
+// debug emits a debug log through the logger specified with WithLogger,
+// if any. args are alternating keys and values, as in slog.
+func (c *config) debug(msg string, args ...interface{}) {
+	if c.logger != nil {
+		c.logger.Debug(msg, args...)
+	}
+}
+
+// contentSize returns the expected size of the contents, as specified by
+// ContentSize or as guessed from the reader passed to Contents.
+func (c *config) contentSize() int64 {
+	if c.sizeHint != defaultConfig().sizeHint {
+		return c.sizeHint
+	}
+	if c.expectSize != defaultConfig().expectSize {
+		return c.expectSize
+	}
+	return guessContentSize(c.contents)
 }
 
 func guessContentSize(r io.Reader) int64 {
@@ -330,6 +1103,12 @@ func guessContentSize(r io.Reader) int64 {
 			return n
 		}
 		return r.N
+	case SizeHinter:
+		if n := r.SizeHint(); n > 0 {
+			return n
+		}
+	case interface{ Len() int }:
+		return int64(r.Len())
 	}
 	return 0
 }
@@ -342,3 +1121,98 @@ func futimens(fd int, times *[2]unix.Timespec) (err error) {
 	}
 	return
 }
+
+// listXattrs returns all extended attributes of the file fd.
+func listXattrs(fd int) ([]xattr, error) {
+	var names []byte
+	for {
+		sz, err := unix.Flistxattr(fd, nil)
+		if err == unix.ENOTSUP {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		names = make([]byte, sz)
+		sz, err = unix.Flistxattr(fd, names)
+		if err == unix.ERANGE {
+			continue // the list grew in the meantime
+		} else if err != nil {
+			return nil, err
+		}
+		names = names[:sz]
+		break
+	}
+
+	var xattrs []xattr
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+		for {
+			sz, err := unix.Fgetxattr(fd, name, nil)
+			if err == unix.ENODATA {
+				break // removed in the meantime
+			} else if err != nil {
+				return nil, err
+			}
+			value := make([]byte, sz)
+			sz, err = unix.Fgetxattr(fd, name, value)
+			if err == unix.ERANGE {
+				continue // the value grew in the meantime
+			} else if err == unix.ENODATA {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			xattrs = append(xattrs, xattr{name, value[:sz]})
+			break
+		}
+	}
+	return xattrs, nil
+}
+
+// rename renames oldpath to newpath, optionally failing if newpath exists.
+func rename(oldpath, newpath string, noReplace bool) error {
+	return renameAt(unix.AT_FDCWD, oldpath, newpath, noReplace)
+}
+
+// renameAt is like rename, but relative paths are resolved relative to the
+// directory dirfd.
+func renameAt(dirfd int, oldpath, newpath string, noReplace bool) error {
+	var err error
+	if noReplace {
+		err = unix.Renameat2(dirfd, oldpath, dirfd, newpath, unix.RENAME_NOREPLACE)
+	} else {
+		err = unix.Renameat(dirfd, oldpath, dirfd, newpath)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// syncParents fsyncs all parent directories of the specified directory,
+// up to the mount point of the filesystem containing it. The specified
+// directory itself is not fsynced.
+func syncParents(dir string) error {
+	d, err := openAt(unix.AT_FDCWD, dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return syncParentsAt(int(d.Fd()))
+}
+
+// syncDir fsyncs the specified directory.
+func syncDir(dir string) error {
+	// on Linux the directory fd can be opened as read-only for fsync
+	d, err := os.OpenFile(dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
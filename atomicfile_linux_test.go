@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestOnlyIfChanged(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	writeFile(t, name, "same")
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		contents  string
+		unchanged bool
+	}{
+		{"same", true},
+		{"other", false},
+	} {
+		var r atomicfile.Result
+		err := atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader([]byte(tc.contents))),
+			atomicfile.Replace(),
+			atomicfile.OnlyIfChanged(),
+			atomicfile.Report(&r),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, name, tc.contents)
+		if r.Unchanged != tc.unchanged {
+			t.Fatalf("Unchanged is %v, expected %v", r.Unchanged, tc.unchanged)
+		}
+		if tc.unchanged {
+			nfi, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(fi, nfi) {
+				t.Fatal("unchanged file was replaced")
+			}
+		}
+	}
+}
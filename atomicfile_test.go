@@ -0,0 +1,118 @@
+//go:build linux || freebsd || netbsd || openbsd || solaris || js || plan9
+// +build linux freebsd netbsd openbsd solaris js plan9
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.Permissions(0o640),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file")
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o640 {
+		t.Fatalf("permissions are %v, expected %v", fi.Mode().Perm(), os.FileMode(0o640))
+	}
+
+	// the target file is not replaced by default
+	err = atomicfile.Create(name, atomicfile.Contents(bytes.NewReader([]byte("new"))))
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file")
+}
+
+func TestCreateEmpty(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	if err := atomicfile.Create(name); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "")
+	checkDirEntries(t, dir, "file")
+}
+
+func TestReplace(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	for _, contents := range []string{"old", "new"} {
+		err := atomicfile.Create(name, atomicfile.Contents(bytes.NewReader([]byte(contents))), atomicfile.Replace())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, name, contents)
+		checkDirEntries(t, dir, "file")
+	}
+
+	err := atomicfile.Create(name, atomicfile.Replace(), atomicfile.NoReplace())
+	if err == nil {
+		t.Fatal("Replace and NoReplace did not conflict")
+	}
+	checkFile(t, name, "new")
+}
+
+func checkFile(t *testing.T, name, contents string) {
+	t.Helper()
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != contents {
+		if len(buf) > 64 || len(contents) > 64 {
+			t.Fatalf("file %s has the wrong contents (%d bytes, expected %d)", name, len(buf), len(contents))
+		}
+		t.Fatalf("file %s contains %q, expected %q", name, buf, contents)
+	}
+}
+
+func writeFile(t *testing.T, name, contents string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkDirEntries checks that dir contains exactly the specified entries,
+// e.g. that no temporary files were left behind.
+func checkDirEntries(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	if len(got) != len(names) {
+		t.Fatalf("directory %s contains %q, expected %q", dir, got, names)
+	}
+	for i := range got {
+		if got[i] != names[i] {
+			t.Fatalf("directory %s contains %q, expected %q", dir, got, names)
+		}
+	}
+}
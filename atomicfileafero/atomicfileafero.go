@@ -0,0 +1,193 @@
+// Package atomicfileafero provides atomic writes over an afero.Fs.
+package atomicfileafero
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/CAFxX/atomicfile"
+	"github.com/spf13/afero"
+)
+
+// Option is the interface for options passed to Create.
+type Option func(*config) error
+
+type config struct {
+	contents io.Reader
+	perm     os.FileMode
+	replace  bool
+	fsync    bool
+}
+
+// Contents specifies the contents to be written to the target file.
+func Contents(r io.Reader) Option {
+	return func(c *config) error {
+		if c.contents != nil {
+			return errors.New("multiple contents")
+		}
+		c.contents = r
+		return nil
+	}
+}
+
+// Permissions specifies the permissions of the target file. If no
+// permissions are specified, the target file is created with permissions
+// 0666 (masked by the umask of the process, if fs is backed by the OS
+// filesystem).
+func Permissions(mode os.FileMode) Option {
+	return func(c *config) error {
+		if c.perm != 0 {
+			return errors.New("multiple permissions")
+		}
+		c.perm = mode
+		return nil
+	}
+}
+
+// Replace makes Create atomically replace the target file if it already
+// exists.
+func Replace() Option {
+	return func(c *config) error {
+		c.replace = true
+		return nil
+	}
+}
+
+// Fsync makes Create sync the target file to stable storage before it is
+// published.
+func Fsync() Option {
+	return func(c *config) error {
+		c.fsync = true
+		return nil
+	}
+}
+
+// Create creates filename in fs with the provided options, so that other
+// users of fs observe either no file (or the previous file, if Replace is
+// specified) or the complete new file.
+// If fs is an *afero.OsFs, Create delegates to atomicfile.Create, unless it
+// is not supported on the current platform. Otherwise the contents are
+// written to a temporary file in the same directory, that is then renamed as
+// the target file: as afero.Fs does not support hard links, without Replace
+// Create checks that the target file does not exist before renaming, so a
+// target file created concurrently by another user of fs may be replaced.
+// Create fails if the file already exists, unless Replace is specified.
+func Create(fs afero.Fs, filename string, options ...Option) error {
+	var cfg config
+	for _, o := range options {
+		if err := o(&cfg); err != nil {
+			return &werror{"options", err}
+		}
+	}
+
+	if _, ok := fs.(*afero.OsFs); ok {
+		err := atomicfile.Create(filename, cfg.atomicfileOptions()...)
+		if !errors.Is(err, atomicfile.ErrUnsupported) {
+			return err
+		}
+	}
+
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	perm := cfg.perm
+	if perm == 0 {
+		perm = 0o666
+	}
+	f, tmp, err := createTemp(fs, dir, base)
+	if err != nil {
+		return &werror{"opening file", err}
+	}
+	defer func() {
+		if tmp != "" {
+			_ = f.Close()
+			_ = fs.Remove(tmp)
+		}
+	}()
+
+	if cfg.contents != nil {
+		if _, err := io.Copy(f, cfg.contents); err != nil {
+			return &werror{"populating file", err}
+		}
+	}
+	if cfg.fsync {
+		if err := f.Sync(); err != nil {
+			return &werror{"fsync file", err}
+		}
+	}
+	if err := f.Close(); err != nil {
+		return &werror{"closing file", err}
+	}
+	if err := fs.Chmod(tmp, perm); err != nil {
+		return &werror{"setting permissions", err}
+	}
+
+	if !cfg.replace {
+		if _, err := fs.Stat(filename); err == nil {
+			return &werror{"linking file", &os.LinkError{Op: "link", Old: tmp, New: filename, Err: os.ErrExist}}
+		}
+	}
+	if err := fs.Rename(tmp, filename); err != nil {
+		return &werror{"renaming file", err}
+	}
+	tmp = ""
+	return nil
+}
+
+// atomicfileOptions returns the atomicfile options equivalent to c.
+func (c *config) atomicfileOptions() []atomicfile.Option {
+	var options []atomicfile.Option
+	if c.contents != nil {
+		options = append(options, atomicfile.Contents(c.contents))
+	}
+	if c.perm != 0 {
+		options = append(options, atomicfile.PermissionsMasked(c.perm))
+	}
+	if c.replace {
+		options = append(options, atomicfile.Replace())
+	}
+	if c.fsync {
+		options = append(options, atomicfile.Fsync())
+	}
+	return options
+}
+
+// createTemp creates a new file with a random name in the directory dir of
+// fs, suitable for a temporary file that will become base, and returns it
+// together with its path.
+func createTemp(fs afero.Fs, dir, base string) (afero.File, string, error) {
+	for i := 0; ; i++ {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, "", err
+		}
+		name := filepath.Join(dir, "."+base+"."+hex.EncodeToString(b[:])+".tmp")
+		f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			return f, name, nil
+		} else if !errors.Is(err, os.ErrExist) || i >= 100 {
+			return nil, "", err
+		}
+	}
+}
+
+type werror struct {
+	msg   string
+	cause error
+}
+
+func (e *werror) Error() string {
+	if e.cause == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.cause.Error()
+}
+
+func (e *werror) Unwrap() error {
+	return e.cause
+}
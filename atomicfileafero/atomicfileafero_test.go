@@ -0,0 +1,86 @@
+package atomicfileafero_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile/atomicfileafero"
+	"github.com/spf13/afero"
+)
+
+func TestCreate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fs   afero.Fs
+		dir  string
+	}{
+		{"mem", afero.NewMemMapFs(), "/dir"},
+		{"os", afero.NewOsFs(), t.TempDir()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.fs.MkdirAll(tc.dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			name := filepath.Join(tc.dir, "file")
+			err := atomicfileafero.Create(tc.fs, name,
+				atomicfileafero.Contents(bytes.NewReader([]byte("hello"))),
+				atomicfileafero.Permissions(0o600),
+				atomicfileafero.Fsync(),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, tc.fs, name, "hello", 0o600)
+
+			err = atomicfileafero.Create(tc.fs, name, atomicfileafero.Contents(bytes.NewReader([]byte("new"))))
+			if !errors.Is(err, os.ErrExist) {
+				t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+			}
+			checkFile(t, tc.fs, name, "hello", 0o600)
+
+			err = atomicfileafero.Create(tc.fs, name,
+				atomicfileafero.Contents(bytes.NewReader([]byte("new"))),
+				atomicfileafero.Replace(),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, tc.fs, name, "new", 0o644)
+
+			// no temporary files are left behind
+			entries, err := afero.ReadDir(tc.fs, tc.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("directory contains %d entries, expected 1", len(entries))
+			}
+
+			err = atomicfileafero.Create(tc.fs, name, atomicfileafero.Permissions(0o600), atomicfileafero.Permissions(0o600))
+			if err == nil {
+				t.Fatal("multiple permissions accepted")
+			}
+		})
+	}
+}
+
+func checkFile(t *testing.T, fs afero.Fs, name, contents string, perm os.FileMode) {
+	t.Helper()
+	buf, err := afero.ReadFile(fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != contents {
+		t.Fatalf("file %s contains %q, expected %q", name, buf, contents)
+	}
+	fi, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&^0o022 != perm&^0o022 {
+		t.Fatalf("file %s has permissions %v, expected %v", name, fi.Mode().Perm(), perm)
+	}
+}
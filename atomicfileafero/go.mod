@@ -0,0 +1,15 @@
+module github.com/CAFxX/atomicfile/atomicfileafero
+
+go 1.21
+
+require (
+	github.com/CAFxX/atomicfile v0.0.0
+	github.com/spf13/afero v1.11.0
+)
+
+require (
+	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
+
+replace github.com/CAFxX/atomicfile => ../
@@ -0,0 +1,230 @@
+// Package atomicfilebilly provides atomic writes over a go-billy filesystem.
+package atomicfilebilly
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/CAFxX/atomicfile"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-billy/v5/helper/polyfill"
+	"github.com/go-git/go-billy/v5/osfs"
+)
+
+// Option is the interface for options passed to Create.
+type Option func(*config) error
+
+type config struct {
+	contents io.Reader
+	perm     os.FileMode
+	replace  bool
+	fsync    bool
+}
+
+// Contents specifies the contents to be written to the target file.
+func Contents(r io.Reader) Option {
+	return func(c *config) error {
+		if c.contents != nil {
+			return errors.New("multiple contents")
+		}
+		c.contents = r
+		return nil
+	}
+}
+
+// Permissions specifies the permissions of the target file. If no
+// permissions are specified, the target file is created with permissions
+// 0666 (masked by the umask of the process, if fs is backed by the OS
+// filesystem). The permissions are set exactly as specified only if fs
+// implements billy.Change; otherwise they are passed to OpenFile when the
+// temporary file is created.
+func Permissions(mode os.FileMode) Option {
+	return func(c *config) error {
+		if c.perm != 0 {
+			return errors.New("multiple permissions")
+		}
+		c.perm = mode
+		return nil
+	}
+}
+
+// Replace makes Create atomically replace the target file if it already
+// exists.
+func Replace() Option {
+	return func(c *config) error {
+		c.replace = true
+		return nil
+	}
+}
+
+// Fsync makes Create sync the target file to stable storage before it is
+// published, if the files of fs implement a Sync method (as *os.File does).
+func Fsync() Option {
+	return func(c *config) error {
+		c.fsync = true
+		return nil
+	}
+}
+
+// Create creates filename in fs with the provided options, so that other
+// users of fs observe either no file (or the previous file, if Replace is
+// specified) or the complete new file.
+// If fs is backed by the OS filesystem (as the filesystems returned by
+// osfs.New are, unless osfs.WithBoundOS is specified), Create delegates to
+// atomicfile.Create (unless it is not supported on the current platform),
+// creating the missing parent directories like osfs does. Otherwise the contents are written to a temporary file in the same
+// directory, that is then renamed as the target file: as billy.Basic does not
+// support hard links, without Replace Create checks that the target file does
+// not exist before renaming it, so a target file created concurrently by
+// another user of fs between the check and the rename is replaced.
+// Create fails if the file already exists, unless Replace is specified.
+func Create(fs billy.Basic, filename string, options ...Option) error {
+	var cfg config
+	for _, o := range options {
+		if err := o(&cfg); err != nil {
+			return &werror{"options", err}
+		}
+	}
+
+	if name, ok := osPath(fs, filename); ok {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return &werror{"creating directory", err}
+		}
+		err := atomicfile.Create(name, cfg.atomicfileOptions()...)
+		if !errors.Is(err, atomicfile.ErrUnsupported) {
+			return err
+		}
+	}
+
+	perm := cfg.perm
+	if perm == 0 {
+		perm = 0o666
+	}
+	f, tmp, err := createTemp(fs, filename, perm)
+	if err != nil {
+		return &werror{"opening file", err}
+	}
+	closed := false
+	defer func() {
+		if tmp != "" {
+			if !closed {
+				_ = f.Close()
+			}
+			_ = fs.Remove(tmp)
+		}
+	}()
+
+	if cfg.contents != nil {
+		if _, err := io.Copy(f, cfg.contents); err != nil {
+			return &werror{"populating file", err}
+		}
+	}
+	if s, ok := f.(interface{ Sync() error }); ok && cfg.fsync {
+		if err := s.Sync(); err != nil {
+			return &werror{"fsync file", err}
+		}
+	}
+	closed = true
+	if err := f.Close(); err != nil {
+		return &werror{"closing file", err}
+	}
+	if c, ok := fs.(billy.Change); ok && cfg.perm != 0 {
+		if err := c.Chmod(tmp, cfg.perm); err != nil {
+			return &werror{"setting permissions", err}
+		}
+	}
+
+	// without hard links, the check and the rename are not atomic
+	if !cfg.replace {
+		if _, err := fs.Stat(filename); err == nil {
+			return &werror{"linking file", &os.LinkError{Op: "link", Old: tmp, New: filename, Err: os.ErrExist}}
+		}
+	}
+	if err := fs.Rename(tmp, filename); err != nil {
+		return &werror{"renaming file", err}
+	}
+	tmp = ""
+	return nil
+}
+
+// osPath returns the path in the OS filesystem of filename in fs, if fs is
+// backed by it.
+func osPath(fs billy.Basic, filename string) (string, bool) {
+	root := ""
+	if c, ok := fs.(*chroot.ChrootHelper); ok {
+		// the paths outside of the root are rejected by fs
+		clean := filepath.Clean(filepath.FromSlash(filename))
+		if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return "", false
+		}
+		root, fs = c.Root(), c.Underlying()
+		if p, ok := fs.(*polyfill.Polyfill); ok {
+			fs = p.Basic
+		}
+	}
+	if _, ok := fs.(*osfs.ChrootOS); !ok {
+		return "", false
+	}
+	return filepath.Join(root, filename), true
+}
+
+// atomicfileOptions returns the atomicfile options equivalent to c.
+func (c *config) atomicfileOptions() []atomicfile.Option {
+	var options []atomicfile.Option
+	if c.contents != nil {
+		options = append(options, atomicfile.Contents(c.contents))
+	}
+	if c.perm != 0 {
+		options = append(options, atomicfile.PermissionsMasked(c.perm))
+	}
+	if c.replace {
+		options = append(options, atomicfile.Replace())
+	}
+	if c.fsync {
+		options = append(options, atomicfile.Fsync())
+	}
+	return options
+}
+
+// createTemp creates a new file with a random name and permissions perm in
+// fs, in the same directory as filename, and returns it together with its
+// path.
+func createTemp(fs billy.Basic, filename string, perm os.FileMode) (billy.File, string, error) {
+	for i := 0; ; i++ {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, "", err
+		}
+		dir, base := path.Split(filename)
+		name := fs.Join(dir, "."+base+"."+hex.EncodeToString(b[:])+".tmp")
+		f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if err == nil {
+			return f, name, nil
+		} else if !errors.Is(err, os.ErrExist) || i >= 100 {
+			return nil, "", err
+		}
+	}
+}
+
+type werror struct {
+	msg   string
+	cause error
+}
+
+func (e *werror) Error() string {
+	if e.cause == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.cause.Error()
+}
+
+func (e *werror) Unwrap() error {
+	return e.cause
+}
@@ -0,0 +1,115 @@
+package atomicfilebilly_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile/atomicfilebilly"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+)
+
+func TestCreate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fs   billy.Filesystem
+	}{
+		{"mem", memfs.New()},
+		{"os", osfs.New(t.TempDir())},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.fs.MkdirAll("dir", 0o755); err != nil {
+				t.Fatal(err)
+			}
+			name := tc.fs.Join("dir", "file")
+			err := atomicfilebilly.Create(tc.fs, name,
+				atomicfilebilly.Contents(bytes.NewReader([]byte("hello"))),
+				atomicfilebilly.Permissions(0o600),
+				atomicfilebilly.Fsync(),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, tc.fs, name, "hello", 0o600)
+
+			err = atomicfilebilly.Create(tc.fs, name, atomicfilebilly.Contents(bytes.NewReader([]byte("new"))))
+			if !errors.Is(err, os.ErrExist) {
+				t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+			}
+			checkFile(t, tc.fs, name, "hello", 0o600)
+
+			err = atomicfilebilly.Create(tc.fs, name,
+				atomicfilebilly.Contents(bytes.NewReader([]byte("new"))),
+				atomicfilebilly.Replace(),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, tc.fs, name, "new", 0o644)
+
+			// no temporary files are left behind
+			entries, err := tc.fs.ReadDir("dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("directory contains %d entries, expected 1", len(entries))
+			}
+		})
+	}
+}
+
+func TestCreateOS(t *testing.T) {
+	dir := t.TempDir()
+	fs := osfs.New(dir)
+
+	// the missing parent directories are created, like osfs does
+	name := fs.Join("a", "b", "file")
+	if err := atomicfilebilly.Create(fs, name, atomicfilebilly.Contents(bytes.NewReader([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, "a", "b", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("file contains %q, expected %q", buf, "hello")
+	}
+
+	// the paths outside of the root are rejected
+	err = atomicfilebilly.Create(fs, "../file", atomicfilebilly.Contents(bytes.NewReader([]byte("hello"))))
+	if err == nil {
+		t.Fatal("expected an error creating a file outside of the root")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "file")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("file created outside of the root: %v", err)
+	}
+}
+
+func checkFile(t *testing.T, fs billy.Filesystem, name, contents string, perm os.FileMode) {
+	t.Helper()
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != contents {
+		t.Fatalf("file %s contains %q, expected %q", name, buf, contents)
+	}
+	fi, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&^0o022 != perm&^0o022 {
+		t.Fatalf("file %s has permissions %v, expected %v", name, fi.Mode().Perm(), perm)
+	}
+}
@@ -0,0 +1,15 @@
+module github.com/CAFxX/atomicfile/atomicfilebilly
+
+go 1.21
+
+require (
+	github.com/CAFxX/atomicfile v0.0.0
+	github.com/go-git/go-billy/v5 v5.5.0
+)
+
+require (
+	github.com/cyphar/filepath-securejoin v0.2.4 // indirect
+	golang.org/x/sys v0.12.0 // indirect
+)
+
+replace github.com/CAFxX/atomicfile => ../
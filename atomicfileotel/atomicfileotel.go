@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+// Package atomicfileotel provides OpenTelemetry tracing for atomicfile.
+package atomicfileotel
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sys/unix"
+)
+
+// ScopeName is the instrumentation scope name used for the tracer obtained
+// from the global TracerProvider.
+const ScopeName = "github.com/CAFxX/atomicfile/atomicfileotel"
+
+// Create is like atomicfile.Create, but it records a span for the creation
+// of the target file, and a child span for each of the stages performed by
+// atomicfile.Create (see atomicfile.Observe), using the tracer obtained from
+// the global TracerProvider. The span of the target file records its path,
+// the type of the filesystem containing it, whether it was linked or replaced
+// and the number of bytes written to it.
+func Create(ctx context.Context, filename string, options ...atomicfile.Option) error {
+	return CreateWithTracer(ctx, otel.Tracer(ScopeName), filename, options...)
+}
+
+// CreateWithTracer is like Create, but it uses the specified tracer.
+func CreateWithTracer(ctx context.Context, tracer trace.Tracer, filename string, options ...atomicfile.Option) error {
+	ctx, span := tracer.Start(ctx, "atomicfile.Create", trace.WithAttributes(
+		attribute.String("file.path", filename),
+		attribute.String("file.system.type", fsType(filename)),
+	))
+	defer span.End()
+
+	observe := atomicfile.Observe(func(stage atomicfile.Stage, d time.Duration, err error) {
+		end := time.Now()
+		_, s := tracer.Start(ctx, "atomicfile."+stage.String(), trace.WithTimestamp(end.Add(-d)))
+		if err != nil {
+			s.RecordError(err)
+			s.SetStatus(codes.Error, err.Error())
+		}
+		s.End(trace.WithTimestamp(end))
+		if err == nil && (stage == atomicfile.StageLink || stage == atomicfile.StageReplace) {
+			span.SetAttributes(attribute.String("atomicfile.strategy", stage.String()))
+		}
+	})
+	report := atomicfile.AfterCommit(func(r atomicfile.Result) error {
+		span.SetAttributes(attribute.Int64("atomicfile.written", r.Written))
+		if r.Backup != "" {
+			span.SetAttributes(attribute.String("atomicfile.backup", r.Backup))
+		}
+		return nil
+	})
+
+	err := atomicfile.Create(filename, append(options[:len(options):len(options)], observe, report)...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// fsTypes maps the filesystem magic numbers returned by statfs(2) to the
+// names of the most common filesystems.
+var fsTypes = map[int64]string{
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.EXT4_SUPER_MAGIC:      "ext4",
+	unix.F2FS_SUPER_MAGIC:      "f2fs",
+	unix.FUSE_SUPER_MAGIC:      "fuse",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+}
+
+// fsType returns the name of the type of the filesystem containing the
+// directory of filename, or its magic number if it is not known.
+func fsType(filename string) string {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path.Dir(filename), &st); err != nil {
+		return "unknown"
+	}
+	if name, ok := fsTypes[int64(st.Type)]; ok {
+		return name
+	}
+	return "0x" + strconv.FormatInt(int64(st.Type), 16)
+}
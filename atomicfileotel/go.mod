@@ -0,0 +1,18 @@
+module github.com/CAFxX/atomicfile/atomicfileotel
+
+go 1.21
+
+require (
+	github.com/CAFxX/atomicfile v0.0.0
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	golang.org/x/sys v0.8.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.opentelemetry.io/otel/metric v1.28.0 // indirect
+)
+
+replace github.com/CAFxX/atomicfile => ../
@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+// Package atomicfileprom provides Prometheus metrics for atomicfile.
+package atomicfileprom
+
+import (
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics collects metrics about the files created with its Create method.
+// Metrics implements prometheus.Collector, so it can be registered with a
+// prometheus.Registerer.
+type Metrics struct {
+	operations *prometheus.CounterVec
+	failures   *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	written    prometheus.Histogram
+}
+
+// New returns a new Metrics. The names of the metrics are prefixed with
+// namespace, if not empty.
+func New(namespace string) *Metrics {
+	return &Metrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "atomicfile",
+			Name:      "operations_total",
+			Help:      "Number of files successfully created (operation=\"create\") or replaced (operation=\"replace\").",
+		}, []string{"operation"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "atomicfile",
+			Name:      "failures_total",
+			Help:      "Number of files that could not be created, by the stage that failed.",
+		}, []string{"stage"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "atomicfile",
+			Name:      "stage_duration_seconds",
+			Help:      "Time spent in each stage of the creation of files.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 12),
+		}, []string{"stage"}),
+		written: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "atomicfile",
+			Name:      "written_bytes",
+			Help:      "Number of bytes written to the created files.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 12),
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.operations.Describe(ch)
+	m.failures.Describe(ch)
+	m.duration.Describe(ch)
+	m.written.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.operations.Collect(ch)
+	m.failures.Collect(ch)
+	m.duration.Collect(ch)
+	m.written.Collect(ch)
+}
+
+// Create is like atomicfile.Create, but it updates the metrics in m.
+// The duration of each stage performed by atomicfile.Create is recorded
+// using atomicfile.Observe. If Create fails, the failure is attributed to
+// the last stage that failed, or to the "other" stage if none did (e.g.
+// because of invalid options, or of a failed validation).
+func (m *Metrics) Create(filename string, options ...atomicfile.Option) error {
+	failed := "other"
+	operation := "create"
+	observe := atomicfile.Observe(func(stage atomicfile.Stage, d time.Duration, err error) {
+		m.duration.WithLabelValues(stage.String()).Observe(d.Seconds())
+		if err != nil {
+			failed = stage.String()
+		} else if stage == atomicfile.StageReplace {
+			operation = "replace"
+		}
+	})
+	report := atomicfile.AfterCommit(func(r atomicfile.Result) error {
+		m.written.Observe(float64(r.Written))
+		return nil
+	})
+
+	err := atomicfile.Create(filename, append(options[:len(options):len(options)], observe, report)...)
+	if err != nil {
+		m.failures.WithLabelValues(failed).Inc()
+		return err
+	}
+	m.operations.WithLabelValues(operation).Inc()
+	return nil
+}
@@ -0,0 +1,194 @@
+// Package atomicfiletest provides an in-memory implementation of
+// atomicfile.WriteFS, to test code that creates files with atomicfile
+// without touching the filesystem.
+package atomicfiletest
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+// File is a file stored in an FS.
+type File struct {
+	Data []byte
+	Perm os.FileMode
+	// Uid and Gid are -1 unless specified when the file was created.
+	Uid, Gid int
+}
+
+// Call records a call to WriteFile.
+type Call struct {
+	Name     string
+	Settings atomicfile.Settings
+	// Err is the error returned by WriteFile, if any.
+	Err error
+}
+
+// FS is an in-memory atomicfile.WriteFS. It records the calls to WriteFile,
+// fails like atomicfile.Create when a file already exists and Replace is not
+// specified, and can be made to fail at any stage (see FailAt).
+// An FS can be used concurrently by multiple goroutines.
+type FS struct {
+	mu       sync.Mutex
+	files    map[string]File
+	calls    []Call
+	failures map[atomicfile.Stage]error
+}
+
+// New returns an empty FS.
+func New() *FS {
+	return &FS{
+		files:    make(map[string]File),
+		failures: make(map[atomicfile.Stage]error),
+	}
+}
+
+// AddFile adds a file to fs, e.g. to simulate a file that already exists.
+// AddFile is not recorded as a call.
+func (fs *FS) AddFile(name string, f File) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[path.Clean(name)] = f
+}
+
+// File returns the file name, if it exists.
+func (fs *FS) File(name string) (File, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[path.Clean(name)]
+	return f, ok
+}
+
+// Names returns the sorted names of the files in fs.
+func (fs *FS) Names() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	names := make([]string, 0, len(fs.files))
+	for name := range fs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Calls returns the calls to WriteFile made so far, in order.
+func (fs *FS) Calls() []Call {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]Call(nil), fs.calls...)
+}
+
+// FailAt makes all subsequent calls to WriteFile that perform stage fail with
+// err at that stage, as atomicfile.Create would. A nil err removes the
+// failure. The target file is left untouched by calls that fail.
+func (fs *FS) FailAt(stage atomicfile.Stage, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err == nil {
+		delete(fs.failures, stage)
+	} else {
+		fs.failures[stage] = err
+	}
+}
+
+// WriteFile creates the file name in fs, as atomicfile.Create would. Only the
+// settings returned by atomicfile.Describe are honored, and the stages that
+// are simulated are StageOpen, StageChown, StageCopy, StageFsync, StageLink
+// (or StageReplace) and StageDirSync.
+func (fs *FS) WriteFile(name string, options ...atomicfile.Option) error {
+	s, err := atomicfile.Describe(options...)
+	if err == nil {
+		err = fs.writeFile(path.Clean(name), s)
+	}
+	fs.mu.Lock()
+	fs.calls = append(fs.calls, Call{Name: name, Settings: s, Err: err})
+	fs.mu.Unlock()
+	return err
+}
+
+func (fs *FS) writeFile(name string, s atomicfile.Settings) error {
+	if err := fs.fail(atomicfile.StageOpen); err != nil {
+		return &werror{"opening file", err}
+	}
+	if s.Uid != -1 || s.Gid != -1 {
+		if err := fs.fail(atomicfile.StageChown); err != nil {
+			return &werror{"setting ownership", err}
+		}
+	}
+
+	// the contents are read without holding the lock, as reading may block
+	var data []byte
+	if s.Contents != nil {
+		var err error
+		data, err = io.ReadAll(s.Contents)
+		if err == nil {
+			err = fs.fail(atomicfile.StageCopy)
+		}
+		if err != nil {
+			return &werror{"populating file", err}
+		}
+	}
+	if s.Durability >= atomicfile.DurabilityData {
+		if err := fs.fail(atomicfile.StageFsync); err != nil {
+			return &werror{"fsync file", err}
+		}
+	}
+
+	fs.mu.Lock()
+	if s.Replace {
+		if err := fs.failures[atomicfile.StageReplace]; err != nil {
+			fs.mu.Unlock()
+			return &werror{"renaming file", err}
+		}
+	} else {
+		err := fs.failures[atomicfile.StageLink]
+		if _, ok := fs.files[name]; ok && err == nil {
+			err = &os.LinkError{Op: "linkat", New: name, Err: syscall.EEXIST}
+		}
+		if err != nil {
+			fs.mu.Unlock()
+			return &werror{"linking file", err}
+		}
+	}
+	fs.files[name] = File{Data: data, Perm: s.Perm, Uid: s.Uid, Gid: s.Gid}
+	fs.mu.Unlock()
+
+	if s.Durability >= atomicfile.DurabilityFull {
+		if err := fs.fail(atomicfile.StageDirSync); err != nil {
+			return &werror{"fsync directory", err}
+		}
+	}
+	if s.Result != nil {
+		*s.Result = atomicfile.Result{Written: int64(len(data))}
+	}
+	return nil
+}
+
+// fail returns the error injected for stage, if any.
+func (fs *FS) fail(stage atomicfile.Stage) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.failures[stage]
+}
+
+type werror struct {
+	msg   string
+	cause error
+}
+
+func (e *werror) Error() string {
+	if e.cause == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.cause.Error()
+}
+
+func (e *werror) Unwrap() error {
+	return e.cause
+}
@@ -0,0 +1,89 @@
+package atomicfiletest_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+	"github.com/CAFxX/atomicfile/atomicfiletest"
+)
+
+var _ atomicfile.WriteFS = atomicfiletest.New()
+
+func TestFS(t *testing.T) {
+	fs := atomicfiletest.New()
+	fs.AddFile("existing", atomicfiletest.File{Data: []byte("old"), Perm: 0o644, Uid: -1, Gid: -1})
+
+	var r atomicfile.Result
+	err := fs.WriteFile("dir/file",
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.Permissions(0o600),
+		atomicfile.Report(&r),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := fs.File("dir/file")
+	if !ok || string(f.Data) != "hello" || f.Perm != 0o600 || f.Uid != -1 || f.Gid != -1 {
+		t.Fatalf("unexpected file %+v", f)
+	}
+	if r.Written != 5 {
+		t.Fatalf("Written is %d, expected 5", r.Written)
+	}
+
+	err = fs.WriteFile("existing", atomicfile.Contents(bytes.NewReader([]byte("new"))))
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+	}
+	if err := fs.WriteFile("existing", atomicfile.Replace()); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := fs.File("existing"); len(f.Data) != 0 {
+		t.Fatalf("file not replaced: %+v", f)
+	}
+	if err := fs.WriteFile("bad", atomicfile.Replace(), atomicfile.NoReplace()); err == nil {
+		t.Fatal("invalid options accepted")
+	}
+
+	names := fs.Names()
+	if len(names) != 2 || names[0] != "dir/file" || names[1] != "existing" {
+		t.Fatalf("Names returned %q", names)
+	}
+	calls := fs.Calls()
+	if len(calls) != 4 || calls[0].Name != "dir/file" || calls[0].Settings.Perm != 0o600 || calls[1].Err == nil || calls[2].Err != nil {
+		t.Fatalf("unexpected calls %+v", calls)
+	}
+}
+
+func TestFailAt(t *testing.T) {
+	fs := atomicfiletest.New()
+	errFault := errors.New("fault")
+
+	for _, tc := range []struct {
+		stage     atomicfile.Stage
+		options   []atomicfile.Option
+		published bool
+	}{
+		{atomicfile.StageOpen, nil, false},
+		{atomicfile.StageCopy, []atomicfile.Option{atomicfile.Contents(bytes.NewReader(nil))}, false},
+		{atomicfile.StageFsync, []atomicfile.Option{atomicfile.Fsync()}, false},
+		{atomicfile.StageLink, nil, false},
+		{atomicfile.StageReplace, []atomicfile.Option{atomicfile.Replace()}, false},
+		{atomicfile.StageDirSync, []atomicfile.Option{atomicfile.Fsync()}, true},
+	} {
+		fs.FailAt(tc.stage, errFault)
+		err := fs.WriteFile(tc.stage.String(), tc.options...)
+		if !errors.Is(err, errFault) {
+			t.Fatalf("%v: expected an error wrapping the fault, got %v", tc.stage, err)
+		}
+		if _, ok := fs.File(tc.stage.String()); ok != tc.published {
+			t.Fatalf("%v: file published: %v", tc.stage, ok)
+		}
+		fs.FailAt(tc.stage, nil)
+		if err := fs.WriteFile(tc.stage.String(), append(tc.options, atomicfile.Replace())...); err != nil {
+			t.Fatalf("%v: %v", tc.stage, err)
+		}
+	}
+}
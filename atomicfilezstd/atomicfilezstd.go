@@ -0,0 +1,23 @@
+// Package atomicfilezstd provides a zstd Codec for atomicfile.Compress.
+package atomicfilezstd
+
+import (
+	"io"
+
+	"github.com/CAFxX/atomicfile"
+	"github.com/klauspost/compress/zstd"
+)
+
+type codec struct {
+	level int
+}
+
+// Codec returns a Codec that compresses data in zstd format, using the
+// specified compression level (1 is the fastest, 22 the strongest).
+func Codec(level int) atomicfile.Codec {
+	return codec{level}
+}
+
+func (c codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+}
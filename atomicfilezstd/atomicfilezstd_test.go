@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package atomicfilezstd_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+	"github.com/CAFxX/atomicfile/atomicfilezstd"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCodec(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file")
+	contents := bytes.Repeat([]byte("hello "), 1<<16)
+
+	var r atomicfile.Result
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader(contents)),
+		atomicfile.Compress(atomicfilezstd.Codec(3)),
+		atomicfile.MaxSize(int64(len(contents))),
+		atomicfile.Report(&r),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Written != fi.Size() || r.Written >= int64(len(contents)) {
+		t.Fatalf("Written is %d, file size is %d", r.Written, fi.Size())
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	buf, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, contents) {
+		t.Fatal("decompressed contents differ")
+	}
+}
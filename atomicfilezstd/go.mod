@@ -0,0 +1,12 @@
+module github.com/CAFxX/atomicfile/atomicfilezstd
+
+go 1.21
+
+require (
+	github.com/CAFxX/atomicfile v0.0.0
+	github.com/klauspost/compress v1.15.15
+)
+
+require golang.org/x/sys v0.8.0 // indirect
+
+replace github.com/CAFxX/atomicfile => ../
@@ -0,0 +1,170 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Backup makes Create, when replacing an existing target file (see Replace),
+// preserve the previous version of the target file by renaming it to the
+// name of the target file followed by suffix (e.g. ".bak"), replacing any
+// previous backup.
+// The new file and the previous version are atomically exchanged using
+// RENAME_EXCHANGE, so that other processes always observe either the previous
+// or the new version of the target file; the previous version is then renamed
+// to the backup name, that is reported in Result.Backup (see Report).
+// If the target file does not exist, no backup is made.
+// Not all filesystems and kernel versions support RENAME_EXCHANGE.
+func Backup(suffix string) Option {
+	return optionFunc(func(c *config) error {
+		if c.backupSuffix != defaultConfig().backupSuffix || c.backupRotate != defaultConfig().backupRotate {
+			return &werror{"multiple backups", nil}
+		}
+		if suffix == "" || strings.Contains(suffix, "/") {
+			return &werror{"invalid backup suffix", nil}
+		}
+		c.backupSuffix = suffix
+		return nil
+	})
+}
+
+// BackupRotate is like Backup, but keeps the last n replaced versions of the
+// target file, using numbered suffixes like `cp --backup=numbered`: the
+// previous version of the target file is renamed to the name of the target
+// file followed by ".~N~", where N is one more than the highest number of the
+// existing backups, and the oldest backups are then removed so that at most
+// n remain.
+// Each step leaves the target file and its backups in a consistent state, so
+// that at most one additional backup is left behind in case of a crash.
+func BackupRotate(n int) Option {
+	return optionFunc(func(c *config) error {
+		if c.backupSuffix != defaultConfig().backupSuffix || c.backupRotate != defaultConfig().backupRotate {
+			return &werror{"multiple backups", nil}
+		}
+		if n < 1 {
+			return &werror{"invalid number of backups", nil}
+		}
+		c.backupRotate = n
+		return nil
+	})
+}
+
+// exchangeAt atomically exchanges oldpath and newpath, that must both exist,
+// resolved relative to the directory dirfd.
+func exchangeAt(dirfd int, oldpath, newpath string) error {
+	err := unix.Renameat2(dirfd, oldpath, dirfd, newpath, unix.RENAME_EXCHANGE)
+	if err != nil {
+		return &os.LinkError{Op: "exchange", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// backupFile exchanges tmp with name in the directory dirfd, and then
+// renames the previous version of name, now found at tmp, to its backup
+// name, that is returned. If name does not exist, tmp is renamed to name
+// and no backup is made. backupFile also reports whether tmp has been
+// published as name, even if it fails afterwards.
+func backupFile(dirfd int, tmp, name string, cfg *config) (string, bool, error) {
+	err := exchangeAt(dirfd, tmp, name)
+	if errIsNotExist(err) {
+		cfg.debug("target file does not exist, skipping backup", "name", name)
+		err = renameAt(dirfd, tmp, name, true)
+		if err != nil {
+			_ = unix.Unlinkat(dirfd, tmp, 0)
+			return "", false, &werror{"renaming file", err}
+		}
+		return "", true, nil
+	} else if err != nil {
+		_ = unix.Unlinkat(dirfd, tmp, 0)
+		return "", false, &werror{"exchanging file", err}
+	}
+
+	// the new file has been published: if the backup can not be renamed,
+	// the previous version is left at tmp
+	if cfg.backupRotate > 0 {
+		backup, err := rotateBackups(dirfd, tmp, name, cfg.backupRotate)
+		return backup, true, err
+	}
+
+	backup := name + cfg.backupSuffix
+	err = renameAt(dirfd, tmp, backup, false)
+	if err != nil {
+		return "", true, &werror{"renaming backup (previous version left at " + tmp + ")", err}
+	}
+	return backup, true, nil
+}
+
+// rotateBackups renames tmp to the next numbered backup of name, that is
+// returned, and then removes the oldest backups so that at most n remain.
+// It is called once the new file has been published, so its errors are
+// reported as such by backupFile.
+func rotateBackups(dirfd int, tmp, name string, n int) (string, error) {
+	nums, err := numberedBackups(dirfd, name)
+	if err != nil {
+		return "", &werror{"listing backups (previous version left at " + tmp + ")", err}
+	}
+	next := 1
+	if len(nums) > 0 {
+		next = nums[len(nums)-1] + 1
+	}
+
+	var backup string
+	for i := 0; ; i++ {
+		backup = numberedBackup(name, next)
+		err = renameAt(dirfd, tmp, backup, true)
+		if err == nil {
+			break
+		} else if !errIsExist(err) || i >= 100 {
+			return "", &werror{"renaming backup (previous version left at " + tmp + ")", err}
+		}
+		next++
+	}
+
+	nums, err = numberedBackups(dirfd, name)
+	if err != nil {
+		return "", &werror{"listing backups", err}
+	}
+	for len(nums) > n {
+		err := unix.Unlinkat(dirfd, numberedBackup(name, nums[0]), 0)
+		if err != nil && err != unix.ENOENT {
+			return "", &werror{"removing backup", err}
+		}
+		nums = nums[1:]
+	}
+	return backup, nil
+}
+
+// numberedBackups returns the numbers of the existing numbered backups of
+// name in the directory dirfd, in increasing order.
+func numberedBackups(dirfd int, name string) ([]int, error) {
+	// open a new fd, as reading the directory changes its offset
+	d, err := openAt(dirfd, ".", unix.O_DIRECTORY|os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	return backupNumbers(name, names), nil
+}
+
+func errIsNotExist(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		return le.Err == unix.ENOENT
+	}
+	return false
+}
+
+func errIsExist(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		return le.Err == unix.EEXIST
+	}
+	return false
+}
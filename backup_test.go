@@ -0,0 +1,175 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	for i, contents := range []string{"v1", "v2", "v3"} {
+		var r atomicfile.Result
+		err := atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader([]byte(contents))),
+			atomicfile.Replace(),
+			atomicfile.Backup(".bak"),
+			atomicfile.Report(&r),
+		)
+		if err != nil {
+			t.Skipf("RENAME_EXCHANGE not supported: %v", err)
+		}
+		checkFile(t, name, contents)
+		if i == 0 {
+			// no backup is made if the target file does not exist
+			if r.Backup != "" {
+				t.Fatalf("Backup is %q, expected none", r.Backup)
+			}
+			checkDirEntries(t, dir, "file")
+			continue
+		}
+		if r.Backup != name+".bak" {
+			t.Fatalf("Backup is %q, expected %q", r.Backup, name+".bak")
+		}
+		checkFile(t, filepath.Join(dir, "file.bak"), []string{"v1", "v2"}[i-1])
+		checkDirEntries(t, dir, "file", "file.bak")
+	}
+
+	for _, opts := range [][]atomicfile.Option{
+		{atomicfile.Replace(), atomicfile.Backup("")},
+		{atomicfile.Replace(), atomicfile.Backup("/bak")},
+		{atomicfile.Replace(), atomicfile.Backup(".a"), atomicfile.Backup(".b")},
+		{atomicfile.Backup(".bak")},
+	} {
+		if err := atomicfile.Create(name, opts...); err == nil {
+			t.Fatal("invalid backup options accepted")
+		}
+	}
+	checkFile(t, name, "v3")
+}
+
+func TestBackupFailure(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	writeFile(t, name, "v1")
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("v2"))),
+		atomicfile.Replace(),
+		atomicfile.Backup(".old"),
+	)
+	if err != nil {
+		t.Skipf("RENAME_EXCHANGE not supported: %v", err)
+	}
+
+	// a non-empty directory can not be replaced by the backup
+	if err := os.MkdirAll(filepath.Join(dir, "file.bak", "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("v3"))),
+		atomicfile.Replace(),
+		atomicfile.Backup(".bak"),
+	)
+	if !errors.Is(err, atomicfile.ErrPublished) {
+		t.Fatalf("expected an error wrapping ErrPublished, got %v", err)
+	}
+	checkFile(t, name, "v3")
+
+	// the previous version is left behind, and named in the error
+	entries, rerr := os.ReadDir(dir)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	var left []string
+	for _, e := range entries {
+		if n := e.Name(); n != "file" && n != "file.old" && n != "file.bak" {
+			left = append(left, n)
+		}
+	}
+	if len(left) != 1 {
+		t.Fatalf("unexpected directory entries %v", entries)
+	}
+	checkFile(t, filepath.Join(dir, left[0]), "v2")
+	if !strings.Contains(err.Error(), left[0]) {
+		t.Fatalf("%q does not name the previous version %s", err, left[0])
+	}
+}
+
+func TestBackupRotate(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	writeFile(t, name, "v0")
+	// unrelated files are ignored
+	writeFile(t, name+".~x~", "")
+	writeFile(t, name+".~01~", "")
+
+	for i := 1; i <= 4; i++ {
+		var r atomicfile.Result
+		err := atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader([]byte{'v', '0' + byte(i)})),
+			atomicfile.Replace(),
+			atomicfile.BackupRotate(2),
+			atomicfile.Report(&r),
+		)
+		if err != nil {
+			t.Skipf("RENAME_EXCHANGE not supported: %v", err)
+		}
+		if want := name + ".~" + string('0'+byte(i)) + "~"; r.Backup != want {
+			t.Fatalf("Backup is %q, expected %q", r.Backup, want)
+		}
+	}
+	checkFile(t, name, "v4")
+	checkFile(t, name+".~3~", "v2")
+	checkFile(t, name+".~4~", "v3")
+	checkDirEntries(t, dir, "file", "file.~01~", "file.~3~", "file.~4~", "file.~x~")
+
+	if err := atomicfile.Create(name, atomicfile.Replace(), atomicfile.BackupRotate(0)); err == nil {
+		t.Fatal("invalid number of backups accepted")
+	}
+	if err := atomicfile.Create(name, atomicfile.Replace(), atomicfile.BackupRotate(1), atomicfile.Backup(".bak")); err == nil {
+		t.Fatal("multiple backups accepted")
+	}
+}
+
+func TestBackupRotateFailure(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	writeFile(t, name, "v0")
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("v1"))),
+		atomicfile.Replace(),
+		atomicfile.BackupRotate(2),
+	)
+	if err != nil {
+		t.Skipf("RENAME_EXCHANGE not supported: %v", err)
+	}
+
+	// a non-empty directory can not be pruned
+	if err := os.Remove(name + ".~1~"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "file.~1~", "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("v2"))),
+		atomicfile.Replace(),
+		atomicfile.BackupRotate(1),
+	)
+	if !errors.Is(err, atomicfile.ErrPublished) {
+		t.Fatalf("expected an error wrapping ErrPublished, got %v", err)
+	}
+	checkFile(t, name, "v2")
+	checkFile(t, name+".~2~", "v1")
+	checkDirEntries(t, dir, "file", "file.~1~", "file.~2~")
+}
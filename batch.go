@@ -0,0 +1,285 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CreateMany creates the specified files in dir, like Create. All files are
+// staged first (see Prepare), and then they are linked in the order in which
+// they are specified: if any of the files can not be staged, none of them is
+// created.
+// The directory is fsynced only once, after all files have been linked,
+// instead of once per file, if the durability level of any of the files
+// requires it (see Durability and SyncParentDirs). The AfterCommit hooks are
+// invoked once the directory has been fsynced.
+// If linking one of the files fails, the files that precede it have already
+// been created, while the ones that follow it are not. If the failure occurs
+// once all files have been linked, the error matches ErrPublished.
+// The options are applied to all files, so they can not include Hash or
+// Report: these must be specified in the Options of each FileSpec.
+func CreateMany(dir string, files []FileSpec, options ...Option) error {
+	if err := checkDefaults(options); err != nil {
+		return err
+	}
+	cfgs := make([]config, len(files))
+	for i, fs := range files {
+		if fs.Name == "" || fs.Name == "." || fs.Name == ".." || strings.Contains(fs.Name, "/") {
+			return &werror{"invalid name " + fs.Name, nil}
+		}
+		cfg, err := newConfig(append(options[:len(options):len(options)], fs.Options...))
+		if err != nil {
+			return &werror{"creating " + fs.Name, err}
+		}
+		cfgs[i] = cfg
+	}
+
+	d, err := openAt(unix.AT_FDCWD, dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	if err != nil {
+		return &werror{"opening directory", err}
+	}
+	defer d.Close()
+	dirfd := int(d.Fd())
+
+	pending := make([]*Pending, 0, len(files))
+	defer func() {
+		for _, p := range pending {
+			_ = p.Discard()
+		}
+	}()
+	for i, fs := range files {
+		p, err := stage(dirfd, fs.Name, cfgs[i])
+		if err != nil {
+			return &werror{"creating " + fs.Name, err}
+		}
+		p.deferSync = true
+		pending = append(pending, p)
+	}
+
+	var syncDir, syncParents bool
+	for _, p := range pending {
+		if err := p.Commit(); err != nil {
+			return &werror{"creating " + p.filename, err}
+		}
+		syncDir = syncDir || p.cfg.durability >= DurabilityFull || p.cfg.syncParents
+		syncParents = syncParents || p.cfg.durability >= DurabilityParanoid || p.cfg.syncParents
+	}
+
+	if syncDir {
+		start := time.Now()
+		err := d.Sync()
+		if err == nil && syncParents {
+			err = syncParentsAt(dirfd)
+		}
+		for _, p := range pending {
+			if ferr := p.cfg.observe(StageDirSync, start, err); err == nil {
+				err = ferr
+			}
+		}
+		if err != nil {
+			return &publishedError{&werror{"fsync directory", err}}
+		}
+	}
+
+	for _, p := range pending {
+		if p.unchanged {
+			continue
+		}
+		if err := p.finish(); err != nil {
+			return &publishedError{&werror{"creating " + p.filename, err}}
+		}
+	}
+	return nil
+}
+
+// Batch creates files in parallel, using a bounded number of goroutines.
+// The directories containing the files are fsynced (if the durability level
+// of any of the files in them requires it) only once, after all files have
+// been linked (see Wait).
+type Batch struct {
+	sem     chan struct{}
+	options []Option
+	err     error
+	wg      sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs []*batchJob
+	dirs map[batchDir]*os.File
+}
+
+type batchJob struct {
+	name string
+	p    *Pending
+	dir  batchDir
+	err  error
+}
+
+// batchDir identifies a directory by its device and inode numbers.
+type batchDir struct {
+	dev uint64
+	ino uint64
+}
+
+// NewBatch returns a Batch that creates up to concurrency files at the same
+// time, using the specified default options. The default options can not
+// include Hash or Report, that would be shared by all files: if they do,
+// creating each file fails.
+func NewBatch(concurrency int, options ...Option) *Batch {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Batch{
+		sem:     make(chan struct{}, concurrency),
+		options: options[:len(options):len(options)],
+		err:     checkDefaults(options),
+		dirs:    make(map[batchDir]*os.File),
+	}
+}
+
+// Add starts creating filename, like Create. The default options of b are
+// applied before the specified ones. If the maximum number of files are
+// already being created, Add blocks until one of them has been linked.
+// Add must not be called after Wait.
+func (b *Batch) Add(filename string, options ...Option) {
+	job := &batchJob{name: filename}
+	b.mu.Lock()
+	b.jobs = append(b.jobs, job)
+	b.mu.Unlock()
+
+	b.sem <- struct{}{}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() { <-b.sem }()
+		job.err = b.create(job, append(b.options, options...))
+	}()
+}
+
+// create stages and links the file of job, and records the directory
+// containing it so that it can be fsynced by Wait.
+func (b *Batch) create(job *batchJob, options []Option) error {
+	if b.err != nil {
+		return b.err
+	}
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	p, err := stage(unix.AT_FDCWD, job.name, cfg)
+	if err != nil {
+		return err
+	}
+	p.deferSync = true
+	if cfg.durability >= DurabilityFull || cfg.syncParents {
+		if err := b.addDir(job, p.d); err != nil {
+			_ = p.Discard()
+			return err
+		}
+	}
+	job.p = p
+	return p.Commit()
+}
+
+// addDir records the directory d as the one containing the file of job,
+// keeping it open until Wait if it was not already recorded.
+func (b *Batch) addDir(job *batchJob, d *os.File) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(d.Fd()), &st); err != nil {
+		return &werror{"reading directory metadata", err}
+	}
+	job.dir = batchDir{st.Dev, st.Ino}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dirs[job.dir] != nil {
+		return nil
+	}
+	fd, err := unix.FcntlInt(d.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return &werror{"duplicating directory descriptor", err}
+	}
+	b.dirs[job.dir] = os.NewFile(uintptr(fd), d.Name())
+	return nil
+}
+
+// Wait waits for all files added to b to be linked, fsyncs the directories
+// containing them (if required by their durability level), and returns the
+// outcome of the creation of each file, in the order in which they were
+// added. The AfterCommit hooks of each file are invoked once the directory
+// containing it has been fsynced.
+func (b *Batch) Wait() []BatchResult {
+	b.wg.Wait()
+
+	// parents records, for each directory to be fsynced, whether its parent
+	// directories need to be fsynced as well
+	parents := make(map[batchDir]bool, len(b.dirs))
+	for _, job := range b.jobs {
+		if job.err != nil || job.p == nil || job.p.unchanged || job.dir == (batchDir{}) {
+			continue
+		}
+		cfg := &job.p.cfg
+		parents[job.dir] = parents[job.dir] || cfg.durability >= DurabilityParanoid || cfg.syncParents
+	}
+	type dirSync struct {
+		start time.Time
+		err   error
+	}
+	syncs := make(map[batchDir]dirSync, len(parents))
+	for dir, syncParents := range parents {
+		d := b.dirs[dir]
+		s := dirSync{start: time.Now()}
+		s.err = d.Sync()
+		if s.err == nil && syncParents {
+			s.err = syncParentsAt(int(d.Fd()))
+		}
+		syncs[dir] = s
+	}
+	for _, d := range b.dirs {
+		_ = d.Close()
+	}
+
+	results := make([]BatchResult, len(b.jobs))
+	for i, job := range b.jobs {
+		results[i] = BatchResult{Name: job.name, Err: job.err}
+		if job.err != nil || job.p == nil {
+			continue
+		}
+		if s, ok := syncs[job.dir]; ok {
+			if err := job.p.cfg.observe(StageDirSync, s.start, s.err); err != nil {
+				results[i].Err = &publishedError{&werror{"fsync directory", err}}
+				continue
+			}
+		}
+		if !job.p.unchanged {
+			if err := job.p.finish(); err != nil {
+				results[i].Err = &publishedError{err}
+			}
+		}
+		results[i].Result = job.p.result
+	}
+	return results
+}
+
+// checkDefaults validates the default options applied to multiple files.
+// Hash and Report are rejected, as the same hash.Hash or Result would be
+// updated by all files (concurrently, in the case of Batch and Creator).
+func checkDefaults(options []Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	if len(cfg.hashes) > 0 {
+		return &werror{"options", &werror{"Hash can not be a default option", nil}}
+	}
+	if cfg.result != defaultConfig().result {
+		return &werror{"options", &werror{"Report can not be a default option", nil}}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestCreateMany(t *testing.T) {
+	dir := t.TempDir()
+
+	var synced int
+	files := []atomicfile.FileSpec{
+		{Name: "a", Options: []atomicfile.Option{atomicfile.Contents(bytes.NewReader([]byte("a")))}},
+		{Name: "b", Options: []atomicfile.Option{atomicfile.Contents(bytes.NewReader([]byte("b"))), atomicfile.Permissions(0o600)}},
+	}
+	err := atomicfile.CreateMany(dir, files,
+		atomicfile.Fsync(),
+		atomicfile.Observe(func(s atomicfile.Stage, _ time.Duration, err error) {
+			if s == atomicfile.StageDirSync {
+				synced++
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "a"), "a")
+	checkFile(t, filepath.Join(dir, "b"), "b")
+	// the directory is fsynced once, but each file observes it
+	if synced != 2 {
+		t.Fatalf("observed %d directory fsyncs, expected 2", synced)
+	}
+
+	// nothing is created if any of the files can not be staged
+	errContents := errors.New("contents failed")
+	err = atomicfile.CreateMany(dir, []atomicfile.FileSpec{
+		{Name: "c"},
+		{Name: "d", Options: []atomicfile.Option{atomicfile.Contents(&errReader{errContents})}},
+	})
+	if !errors.Is(err, errContents) {
+		t.Fatalf("expected an error wrapping the reader error, got %v", err)
+	}
+	checkDirEntries(t, dir, "a", "b")
+
+	// the files that precede a failed one are created
+	err = atomicfile.CreateMany(dir, []atomicfile.FileSpec{{Name: "c"}, {Name: "a"}, {Name: "d"}})
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+	}
+	checkDirEntries(t, dir, "a", "b", "c")
+
+	for _, name := range []string{"", ".", "..", "x/y"} {
+		if err := atomicfile.CreateMany(dir, []atomicfile.FileSpec{{Name: name}}); err == nil {
+			t.Fatalf("invalid name %q accepted", name)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+
+	b := atomicfile.NewBatch(4, atomicfile.Fsync(), atomicfile.Permissions(0o600))
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := filepath.Join(dirs[i%2], strconv.Itoa(i))
+		names = append(names, name)
+		b.Add(name, atomicfile.Contents(bytes.NewReader([]byte(strconv.Itoa(i)))))
+	}
+	results := b.Wait()
+	if len(results) != len(names) {
+		t.Fatalf("%d results, expected %d", len(results), len(names))
+	}
+	for i, r := range results {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		if r.Name != names[i] || r.Result.Written != int64(len(strconv.Itoa(i))) {
+			t.Fatalf("unexpected result %+v for %s", r, names[i])
+		}
+		checkFile(t, names[i], strconv.Itoa(i))
+		fi, err := os.Stat(names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0o600 {
+			t.Fatalf("permissions are %v, expected %v", fi.Mode().Perm(), os.FileMode(0o600))
+		}
+	}
+
+	b = atomicfile.NewBatch(1)
+	b.Add(names[0])
+	b.Add(filepath.Join(dirs[0], "new"))
+	results = b.Wait()
+	if len(results) != 2 || results[0].Name != names[0] || !errors.Is(results[0].Err, os.ErrExist) || results[1].Err != nil {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	checkFile(t, names[0], "0")
+}
+
+func TestSharedDefaults(t *testing.T) {
+	dir := t.TempDir()
+	var r atomicfile.Result
+	for _, opt := range []atomicfile.Option{atomicfile.Hash(sha256.New()), atomicfile.Report(&r)} {
+		err := atomicfile.CreateMany(dir, []atomicfile.FileSpec{{Name: "a"}, {Name: "b"}}, opt)
+		if err == nil {
+			t.Fatal("CreateMany accepted a shared option")
+		}
+
+		b := atomicfile.NewBatch(2, opt)
+		b.Add(filepath.Join(dir, "a"))
+		if results := b.Wait(); len(results) != 1 || results[0].Err == nil {
+			t.Fatalf("Batch accepted a shared option: %+v", results)
+		}
+
+		if _, err := atomicfile.NewCreator(dir, opt); err == nil {
+			t.Fatal("NewCreator accepted a shared option")
+		}
+	}
+	checkDirEntries(t, dir)
+
+	// Hash and Report can be specified for each file
+	h := sha256.New()
+	err := atomicfile.CreateMany(dir, []atomicfile.FileSpec{
+		{Name: "a", Options: []atomicfile.Option{atomicfile.Hash(h), atomicfile.Report(&r)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.Sum(nil), sha256.New().Sum(nil)) {
+		t.Fatal("unexpected hash")
+	}
+}
+
+// errReader is an io.Reader that always fails with err.
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,70 @@
+//go:build freebsd || netbsd || openbsd
+// +build freebsd netbsd openbsd
+
+package atomicfile
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// File flags that can be used with InodeFlags (see chflags(1)), as defined in
+// sys/stat.h. Not all filesystems support all flags.
+const (
+	InodeNoDump        uint32 = 0x00000001 // UF_NODUMP: do not dump file
+	InodeUserImmutable uint32 = 0x00000002 // UF_IMMUTABLE: immutable file
+	InodeUserAppend    uint32 = 0x00000004 // UF_APPEND: writes can only append
+	InodeImmutable     uint32 = 0x00020000 // SF_IMMUTABLE: immutable file
+	InodeAppend        uint32 = 0x00040000 // SF_APPEND: writes can only append
+)
+
+// lateInodeFlags are the file flags that prevent the target file from being
+// linked or renamed, and that are therefore set after it has been linked.
+const lateInodeFlags = InodeUserImmutable | InodeUserAppend | InodeImmutable |
+	InodeAppend | noUnlinkFlags
+
+// InodeFlags sets the file flags in set, and clears the ones in clear, on
+// the target file (see chflags(1)). InodeFlags can be specified multiple
+// times. The flags that prevent the target file from being modified or
+// renamed (the immutable, append-only and no-unlink ones) are set after the
+// target file has been linked, like with Immutable.
+// The system flags (e.g. InodeImmutable) can only be set by the superuser,
+// depending on the securelevel.
+func InodeFlags(set, clear uint32) Option {
+	return optionFunc(func(c *config) error {
+		if set&clear != 0 || (c.flagsSet|set)&(c.flagsClear|clear) != 0 {
+			return &werror{"conflicting inode flags", nil}
+		}
+		c.flagsSet |= set
+		c.flagsClear |= clear
+		return nil
+	})
+}
+
+// Immutable makes Create set the system immutable flag (SF_IMMUTABLE, see
+// chflags(1)) on the target file, so that it can not be modified, renamed or
+// deleted until the flag is explicitly cleared.
+// The flag is set as the final step, after the target file has been linked:
+// if setting the flag fails, Create returns an error, but the target file is
+// not removed.
+func Immutable() Option {
+	return InodeFlags(InodeImmutable, 0)
+}
+
+// setFileFlags sets the flags in set, and clears the ones in clear, on the
+// file fd.
+func setFileFlags(fd int, set, clear uint32) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if flags := (st.Flags | set) &^ clear; flags != st.Flags {
+		return unix.Fchflags(fd, int(flags))
+	}
+	return nil
+}
+
+// linkAt links the file oldname as newname, both in the directory dirfd
+// (whose path is dir).
+func linkAt(dirfd int, dir, oldname, newname string) error {
+	return unix.Linkat(dirfd, oldname, dirfd, newname, 0)
+}
@@ -0,0 +1,153 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// Check validates, without creating any file, that Create(filename, options...)
+// is expected to succeed, e.g. so that a deployment tool can check that a file
+// can be written before removing the file it replaces. Check validates the
+// options, and checks that the directory containing the target file exists
+// and is writable, that the target file does not exist (unless Replace is
+// specified) and satisfies the preconditions specified with ReplaceIf, that
+// the filesystem supports the features required by the options, and that it
+// has enough free space for the contents, if their size is known (see
+// ContentSize). The contents are not read.
+// Check can not guarantee that Create succeeds, as the conditions it checks
+// may change in the meantime, and not all failures can be predicted.
+func Check(filename string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+
+	dir, base := path.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	var d *os.File
+	if cfg.secureResolve {
+		d, err = openBeneath(unix.AT_FDCWD, dir)
+	} else {
+		d, err = openAt(unix.AT_FDCWD, dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	}
+	if err != nil {
+		return &werror{"opening directory", err}
+	}
+	defer d.Close()
+	dirfd := int(d.Fd())
+	if cfg.noForeignLinks {
+		if err := checkForeignSymlinks(unix.AT_FDCWD, dir, d); err != nil {
+			return &werror{"checking directory", err}
+		}
+	}
+	if cfg.dirOwner != defaultConfig().dirOwner || cfg.dirMode != defaultConfig().dirMode {
+		if err := checkDir(d, path.Clean(dir), &cfg); err != nil {
+			return &werror{"checking directory", err}
+		}
+	}
+	if err := unix.Faccessat(dirfd, ".", unix.W_OK|unix.X_OK, unix.AT_EACCESS); err != nil {
+		return &werror{"checking directory", &os.PathError{Op: "access", Path: dir, Err: err}}
+	}
+
+	if cfg.metadataFrom != "" {
+		if _, err := os.Stat(cfg.metadataFrom); err != nil {
+			return &werror{"reading reference file metadata", err}
+		}
+	}
+
+	var st unix.Stat_t
+	err = unix.Fstatat(dirfd, base, &st, unix.AT_SYMLINK_NOFOLLOW)
+	switch {
+	case err == unix.ENOENT:
+		if len(cfg.preconditions) > 0 {
+			return &werror{"checking preconditions", ErrPreconditionFailed}
+		}
+	case err != nil:
+		return &werror{"checking target file", &os.PathError{Op: "lstat", Path: filename, Err: err}}
+	case st.Mode&unix.S_IFMT == unix.S_IFDIR:
+		return &werror{"checking target file", &os.PathError{Op: "check", Path: filename, Err: unix.EISDIR}}
+	case !cfg.replace && cfg.unique == nil:
+		return &werror{"checking target file", &os.PathError{Op: "check", Path: filename, Err: unix.EEXIST}}
+	case len(cfg.preconditions) > 0:
+		if err := checkPreconditions(dirfd, base, cfg.preconditions); err != nil {
+			return &werror{"checking preconditions", err}
+		}
+	}
+
+	if err := checkCapabilities(d, &cfg); err != nil {
+		return err
+	}
+
+	var fs unix.Statfs_t
+	if err := unix.Fstatfs(dirfd, &fs); err != nil {
+		return &werror{"reading filesystem metadata", err}
+	}
+	size := cfg.contentSize()
+	if cfg.prealloc > size {
+		size = cfg.prealloc
+	}
+	if size > 0 && uint64(size) > fs.Bavail*uint64(fs.Bsize) {
+		return &werror{"checking free space", unix.ENOSPC}
+	}
+	if fs.Files > 0 && fs.Ffree == 0 {
+		return &werror{"checking free inodes", unix.ENOSPC}
+	}
+	return nil
+}
+
+// checkCapabilities checks that the filesystem containing the directory d
+// supports the features required by cfg, without creating any file.
+func checkCapabilities(d *os.File, cfg *config) error {
+	dirfd := int(d.Fd())
+
+	if s, ok := cfg.strategy.(tmpFileStrategy); ok {
+		// unnamed temporary files are never visible in the filesystem, and
+		// are removed as soon as they are closed
+		fd, err := unix.Openat(dirfd, ".", unix.O_TMPFILE|unix.O_RDWR|unix.O_CLOEXEC, 0o600)
+		if err != nil {
+			return &werror{"checking O_TMPFILE", err}
+		}
+		_ = unix.Close(fd)
+		if s.mode == StrategyProcLink {
+			proc := cfg.procMount
+			if proc == "" {
+				proc = "/proc"
+			}
+			if _, err := os.Stat(path.Join(proc, "self/fd")); err != nil {
+				return &werror{"checking procfs", err}
+			}
+		}
+	}
+	if cfg.stageDir != "" {
+		sd, err := openStageDir(d, cfg.stageDir)
+		if err != nil && !errors.Is(err, unix.EXDEV) {
+			return &werror{"opening staging directory", err}
+		} else if err == nil {
+			_ = sd.Close()
+		}
+	}
+
+	for _, x := range cfg.xattrs {
+		// reading an attribute that does not exist succeeds, or fails with
+		// ENODATA, only if extended attributes are supported
+		_, err := unix.Fgetxattr(dirfd, x.name, nil)
+		if err == unix.ENODATA {
+			err = nil
+		}
+		if ok, err := probeResult(err); err != nil || !ok {
+			if err == nil {
+				err = unix.EOPNOTSUPP
+			}
+			return &werror{"checking xattr " + x.name, err}
+		}
+	}
+	return nil
+}
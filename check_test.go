@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	// the contents are not read
+	contents := &errReader{errors.New("contents read")}
+	if err := atomicfile.Check(name, atomicfile.Contents(contents)); err != nil {
+		t.Fatal(err)
+	}
+	checkDirEntries(t, dir)
+
+	writeFile(t, name, "old")
+	if err := atomicfile.Check(name); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+	}
+	if err := atomicfile.Check(name, atomicfile.Replace()); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomicfile.Check(name, atomicfile.ReplaceIf(atomicfile.IfSize(4))); !errors.Is(err, atomicfile.ErrPreconditionFailed) {
+		t.Fatalf("expected an error wrapping ErrPreconditionFailed, got %v", err)
+	}
+	if err := atomicfile.Check(name, atomicfile.ReplaceIf(atomicfile.IfSize(3))); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomicfile.Check(dir, atomicfile.Replace()); err == nil {
+		t.Fatal("directory target accepted")
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	err := atomicfile.Check(filepath.Join(dir, "large"), atomicfile.ContentSize(int64(st.Bavail)*st.Bsize+1<<30))
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected an error wrapping ENOSPC, got %v", err)
+	}
+
+	for _, opts := range [][]atomicfile.Option{
+		{atomicfile.Replace(), atomicfile.NoReplace()},
+		{atomicfile.Lock()},
+	} {
+		if err := atomicfile.Check(filepath.Join(dir, "other"), opts...); err == nil {
+			t.Fatal("invalid options accepted")
+		}
+	}
+	if err := atomicfile.Check(filepath.Join(dir, "missing", "file")); err == nil {
+		t.Fatal("missing directory accepted")
+	}
+	checkFile(t, name, "old")
+	checkDirEntries(t, dir, "file")
+}
@@ -1,74 +1,208 @@
+//go:build linux
+// +build linux
+
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
-	"strconv"
-	"time"
 
 	"github.com/CAFxX/atomicfile"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 func main() {
-	filename := kingpin.Arg("filename", "Name of the file to create").Required().String()
-	fsync := kingpin.Flag("fsync", "Fsync the file").Default("false").Bool()
-	dontneed := kingpin.Flag("dontneed", "Minimize block cache usage").Default("false").Bool()
-	prealloc := kingpin.Flag("prealloc", "Preallocate file space (bytes)").Default("0").Int64()
-	xattrs := kingpin.Flag("xattr", "Extended attributes to be added to the file").PlaceHolder("KEY=VALUE").StringMap()
-	perm := kingpin.Flag("perm", "File permissions").String()
-	uid := kingpin.Flag("uid", "File owner user").Default("-1").PlaceHolder("UID").Int()
-	gid := kingpin.Flag("gid", "File owner group").Default("-1").PlaceHolder("GID").Int()
-	mtime := kingpin.Flag("mtime", "File modification time (RFC 3339)").String()
-	atime := kingpin.Flag("atime", "File access time (RFC 3339)").String()
-	kingpin.Parse()
-
-	opts := []atomicfile.Option{
-		atomicfile.Contents(os.Stdin),
-	}
-	if *fsync {
-		opts = append(opts, atomicfile.Fsync())
+	kingpin.CommandLine.Help = "Atomically create, replace, copy, swap and remove files."
+	kingpin.Flag("json", "Print the outcome (or the error) as JSON").BoolVar(&jsonOutput)
+	kingpin.Flag("sha256", "Include the SHA-256 digest of the contents in the JSON output (prevents zero-copy)").BoolVar(&jsonDigest)
+
+	create := kingpin.Command("create", "Create a file with the contents read from stdin (default)").Default()
+	createName := create.Arg("filename", "Name of the file to create").Required().String()
+	createInput := create.Flag("input", "Read the contents from FILE instead of stdin").Default("-").PlaceHolder("FILE").String()
+	createURL := create.Flag("from-url", "Download the contents from URL instead of reading them from stdin").PlaceHolder("URL").String()
+	createRef := create.Flag("reference", "Use the permissions, ownership, times and xattrs of PATH (like chmod --reference)").PlaceHolder("PATH").String()
+	createOpts := fileFlags(create)
+	createChecksum := checksumFlags(create)
+	createOverwrite := overwriteFlags(create, false)
+
+	replace := kingpin.Command("replace", "Create or replace a file with the contents read from stdin")
+	replaceName := replace.Arg("filename", "Name of the file to create or replace").Required().String()
+	replaceInput := replace.Flag("input", "Read the contents from FILE instead of stdin").Default("-").PlaceHolder("FILE").String()
+	replaceURL := replace.Flag("from-url", "Download the contents from URL instead of reading them from stdin").PlaceHolder("URL").String()
+	replaceRef := replace.Flag("reference", "Use the permissions, ownership, times and xattrs of PATH (like chmod --reference)").PlaceHolder("PATH").String()
+	replaceIfChanged := replace.Flag("if-changed", "Leave the file untouched if its contents are unchanged").Default("false").Bool()
+	replaceUnchangedStatus := replace.Flag("unchanged-status", "Exit with status N if the file is left untouched (see --if-changed)").Default("0").PlaceHolder("N").Int()
+	replaceOpts := fileFlags(replace)
+	replaceChecksum := checksumFlags(replace)
+	replaceOverwrite := overwriteFlags(replace, true)
+
+	cp := kingpin.Command("copy", "Create a copy of a file, preserving its metadata")
+	cpSrc := cp.Arg("src", "Name of the file to copy").Required().String()
+	cpDst := cp.Arg("dst", "Name of the file to create").Required().String()
+	cpOpts := fileFlags(cp)
+	cpChecksum := checksumFlags(cp)
+	cpOverwrite := overwriteFlags(cp, false)
+
+	swap := kingpin.Command("swap", "Exchange two files")
+	swapPath1 := swap.Arg("path1", "Name of the first file").Required().String()
+	swapPath2 := swap.Arg("path2", "Name of the second file").Required().String()
+
+	symlink := kingpin.Command("symlink", "Create or replace a symbolic link")
+	symlinkTarget := symlink.Arg("target", "Target of the symbolic link").Required().String()
+	symlinkName := symlink.Arg("linkname", "Name of the symbolic link").Required().String()
+	symlinkFsync := symlink.Flag("fsync", "Fsync the directory containing the symbolic link").Default("false").Bool()
+	symlinkNoReplace := symlink.Flag("no-replace", "Fail if linkname exists").Default("false").Bool()
+
+	rm := kingpin.Command("rm", "Remove a file (or empty directory)")
+	rmName := rm.Arg("filename", "Name of the file to remove").Required().String()
+
+	probe := kingpin.Command("probe", "Report the features supported by the filesystem containing a directory")
+	probeDir := probe.Arg("dir", "Directory to probe (it must be writable)").Required().String()
+
+	var out report
+	var name string
+	var err error
+	switch kingpin.Parse() {
+	case create.FullCommand():
+		opts, input := contents(*createInput, *createURL)
+		opts = append(opts, createOpts()...)
+		opts = append(opts, createOverwrite()...)
+		opts = append(opts, createChecksum(sourceName(*createInput, *createURL), *createName)...)
+		if *createRef != "" {
+			opts = append(opts, atomicfile.MetadataFrom(*createRef))
+		}
+		name = *createName
+		err = atomicfile.Create(name, append(opts, out.options()...)...)
+		closeInput(input)
+	case replace.FullCommand():
+		opts, input := contents(*replaceInput, *replaceURL)
+		opts = append(opts, replaceOpts()...)
+		opts = append(opts, replaceOverwrite()...)
+		opts = append(opts, replaceChecksum(sourceName(*replaceInput, *replaceURL), *replaceName)...)
+		if *replaceRef != "" {
+			opts = append(opts, atomicfile.MetadataFrom(*replaceRef))
+		}
+		if *replaceIfChanged {
+			opts = append(opts, atomicfile.OnlyIfChanged())
+		}
+		name = *replaceName
+		err = atomicfile.Create(name, append(opts, out.options()...)...)
+		closeInput(input)
+	case cp.FullCommand():
+		opts := append(cpOpts(), cpOverwrite()...)
+		opts = append(opts, cpChecksum(*cpSrc, *cpDst)...)
+		name = *cpDst
+		err = atomicfile.Copy(name, *cpSrc, append(opts, out.options()...)...)
+	case swap.FullCommand():
+		name = *swapPath2
+		err = atomicfile.Swap(*swapPath1, *swapPath2)
+	case symlink.FullCommand():
+		var opts []atomicfile.Option
+		if *symlinkFsync {
+			opts = append(opts, atomicfile.Fsync())
+		}
+		if *symlinkNoReplace {
+			opts = append(opts, atomicfile.NoReplace())
+		}
+		name = *symlinkName
+		err = atomicfile.Symlink(*symlinkTarget, *symlinkName, opts...)
+	case rm.FullCommand():
+		name = *rmName
+		err = atomicfile.Remove(*rmName)
+	case probe.FullCommand():
+		var caps atomicfile.Capabilities
+		caps, err = atomicfile.Probe(*probeDir)
+		if err == nil && jsonOutput {
+			name, out.Capabilities = *probeDir, &caps
+		} else if err == nil {
+			fmt.Printf("tmpfile: %v\n", caps.TmpFile)
+			fmt.Printf("fallocate: %v\n", caps.Fallocate)
+			fmt.Printf("xattrs: %v\n", caps.Xattrs)
+			fmt.Printf("reflink: %v\n", caps.Reflink)
+			fmt.Printf("verity: %v\n", caps.Verity)
+			fmt.Printf("rename-noreplace: %v\n", caps.RenameNoReplace)
+			fmt.Printf("rename-exchange: %v\n", caps.RenameExchange)
+		}
 	}
-	if *dontneed {
-		opts = append(opts, atomicfile.DontNeed())
+	if err != nil {
+		if jsonOutput {
+			printError(err, out.failed)
+			os.Exit(-1)
+		}
+		fatal(err)
 	}
-	if *prealloc != 0 {
-		opts = append(opts, atomicfile.Preallocate(*prealloc))
+	if jsonOutput {
+		out.print(name)
 	}
-	for k, v := range *xattrs {
-		opts = append(opts, atomicfile.Xattr(k, []byte(v)))
+	if out.result.Unchanged && *replaceUnchangedStatus != 0 {
+		os.Exit(*replaceUnchangedStatus)
 	}
-	if *perm != "" {
-		pp, err := strconv.ParseUint(*perm, 8, 32)
+}
+
+// contents returns the options that specify the contents of the file to
+// create, read from the file input (or stdin, if input is "-") or, if url is
+// not empty, downloaded from url.
+// The input file is passed to the library as is, so that it can use its size
+// and the zero-copy mechanisms to populate the target file. The size of the
+// downloaded contents, if known, is used to preallocate the target file and
+// to detect truncated responses.
+// The returned io.Closer, if not nil, must be closed once the file has been
+// created.
+func contents(input, url string) ([]atomicfile.Option, io.Closer) {
+	if url != "" {
+		if input != "-" {
+			fatal(errors.New("--input and --from-url are mutually exclusive"))
+		}
+		body, size, err := download(url)
 		if err != nil {
 			fatal(err)
 		}
-		opts = append(opts, atomicfile.Permissions(os.FileMode(pp)))
+		opts := []atomicfile.Option{atomicfile.Contents(body)}
+		if size >= 0 {
+			opts = append(opts, atomicfile.ExpectSize(size))
+		}
+		return opts, body
 	}
-	if *uid != -1 || *gid != -1 {
-		opts = append(opts, atomicfile.Ownership(*uid, *gid))
+	if input == "-" {
+		return []atomicfile.Option{atomicfile.Contents(os.Stdin)}, nil
 	}
-	if *mtime != "" {
-		t, err := time.Parse(time.RFC3339Nano, *mtime)
-		if err != nil {
-			fatal(err)
-		}
-		opts = append(opts, atomicfile.ModificationTime(t))
+	f, err := os.Open(input)
+	if err != nil {
+		fatal(err)
 	}
-	if *atime != "" {
-		t, err := time.Parse(time.RFC3339Nano, *atime)
-		if err != nil {
-			fatal(err)
+	return []atomicfile.Option{atomicfile.Contents(f)}, f
+}
+
+// sourceName returns the name of the file the contents are read from (see
+// contents), or an empty string if they are read from stdin.
+func sourceName(input, rawURL string) string {
+	if rawURL != "" {
+		if u, err := url.Parse(rawURL); err == nil {
+			return u.Path
 		}
-		opts = append(opts, atomicfile.AccessTime(t))
+		return ""
+	}
+	if input == "-" {
+		return ""
 	}
+	return input
+}
 
-	err := atomicfile.Create(*filename, opts...)
-	if err != nil {
-		fatal(err)
+// closeInput closes the input returned by contents, if any.
+func closeInput(c io.Closer) {
+	if c != nil {
+		_ = c.Close()
 	}
 }
 
 func fatal(err error) {
+	if jsonOutput {
+		printError(err, "")
+		os.Exit(-1)
+	}
 	os.Stderr.WriteString(err.Error())
 	os.Stderr.WriteString("\n")
 	os.Exit(-1)
@@ -0,0 +1,317 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the command instead of the tests if ATOMICFILE_TEST_MAIN is
+// set, so that the tests can run it (see run) without building it.
+func TestMain(m *testing.M) {
+	if os.Getenv("ATOMICFILE_TEST_MAIN") != "" {
+		os.Args = append(os.Args[:1], strings.Fields(os.Getenv("ATOMICFILE_TEST_MAIN"))...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs the command with args, and stdin as its standard input. It
+// returns the standard output and the exit status.
+func run(t *testing.T, stdin string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "ATOMICFILE_TEST_MAIN="+strings.Join(args, " "))
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return stdout.String(), exit.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), 0
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	if _, status := run(t, "hello", name); status != 0 {
+		t.Fatalf("create exited with status %d", status)
+	}
+	checkFile(t, name, "hello")
+
+	if _, status := run(t, "again", "create", name); status == 0 {
+		t.Fatal("create replaced an existing file")
+	}
+	checkFile(t, name, "hello")
+
+	if _, status := run(t, "again", "replace", name); status != 0 {
+		t.Fatalf("replace exited with status %d", status)
+	}
+	checkFile(t, name, "again")
+}
+
+func TestCreateInput(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("from file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "file")
+
+	if _, status := run(t, "", "create", "--input", src, "--perm", "600", name); status != 0 {
+		t.Fatalf("create exited with status %d", status)
+	}
+	checkFile(t, name, "from file")
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Fatalf("permissions are %v, expected %v", fi.Mode().Perm(), os.FileMode(0o600))
+	}
+}
+
+func TestFromURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("downloaded"))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	if _, status := run(t, "", "create", "--from-url", srv.URL+"/file", name); status != 0 {
+		t.Fatalf("create exited with status %d", status)
+	}
+	checkFile(t, name, "downloaded")
+
+	// failed downloads do not replace the file
+	if _, status := run(t, "", "replace", "--from-url", srv.URL+"/missing", name); status == 0 {
+		t.Fatal("replace succeeded with a failed download")
+	}
+	checkFile(t, name, "downloaded")
+	if _, status := run(t, "", "create", "--from-url", srv.URL+"/file", "--input", name, name+"2"); status == 0 {
+		t.Fatal("create accepted --from-url with --input")
+	}
+}
+
+func TestReplaceIfChanged(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	for _, tc := range []struct {
+		contents string
+		args     []string
+		status   int
+	}{
+		{"v1", nil, 0},
+		{"v1", []string{"--if-changed"}, 0},
+		{"v1", []string{"--if-changed", "--unchanged-status=3"}, 3},
+		{"v2", []string{"--if-changed", "--unchanged-status=3"}, 0},
+	} {
+		args := append(append([]string{"replace"}, tc.args...), name)
+		if _, status := run(t, tc.contents, args...); status != tc.status {
+			t.Fatalf("%v exited with status %d, expected %d", args, status, tc.status)
+		}
+		checkFile(t, name, tc.contents)
+	}
+}
+
+func TestOverwriteFlags(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	if _, status := run(t, "hello", "create", name); status != 0 {
+		t.Fatalf("create exited with status %d", status)
+	}
+	if _, status := run(t, "again", "create", "--no-clobber", "--force", name); status == 0 {
+		t.Fatal("create accepted --no-clobber with --force")
+	}
+	if _, status := run(t, "again", "create", "--force", "--backup", "--suffix", ".old", name); status != 0 {
+		t.Fatalf("create --force exited with status %d", status)
+	}
+	checkFile(t, name, "again")
+	checkFile(t, name+".old", "hello")
+
+	if _, status := run(t, "third", "replace", "--backup", name); status != 0 {
+		t.Fatalf("replace --backup exited with status %d", status)
+	}
+	checkFile(t, name, "third")
+	checkFile(t, name+"~", "again")
+
+	dst := filepath.Join(dir, "copy")
+	for _, args := range [][]string{{"copy", name, dst}, {"copy", "--force", name + ".old", dst}} {
+		if _, status := run(t, "", args...); status != 0 {
+			t.Fatalf("%v exited with status %d", args, status)
+		}
+	}
+	checkFile(t, dst, "hello")
+	if _, status := run(t, "", "copy", name, dst); status == 0 {
+		t.Fatal("copy replaced an existing file")
+	}
+}
+
+func TestVerifySHA256(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	sum := sha256.Sum256([]byte("hello"))
+
+	if _, status := run(t, "hello", "create", "--verify-sha256", hex.EncodeToString(make([]byte, sha256.Size)), name); status == 0 {
+		t.Fatal("create succeeded with the wrong digest")
+	}
+	if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("file created with the wrong digest: %v", err)
+	}
+
+	sums := filepath.Join(dir, "SHA256SUMS")
+	line := hex.EncodeToString(sum[:]) + "  file\n" + hex.EncodeToString(make([]byte, sha256.Size)) + "  other\n"
+	if err := os.WriteFile(sums, []byte(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := run(t, "hello", "create", "--verify-from", sums, name); status != 0 {
+		t.Fatalf("create --verify-from exited with status %d", status)
+	}
+	checkFile(t, name, "hello")
+}
+
+func TestJSON(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	sum := sha256.Sum256([]byte("hello"))
+
+	for _, digest := range []bool{false, true} {
+		args := []string{"--json", "replace", name}
+		if digest {
+			args = append([]string{"--sha256"}, args...)
+		}
+		out, status := run(t, "hello", args...)
+		if status != 0 {
+			t.Fatalf("%v exited with status %d", args, status)
+		}
+		var r report
+		if err := json.Unmarshal([]byte(out), &r); err != nil {
+			t.Fatalf("%v: %v", out, err)
+		}
+		if r.Path != name || r.Written == nil || *r.Written != 5 {
+			t.Fatalf("unexpected output %s", out)
+		}
+		if digest && r.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("SHA256 is %q, expected %x", r.SHA256, sum)
+		} else if !digest && r.SHA256 != "" {
+			t.Fatalf("SHA256 is %q without --sha256", r.SHA256)
+		}
+	}
+
+	out, status := run(t, "hello", "--json", "create", name)
+	if status == 0 {
+		t.Fatal("create replaced an existing file")
+	}
+	var e jsonError
+	if err := json.Unmarshal([]byte(out), &e); err != nil {
+		t.Fatalf("%v: %v", out, err)
+	}
+	if e.ErrnoName != "EEXIST" {
+		t.Fatalf("unexpected output %s", out)
+	}
+}
+
+func TestCopySymlinkRemove(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("contents"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if _, status := run(t, "", "copy", src, dst); status != 0 {
+		t.Fatalf("copy exited with status %d", status)
+	}
+	checkFile(t, dst, "contents")
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o640 {
+		t.Fatalf("permissions are %v, expected %v", fi.Mode().Perm(), os.FileMode(0o640))
+	}
+
+	link := filepath.Join(dir, "link")
+	if _, status := run(t, "", "symlink", "--fsync", "dst", link); status != 0 {
+		t.Fatalf("symlink exited with status %d", status)
+	}
+	if _, status := run(t, "", "symlink", "--no-replace", "src", link); status == 0 {
+		t.Fatal("symlink --no-replace replaced an existing link")
+	}
+	if target, err := os.Readlink(link); err != nil || target != "dst" {
+		t.Fatalf("symlink points to %q (%v), expected %q", target, err, "dst")
+	}
+
+	if _, status := run(t, "", "rm", link); status != 0 {
+		t.Fatalf("rm exited with status %d", status)
+	}
+	if _, err := os.Lstat(link); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("symlink not removed: %v", err)
+	}
+}
+
+func TestReadSumFile(t *testing.T) {
+	dir := t.TempDir()
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("b", 64)
+
+	for _, tc := range []struct {
+		contents string
+		names    []string
+		sum      string
+	}{
+		{a + "\n", []string{"x"}, a},
+		{a + "  x\n", []string{"y"}, ""},
+		{a + "  x\n", []string{"y", "x"}, a},
+		{"# comment\n" + a + "  x\n" + b + " *dir/y\n", []string{"/src/y"}, b},
+		{a + "  x\n" + b + "  y\n", []string{"", "x"}, a},
+		{a + "  x\n" + b + "  y\n", []string{"z"}, ""},
+	} {
+		name := filepath.Join(dir, "sums")
+		if err := os.WriteFile(name, []byte(tc.contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := readSumFile(name, tc.names)
+		if tc.sum == "" && err == nil {
+			t.Fatalf("%q: found %q for %q", tc.contents, sum, tc.names)
+		} else if tc.sum != "" && (err != nil || sum != tc.sum) {
+			t.Fatalf("%q: found %q (%v) for %q, expected %q", tc.contents, sum, err, tc.names, tc.sum)
+		}
+	}
+}
+
+func checkFile(t *testing.T, name, contents string) {
+	t.Helper()
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != contents {
+		t.Fatalf("file %s contains %q, expected %q", name, buf, contents)
+	}
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The timeouts of the downloads (see --from-url). The download as a whole
+// has no deadline, as large files can take arbitrarily long to download, but
+// it is aborted if no data is received for stallTimeout.
+const (
+	dialTimeout   = 30 * time.Second
+	headerTimeout = 30 * time.Second
+	stallTimeout  = time.Minute
+)
+
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: dialTimeout}).DialContext,
+		TLSHandshakeTimeout:   dialTimeout,
+		ResponseHeaderTimeout: headerTimeout,
+	},
+}
+
+// download starts downloading url, and returns the body of the response and
+// its length (or -1, if unknown). The caller is responsible for closing the
+// body.
+func download(url string) (io.ReadCloser, int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		return nil, 0, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, 0, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		cancel()
+		return nil, 0, errors.New("GET " + url + ": " + resp.Status)
+	}
+	body := &stallReader{
+		body:   resp.Body,
+		ctx:    ctx,
+		cancel: cancel,
+		timer:  time.AfterFunc(stallTimeout, cancel),
+	}
+	return body, resp.ContentLength, nil
+}
+
+// stallReader reads the body of a response, canceling the request if no data
+// is received for stallTimeout.
+type stallReader struct {
+	body   io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if err != nil && r.ctx.Err() != nil {
+		return n, errors.New("download stalled for " + stallTimeout.String())
+	}
+	r.timer.Reset(stallTimeout)
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.body.Close()
+}
@@ -0,0 +1,122 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+	"golang.org/x/sys/unix"
+)
+
+// jsonOutput makes the commands print their outcome as JSON (see --json).
+var jsonOutput bool
+
+// jsonDigest adds the SHA-256 digest of the contents to the JSON output (see
+// --sha256).
+var jsonDigest bool
+
+// report collects the outcome of a command, to print it with --json.
+type report struct {
+	// Path is the absolute path of the file created or modified.
+	Path string `json:"path,omitempty"`
+	// Written is the number of bytes written, for the commands that write
+	// files.
+	Written   *int64 `json:"written,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	Strategy  string `json:"strategy,omitempty"`
+	Backup    string `json:"backup,omitempty"`
+	Unchanged bool   `json:"unchanged,omitempty"`
+	// Timings is the time spent in each stage, in seconds.
+	Timings      map[string]float64       `json:"timings,omitempty"`
+	Capabilities *atomicfile.Capabilities `json:"capabilities,omitempty"`
+
+	result atomicfile.Result
+	// collected reports whether result was collected, i.e. whether the
+	// command created a file.
+	collected bool
+	hash      hash.Hash
+	start     time.Time
+	// failed is the last stage that failed, if any.
+	failed string
+}
+
+// options returns the options that collect the outcome of the creation of
+// a file into r. The timings are collected only with --json, and the digest
+// only with --sha256 as well, as computing it prevents the use of zero-copy
+// mechanisms.
+func (r *report) options() []atomicfile.Option {
+	r.collected = true
+	opts := []atomicfile.Option{atomicfile.Report(&r.result)}
+	if !jsonOutput {
+		return opts
+	}
+	if jsonDigest {
+		r.hash = sha256.New()
+		opts = append(opts, atomicfile.Hash(r.hash))
+	}
+	r.Timings = make(map[string]float64)
+	r.start = time.Now()
+	return append(opts,
+		atomicfile.Observe(func(s atomicfile.Stage, d time.Duration, err error) {
+			r.Timings[s.String()] += d.Seconds()
+			if err != nil {
+				r.failed = s.String()
+			}
+		}),
+	)
+}
+
+// print prints r, for the file name, as JSON.
+func (r *report) print(name string) {
+	if name != "" {
+		if abs, err := filepath.Abs(name); err == nil {
+			name = abs
+		}
+		r.Path = name
+	}
+	if r.collected {
+		r.Written = &r.result.Written
+	}
+	if r.hash != nil && !r.result.Unchanged {
+		r.SHA256 = hex.EncodeToString(r.hash.Sum(nil))
+	}
+	if r.result.Strategy != 0 {
+		r.Strategy = r.result.Strategy.String()
+	}
+	r.Backup = r.result.Backup
+	r.Unchanged = r.result.Unchanged
+	if r.Timings != nil {
+		r.Timings["total"] = time.Since(r.start).Seconds()
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(r)
+}
+
+// jsonError is the JSON representation of an error (see --json).
+type jsonError struct {
+	Error string `json:"error"`
+	// Stage is the last stage that failed, if known.
+	Stage string `json:"stage,omitempty"`
+	// Errno and ErrnoName identify the system call error, if any.
+	Errno     int    `json:"errno,omitempty"`
+	ErrnoName string `json:"errno_name,omitempty"`
+}
+
+// printError prints err, that occurred in stage (if known), as JSON.
+func printError(err error, stage string) {
+	e := jsonError{Error: err.Error(), Stage: stage}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		e.Errno, e.ErrnoName = int(errno), unix.ErrnoName(errno)
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(e)
+}
@@ -0,0 +1,250 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// fileFlags registers on cmd the flags that control how a file is created,
+// and returns a function that returns the corresponding options once the
+// command line has been parsed.
+func fileFlags(cmd *kingpin.CmdClause) func() []atomicfile.Option {
+	fsync := cmd.Flag("fsync", "Fsync the file").Default("false").Bool()
+	dontneed := cmd.Flag("dontneed", "Minimize block cache usage").Default("false").Bool()
+	prealloc := cmd.Flag("prealloc", "Preallocate file space (bytes)").Default("0").Int64()
+	preallocMode := cmd.Flag("prealloc-mode", "Preallocation mode (keep-size, extend, zero-range)").Default("keep-size").Enum("keep-size", "extend", "zero-range")
+	xattrs := cmd.Flag("xattr", "Extended attributes to be added to the file").PlaceHolder("KEY=VALUE").StringMap()
+	perm := cmd.Flag("perm", "File permissions").String()
+	executable := cmd.Flag("executable", "Make the file executable by the users that can read it").Default("false").Bool()
+	uid := cmd.Flag("uid", "File owner user").Default("-1").PlaceHolder("UID").Int()
+	gid := cmd.Flag("gid", "File owner group").Default("-1").PlaceHolder("GID").Int()
+	owner := cmd.Flag("owner", "File owner user and/or group (names or IDs)").PlaceHolder("USER:GROUP").String()
+	mtime := cmd.Flag("mtime", "File modification time (RFC 3339)").String()
+	atime := cmd.Flag("atime", "File access time (RFC 3339)").String()
+	compress := cmd.Flag("compress", "Compress the contents (gzip)").Enum("gzip")
+	selinux := cmd.Flag("selinux-context", "File SELinux security context").PlaceHolder("CONTEXT").String()
+	immutable := cmd.Flag("immutable", "Make the file immutable (see chattr)").Default("false").Bool()
+	copyBuffer := cmd.Flag("copy-buffer", "Size of the buffer used to copy the contents (bytes)").Default("0").PlaceHolder("SIZE").Int()
+	sparse := cmd.Flag("sparse", "Do not store blocks of zeros (like cp --sparse=always)").Default("false").Bool()
+	strategy := cmd.Flag("strategy", "Force the mechanism used to create the file (linkat, proc-link, rename)").Enum("linkat", "proc-link", "rename")
+	procMount := cmd.Flag("proc-mount", "Directory where procfs is mounted (used by proc-link)").PlaceHolder("DIR").String()
+	verify := cmd.Flag("verify", "Read back the file before linking it, bypassing the page cache").Default("false").Bool()
+
+	return func() []atomicfile.Option {
+		var opts []atomicfile.Option
+		if *fsync {
+			opts = append(opts, atomicfile.Fsync())
+		}
+		if *dontneed {
+			opts = append(opts, atomicfile.FadviseDontNeed())
+		}
+		if *prealloc != 0 {
+			opts = append(opts, atomicfile.Preallocate(*prealloc))
+		}
+		switch *preallocMode {
+		case "extend":
+			opts = append(opts, atomicfile.PreallocateMode(atomicfile.PreallocExtend))
+		case "zero-range":
+			opts = append(opts, atomicfile.PreallocateMode(atomicfile.PreallocZeroRange))
+		}
+		if *copyBuffer != 0 {
+			opts = append(opts, atomicfile.CopyBufferSize(*copyBuffer))
+		}
+		if *sparse {
+			opts = append(opts, atomicfile.Sparse())
+		}
+		switch *strategy {
+		case "linkat":
+			opts = append(opts, atomicfile.ForceStrategy(atomicfile.StrategyLinkat))
+		case "proc-link":
+			opts = append(opts, atomicfile.ForceStrategy(atomicfile.StrategyProcLink))
+		case "rename":
+			opts = append(opts, atomicfile.ForceStrategy(atomicfile.StrategyRename))
+		}
+		if *procMount != "" {
+			opts = append(opts, atomicfile.ProcMount(*procMount))
+		}
+		if *verify {
+			opts = append(opts, atomicfile.VerifyAfterWriteDirect())
+		}
+		for k, v := range *xattrs {
+			opts = append(opts, atomicfile.Xattr(k, []byte(v)))
+		}
+		if *perm != "" {
+			pp, err := strconv.ParseUint(*perm, 8, 32)
+			if err != nil {
+				fatal(err)
+			}
+			mode := os.FileMode(pp) & os.ModePerm
+			if pp&0o4000 != 0 {
+				mode |= os.ModeSetuid
+			}
+			if pp&0o2000 != 0 {
+				mode |= os.ModeSetgid
+			}
+			if pp&0o1000 != 0 {
+				mode |= os.ModeSticky
+			}
+			opts = append(opts, atomicfile.Permissions(mode))
+		}
+		if *executable {
+			opts = append(opts, atomicfile.Executable())
+		}
+		if *uid != -1 {
+			opts = append(opts, atomicfile.Uid(*uid))
+		}
+		if *gid != -1 {
+			opts = append(opts, atomicfile.Gid(*gid))
+		}
+		if *owner != "" {
+			ug := strings.SplitN(*owner, ":", 2)
+			if ug[0] != "" {
+				opts = append(opts, atomicfile.Owner(ug[0]))
+			}
+			if len(ug) == 2 && ug[1] != "" {
+				opts = append(opts, atomicfile.Group(ug[1]))
+			}
+		}
+		if *mtime != "" {
+			t, err := time.Parse(time.RFC3339Nano, *mtime)
+			if err != nil {
+				fatal(err)
+			}
+			opts = append(opts, atomicfile.ModificationTime(t))
+		}
+		if *atime != "" {
+			t, err := time.Parse(time.RFC3339Nano, *atime)
+			if err != nil {
+				fatal(err)
+			}
+			opts = append(opts, atomicfile.AccessTime(t))
+		}
+		if *selinux != "" {
+			opts = append(opts, atomicfile.SELinuxContext(*selinux))
+		}
+		if *immutable {
+			opts = append(opts, atomicfile.Immutable())
+		}
+		switch *compress {
+		case "gzip":
+			opts = append(opts, atomicfile.Compress(atomicfile.Gzip(gzip.DefaultCompression)))
+		}
+		return opts
+	}
+}
+
+// overwriteFlags registers on cmd the flags that control whether an existing
+// file is replaced and whether it is backed up, and returns a function that
+// returns the corresponding options once the command line has been parsed.
+// If replace is true the command always replaces the existing file, so only
+// the backup flags are registered.
+func overwriteFlags(cmd *kingpin.CmdClause, replace bool) func() []atomicfile.Option {
+	force, noClobber := &replace, new(bool)
+	if !replace {
+		force = cmd.Flag("force", "Replace the file if it exists").Short('f').Default("false").Bool()
+		noClobber = cmd.Flag("no-clobber", "Fail if the file exists (default)").Short('n').Default("false").Bool()
+	}
+	backup := cmd.Flag("backup", "Keep the replaced file, appending the backup suffix to its name (implies --force)").Short('b').Default("false").Bool()
+	suffix := cmd.Flag("suffix", "Backup suffix").Short('S').Default("~").String()
+
+	return func() []atomicfile.Option {
+		if *noClobber && (*force || *backup) {
+			fatal(errors.New("--no-clobber can not be used with --force or --backup"))
+		}
+		var opts []atomicfile.Option
+		if *force || *backup {
+			opts = append(opts, atomicfile.Replace())
+		}
+		if *backup {
+			opts = append(opts, atomicfile.Backup(*suffix))
+		}
+		return opts
+	}
+}
+
+// checksumFlags registers on cmd the flags that specify the expected SHA-256
+// digest of the contents, and returns a function that returns the
+// corresponding options once the command line has been parsed. The digest
+// read from a checksum file is the one for the first of names (e.g. the
+// source and the target file) that is found in it.
+func checksumFlags(cmd *kingpin.CmdClause) func(names ...string) []atomicfile.Option {
+	sum := cmd.Flag("verify-sha256", "Create the file only if the SHA-256 digest of the contents is HEX").PlaceHolder("HEX").String()
+	sumFile := cmd.Flag("verify-from", "Like --verify-sha256, reading the digest from FILE (in the format of sha256sum)").PlaceHolder("FILE").String()
+
+	return func(names ...string) []atomicfile.Option {
+		if *sum != "" && *sumFile != "" {
+			fatal(errors.New("--verify-sha256 and --verify-from are mutually exclusive"))
+		}
+		hexSum := *sum
+		if *sumFile != "" {
+			var err error
+			hexSum, err = readSumFile(*sumFile, names)
+			if err != nil {
+				fatal(err)
+			}
+		}
+		if hexSum == "" {
+			return nil
+		}
+		expected, err := hex.DecodeString(hexSum)
+		if err != nil || len(expected) != sha256.Size {
+			fatal(errors.New("invalid SHA-256 digest " + hexSum))
+		}
+		return []atomicfile.Option{atomicfile.VerifyChecksum(crypto.SHA256, expected)}
+	}
+}
+
+// readSumFile returns the digest for the first of names that is found in the
+// checksum file filename, in the format of sha256sum (one "DIGEST  NAME" line
+// per file); names are compared by their last element. If the checksum file
+// contains a single digest without a name, it is returned for any of names.
+func readSumFile(filename string, names []string) (string, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	var sums, sumNames []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		sums = append(sums, fields[0])
+		if len(fields) > 1 {
+			// sha256sum marks binary files with a leading '*'
+			sumNames = append(sumNames, path.Base(strings.TrimPrefix(fields[1], "*")))
+		} else {
+			sumNames = append(sumNames, "")
+		}
+	}
+	if len(sums) == 1 && sumNames[0] == "" {
+		return sums[0], nil
+	}
+	var tried []string
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		for i := range sums {
+			if sumNames[i] == path.Base(name) {
+				return sums[i], nil
+			}
+		}
+		tried = append(tried, path.Base(name))
+	}
+	return "", errors.New(filename + ": no digest for " + strings.Join(tried, " or "))
+}
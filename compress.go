@@ -0,0 +1,48 @@
+package atomicfile
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// Codec compresses the contents written to the target file. Only Gzip is
+// provided by this package, so that it does not depend on third-party
+// compression libraries: see the atomicfilezstd module for zstd.
+type Codec interface {
+	// NewWriter returns a writer that compresses the data written to it,
+	// and writes the compressed data to w. Close is called once all the
+	// contents have been written.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+type codecFunc func(w io.Writer) (io.WriteCloser, error)
+
+func (c codecFunc) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return c(w)
+}
+
+// Gzip returns a Codec that compresses data in gzip format, using the
+// specified compression level (see compress/gzip).
+func Gzip(level int) Codec {
+	return codecFunc(func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, level)
+	})
+}
+
+// Compress compresses the contents with the specified codec before writing
+// them to the target file.
+// The Hash, VerifyChecksum, MaxSize and ExpectSize options apply to the
+// uncompressed contents, while ChecksumXattr and Result.Written refer to the
+// compressed data written to the target file.
+// As the contents need to be read in userspace, specifying Compress prevents
+// the use of zero-copy mechanisms to populate the target file.
+func Compress(codec Codec) Option {
+	return optionFunc(func(c *config) error {
+		if c.compressed {
+			return &werror{"multiple codecs", nil}
+		}
+		c.compressed = true
+		c.transforms = append(c.transforms, codec.NewWriter)
+		return nil
+	})
+}
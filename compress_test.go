@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestCompress(t *testing.T) {
+	dir := t.TempDir()
+	contents := bytes.Repeat([]byte("hello "), 1<<16)
+	src := openAt(t, t.TempDir(), contents, 0)
+
+	for _, c := range []struct {
+		name   string
+		codec  atomicfile.Codec
+		reader func(io.Reader) (io.Reader, error)
+	}{
+		{"gzip", atomicfile.Gzip(gzip.BestSpeed), func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+	} {
+		name := filepath.Join(dir, c.name)
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		var r atomicfile.Result
+		err := atomicfile.Create(name,
+			atomicfile.Contents(src),
+			atomicfile.Compress(c.codec),
+			atomicfile.MaxSize(int64(len(contents))),
+			atomicfile.Report(&r),
+		)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Written != fi.Size() || r.Written >= int64(len(contents)) {
+			t.Fatalf("%s: Written is %d, file size is %d", c.name, r.Written, fi.Size())
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := c.reader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := io.ReadAll(zr)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, contents) {
+			t.Fatalf("%s: decompressed contents differ", c.name)
+		}
+	}
+	checkDirEntries(t, dir, "gzip")
+
+	err := atomicfile.Create(filepath.Join(dir, "multiple"),
+		atomicfile.Compress(atomicfile.Gzip(gzip.BestSpeed)),
+		atomicfile.Compress(atomicfile.Gzip(gzip.BestSpeed)),
+	)
+	if err == nil {
+		t.Fatal("multiple codecs accepted")
+	}
+}
@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Copy atomically creates dst with the contents of the regular file src.
+// Unless the corresponding options are specified, the permissions,
+// ownership, access and modification times, and extended attributes of src
+// are preserved in dst. Like for cp -p, ownership is preserved only if the
+// process is allowed to do so. The checksums stored by ChecksumXattr are
+// preserved only if the contents are copied as is, i.e. if neither Transform
+// nor Compress is specified.
+// The Contents option can not be used with Copy.
+// Note that src is not read atomically.
+func Copy(dst, src string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	if cfg.contents != defaultConfig().contents {
+		return &werror{"options", &werror{"multiple contents", nil}}
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return &werror{"opening source file", err}
+	}
+	defer f.Close()
+
+	var st unix.Stat_t
+	err = unix.Fstat(int(f.Fd()), &st)
+	if err != nil {
+		return &werror{"reading source file metadata", err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG {
+		return &werror{"source is not a regular file", nil}
+	}
+
+	cfg.contents = f
+	what := inheritMetadata | inheritTimes | inheritChecksums
+	if len(cfg.transforms) > 0 {
+		// the checksums of src do not match the transformed contents
+		what &^= inheritChecksums
+	}
+	err = cfg.inherit(int(f.Fd()), what)
+	if err != nil {
+		return &werror{"reading source file metadata", err}
+	}
+
+	return create(unix.AT_FDCWD, dst, cfg)
+}
+
+func hasXattr(xattrs []xattr, name string) bool {
+	for _, xattr := range xattrs {
+		if xattr.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+	"golang.org/x/sys/unix"
+)
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("contents"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(src, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(src, "user.test", []byte("value"), 0); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := atomicfile.Copy(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, dst, "contents")
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o640 {
+		t.Fatalf("permissions are %v, expected %v", fi.Mode().Perm(), os.FileMode(0o640))
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Fatalf("modification time is %v, expected %v", fi.ModTime(), mtime)
+	}
+	checkXattr(t, dst, "user.test", "value")
+
+	// the options take precedence over the metadata of the source file
+	dst = filepath.Join(dir, "dst2")
+	err = atomicfile.Copy(dst, src,
+		atomicfile.Permissions(0o600),
+		atomicfile.Xattr("user.test", []byte("other")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, dst, "contents")
+	fi, err = os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Fatalf("permissions are %v, expected %v", fi.Mode().Perm(), os.FileMode(0o600))
+	}
+	checkXattr(t, dst, "user.test", "other")
+
+	if err := atomicfile.Copy(dst, src); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+	}
+	if err := atomicfile.Copy(filepath.Join(dir, "dir"), dir); err == nil {
+		t.Fatal("directory copied")
+	}
+	err = atomicfile.Copy(filepath.Join(dir, "dst3"), src, atomicfile.Contents(bytes.NewReader(nil)))
+	if err == nil {
+		t.Fatal("Contents accepted by Copy")
+	}
+	checkDirEntries(t, dir, "dst", "dst2", "src")
+}
+
+func checkXattr(t *testing.T, name, attr, value string) {
+	t.Helper()
+	buf := make([]byte, 256)
+	n, err := unix.Getxattr(name, attr, buf)
+	if err != nil {
+		t.Fatalf("reading xattr %s of %s: %v", attr, name, err)
+	}
+	if string(buf[:n]) != value {
+		t.Fatalf("xattr %s of %s is %q, expected %q", attr, name, buf[:n], value)
+	}
+}
@@ -0,0 +1,195 @@
+//go:build linux
+// +build linux
+
+// Package crashtest verifies that workloads using atomicfile preserve their
+// invariants if they crash at any point.
+//
+// A Test runs its workload once to record the sequence of stages performed
+// by atomicfile, and then once for each stage, simulating a crash right after
+// it (see atomicfile.InjectFault) and checking the invariants on the state
+// left behind. Crashes are simulated in-process: the data that was not yet
+// synced to stable storage is not lost, as it could be after a real power
+// loss, so durability is only verified in terms of the recorded sequence of
+// stages (see Test.Durability), not at the block level.
+package crashtest
+
+import (
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+// Test describes a crash-consistency test.
+type Test struct {
+	// Setup, if not nil, prepares the directory dir before each run of
+	// Workload (e.g. by creating the files that Workload replaces).
+	Setup func(dir string) error
+	// Workload performs the operations under test in the directory dir.
+	// It must pass opts to each call to atomicfile, and return as soon as
+	// one of them fails.
+	Workload func(dir string, opts ...atomicfile.Option) error
+	// Check verifies that the invariants of the workload hold in the
+	// directory dir, after Workload completed or crashed (e.g. by calling
+	// atomicfile.CheckAtomic).
+	Check func(dir string) error
+	// Durability is the durability level requested by Workload. If it is
+	// at least atomicfile.DurabilityData, Run verifies that each file is
+	// synced (atomicfile.StageFsync) before it is linked
+	// (atomicfile.StageLink or atomicfile.StageReplace); if it is at least
+	// atomicfile.DurabilityFull, Run also verifies that the directory is
+	// synced (atomicfile.StageDirSync) after each file is linked.
+	Durability atomicfile.DurabilityLevel
+}
+
+// The errors reported by Run when the recorded sequence of stages does not
+// provide the durability requested by the workload (see Test.Durability).
+var (
+	// ErrLinkedBeforeSync is reported when a file is linked before being
+	// synced: after a crash, the file may be visible with partial contents.
+	ErrLinkedBeforeSync = errors.New("file linked before being synced")
+	// ErrDirNotSynced is reported when the directory is not synced after a
+	// file has been linked: after a crash, the file may not be visible.
+	ErrDirNotSynced = errors.New("directory not synced after linking")
+)
+
+// Failure describes a crash point after which the invariants did not hold,
+// or a stage that does not provide the requested durability.
+type Failure struct {
+	// Point is the index of the crash point, in the sequence of stages
+	// performed by the workload, or -1 if the invariants did not hold after
+	// the workload completed without crashing.
+	Point int
+	// Stage is the stage after which the crash was simulated.
+	Stage atomicfile.Stage
+	// Err is the error returned by Check, or ErrLinkedBeforeSync or
+	// ErrDirNotSynced.
+	Err error
+}
+
+func (f Failure) Error() string {
+	if f.Point < 0 {
+		return "no crash: " + f.Err.Error()
+	}
+	return "crash after " + f.Stage.String() + " (point " + strconv.Itoa(f.Point) + "): " + f.Err.Error()
+}
+
+func (f Failure) Unwrap() error {
+	return f.Err
+}
+
+// Run runs t, in temporary directories that are removed once done, and
+// returns the crash points after which the invariants did not hold, and the
+// stages that do not provide the durability requested by t. An error
+// is returned if t could not be run (e.g. because Setup failed, or Workload
+// failed without a simulated crash).
+func (t Test) Run() ([]Failure, error) {
+	var stages []atomicfile.Stage
+	record := atomicfile.InjectFault(func(s atomicfile.Stage) atomicfile.Fault {
+		stages = append(stages, s)
+		return atomicfile.NoFault
+	})
+	var failures []Failure
+	err := t.run(record, func(err error) {
+		failures = append(failures, Failure{Point: -1, Err: err})
+	})
+	if err != nil {
+		return nil, err
+	}
+	failures = append(failures, t.checkOrder(stages)...)
+
+	for i, s := range stages {
+		point, stage := i, s
+		n := 0
+		crash := atomicfile.InjectFault(func(atomicfile.Stage) atomicfile.Fault {
+			n++
+			if n-1 == point {
+				return atomicfile.Crash
+			}
+			return atomicfile.NoFault
+		})
+		err := t.run(crash, func(err error) {
+			failures = append(failures, Failure{Point: point, Stage: stage, Err: err})
+		})
+		if err != nil {
+			return nil, &werror{"crash point " + strconv.Itoa(point), err}
+		}
+	}
+	return failures, nil
+}
+
+// checkOrder verifies that the sequence of stages provides the durability
+// requested by t. Each link must be preceded by a fsync of the file, and
+// followed by a fsync of the directory, that are not matched with other
+// links: e.g. the files created by atomicfile.CreateMany are all linked
+// before the directory is synced once per file.
+func (t Test) checkOrder(stages []atomicfile.Stage) []Failure {
+	var failures []Failure
+	var synced int
+	var unsynced []int
+	for i, s := range stages {
+		switch s {
+		case atomicfile.StageFsync:
+			synced++
+		case atomicfile.StageLink, atomicfile.StageReplace:
+			if t.Durability >= atomicfile.DurabilityData {
+				if synced == 0 {
+					failures = append(failures, Failure{Point: i, Stage: s, Err: ErrLinkedBeforeSync})
+				} else {
+					synced--
+				}
+			}
+			unsynced = append(unsynced, i)
+		case atomicfile.StageDirSync:
+			if len(unsynced) > 0 {
+				unsynced = unsynced[1:]
+			}
+		}
+	}
+	if t.Durability >= atomicfile.DurabilityFull {
+		for _, i := range unsynced {
+			failures = append(failures, Failure{Point: i, Stage: stages[i], Err: ErrDirNotSynced})
+		}
+	}
+	return failures
+}
+
+// run runs the workload of t once, with the fault injection option opt, in a
+// new temporary directory, and reports the error returned by Check to fail.
+func (t Test) run(opt atomicfile.Option, fail func(error)) error {
+	dir, err := os.MkdirTemp("", "crashtest")
+	if err != nil {
+		return &werror{"creating directory", err}
+	}
+	defer os.RemoveAll(dir)
+
+	if t.Setup != nil {
+		if err := t.Setup(dir); err != nil {
+			return &werror{"setting up", err}
+		}
+	}
+	if err := t.Workload(dir, opt); err != nil && !errors.Is(err, atomicfile.ErrSimulatedCrash) {
+		return &werror{"running workload", err}
+	}
+	if err := t.Check(dir); err != nil {
+		fail(err)
+	}
+	return nil
+}
+
+type werror struct {
+	msg   string
+	cause error
+}
+
+func (e *werror) Error() string {
+	if e.cause == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.cause.Error()
+}
+
+func (e *werror) Unwrap() error {
+	return e.cause
+}
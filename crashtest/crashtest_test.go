@@ -0,0 +1,206 @@
+//go:build linux
+// +build linux
+
+package crashtest_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+	"github.com/CAFxX/atomicfile/crashtest"
+)
+
+func TestReplace(t *testing.T) {
+	for _, level := range []atomicfile.DurabilityLevel{
+		atomicfile.DurabilityNone,
+		atomicfile.DurabilityData,
+		atomicfile.DurabilityFull,
+		atomicfile.DurabilityParanoid,
+	} {
+		test := crashtest.Test{
+			Setup: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, "file"), []byte("old"), 0o644)
+			},
+			Workload: func(dir string, opts ...atomicfile.Option) error {
+				opts = append(opts,
+					atomicfile.Contents(bytes.NewReader([]byte("new"))),
+					atomicfile.Replace(),
+					atomicfile.Durability(level),
+				)
+				return atomicfile.Create(filepath.Join(dir, "file"), opts...)
+			},
+			Check: func(dir string) error {
+				return atomicfile.CheckAtomic(filepath.Join(dir, "file"), []byte("old"), []byte("new"))
+			},
+			Durability: level,
+		}
+		checkNoFailures(t, test)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	test := crashtest.Test{
+		Setup: func(dir string) error {
+			return os.WriteFile(filepath.Join(dir, "file"), []byte("old"), 0o644)
+		},
+		Workload: func(dir string, opts ...atomicfile.Option) error {
+			opts = append(opts,
+				atomicfile.Contents(bytes.NewReader([]byte("new"))),
+				atomicfile.Replace(),
+				atomicfile.Backup(".bak"),
+				atomicfile.Fsync(),
+			)
+			return atomicfile.Create(filepath.Join(dir, "file"), opts...)
+		},
+		Check: func(dir string) error {
+			// the target file must always exist, and the backup (if any)
+			// must be the previous version
+			name := filepath.Join(dir, "file")
+			if _, err := os.Stat(name); err != nil {
+				return err
+			}
+			if err := atomicfile.CheckAtomic(name, []byte("old"), []byte("new")); err != nil {
+				return err
+			}
+			return atomicfile.CheckAtomic(name+".bak", []byte("old"))
+		},
+		Durability: atomicfile.DurabilityFull,
+	}
+	checkNoFailures(t, test)
+}
+
+func TestCreateMany(t *testing.T) {
+	names := []string{"a", "b", "c"}
+	test := crashtest.Test{
+		Workload: func(dir string, opts ...atomicfile.Option) error {
+			var files []atomicfile.FileSpec
+			for _, name := range names {
+				files = append(files, atomicfile.FileSpec{
+					Name:    name,
+					Options: []atomicfile.Option{atomicfile.Contents(bytes.NewReader([]byte(name)))},
+				})
+			}
+			opts = append(opts, atomicfile.Fsync())
+			return atomicfile.CreateMany(dir, files, opts...)
+		},
+		Check: func(dir string) error {
+			for _, name := range names {
+				if err := atomicfile.CheckAtomic(filepath.Join(dir, name), []byte(name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Durability: atomicfile.DurabilityFull,
+	}
+	checkNoFailures(t, test)
+}
+
+func TestNonAtomicWorkload(t *testing.T) {
+	// the workload updates a file in place around the call to atomicfile,
+	// so a crash at any stage leaves it partially written
+	test := crashtest.Test{
+		Workload: func(dir string, opts ...atomicfile.Option) error {
+			f, err := os.Create(filepath.Join(dir, "log"))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := f.WriteString("begin "); err != nil {
+				return err
+			}
+			opts = append(opts, atomicfile.Contents(bytes.NewReader([]byte("data"))))
+			if err := atomicfile.Create(filepath.Join(dir, "file"), opts...); err != nil {
+				return err
+			}
+			_, err = f.WriteString("end")
+			return err
+		},
+		Check: func(dir string) error {
+			return atomicfile.CheckAtomic(filepath.Join(dir, "log"), []byte("begin end"))
+		},
+	}
+	failures, err := test.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) == 0 {
+		t.Fatal("no failures reported")
+	}
+	for i, f := range failures {
+		if f.Point != i {
+			t.Fatalf("failure %d is for crash point %d", i, f.Point)
+		}
+		if !errors.Is(f, atomicfile.ErrNotAtomic) {
+			t.Fatalf("expected failure %d to wrap ErrNotAtomic, got %v", i, f)
+		}
+	}
+}
+
+func TestDurabilityOrder(t *testing.T) {
+	// the workload does not sync anything, but claims full durability
+	test := crashtest.Test{
+		Workload: func(dir string, opts ...atomicfile.Option) error {
+			opts = append(opts, atomicfile.Contents(bytes.NewReader([]byte("data"))))
+			return atomicfile.Create(filepath.Join(dir, "file"), opts...)
+		},
+		Check: func(dir string) error {
+			return atomicfile.CheckAtomic(filepath.Join(dir, "file"), []byte("data"))
+		},
+		Durability: atomicfile.DurabilityFull,
+	}
+	failures, err := test.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var linked, dir bool
+	for _, f := range failures {
+		switch {
+		case errors.Is(f, crashtest.ErrLinkedBeforeSync):
+			linked = true
+		case errors.Is(f, crashtest.ErrDirNotSynced):
+			dir = true
+		default:
+			t.Errorf("unexpected failure: %v", f)
+		}
+		if f.Stage != atomicfile.StageLink {
+			t.Errorf("failure reported for stage %v, expected %v", f.Stage, atomicfile.StageLink)
+		}
+	}
+	if !linked || !dir {
+		t.Fatalf("failures are %v, expected both ErrLinkedBeforeSync and ErrDirNotSynced", failures)
+	}
+}
+
+func TestSetupError(t *testing.T) {
+	errSetup := errors.New("setup failed")
+	test := crashtest.Test{
+		Setup: func(dir string) error {
+			return errSetup
+		},
+		Workload: func(dir string, opts ...atomicfile.Option) error {
+			return nil
+		},
+		Check: func(dir string) error {
+			return nil
+		},
+	}
+	if _, err := test.Run(); !errors.Is(err, errSetup) {
+		t.Fatalf("expected an error wrapping the setup error, got %v", err)
+	}
+}
+
+func checkNoFailures(t *testing.T, test crashtest.Test) {
+	t.Helper()
+	failures, err := test.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range failures {
+		t.Error(f)
+	}
+}
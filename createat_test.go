@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestCreateAt(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	err = atomicfile.CreateAt(d, "sub/file", atomicfile.Contents(bytes.NewReader([]byte("hello"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "sub", "file"), "hello")
+
+	// the directory is used even after it has been renamed
+	if err := os.Rename(dir, dir+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Rename(dir+".moved", dir)
+	err = atomicfile.CreateAt(d, "file",
+		atomicfile.Contents(bytes.NewReader([]byte("moved"))),
+		atomicfile.Replace(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir+".moved", "file"), "moved")
+	checkDirEntries(t, dir+".moved", "file", "sub")
+
+	// absolute paths are not resolved relative to dir
+	abs := filepath.Join(t.TempDir(), "abs")
+	if err := atomicfile.CreateAt(d, abs); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, abs, "")
+}
@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Creator creates files in a directory, using a set of default options.
+// The directory is opened once by NewCreator, so that creating each file
+// does not require resolving the path of the directory again (as CreateAt).
+// The mechanisms used to create the files (e.g. whether O_TMPFILE is
+// supported) are detected by the first call to Create, and reused by the
+// following ones.
+// A Creator can be used concurrently by multiple goroutines, and implements
+// WriteFS.
+type Creator struct {
+	dir     *os.File
+	options []Option
+	// cache records the mechanisms supported in dir. It is not used for the
+	// files created in subdirectories of dir, that may be on a different
+	// filesystem.
+	cache *dirCache
+}
+
+// NewCreator returns a Creator that creates files in dir, using the specified
+// default options. The options are validated immediately, so that invalid
+// options are reported by NewCreator instead of by each call to Create. The
+// default options can not include Hash or Report, that would be shared by all
+// files.
+// The Creator must be closed with Close once it is no longer needed.
+func NewCreator(dir string, options ...Option) (*Creator, error) {
+	if err := checkDefaults(options); err != nil {
+		return nil, err
+	}
+	d, err := openAt(unix.AT_FDCWD, dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	if err != nil {
+		return nil, &werror{"opening directory", err}
+	}
+	return &Creator{dir: d, options: options[:len(options):len(options)], cache: &dirCache{}}, nil
+}
+
+// Create creates the file name, resolved relative to the directory of c,
+// like CreateAt. The default options of c are applied before the specified
+// ones.
+func (c *Creator) Create(name string, options ...Option) error {
+	cfg, err := newConfig(append(c.options, options...))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(name, "/") {
+		cfg.dirCache = c.cache
+	}
+	err = create(int(c.dir.Fd()), name, cfg)
+	runtime.KeepAlive(c)
+	return err
+}
+
+// Close closes the directory of c. Create must not be called after Close.
+func (c *Creator) Close() error {
+	return c.dir.Close()
+}
+
+// WriteFile is equivalent to Create, so that a Creator implements WriteFS.
+func (c *Creator) WriteFile(name string, options ...Option) error {
+	return c.Create(name, options...)
+}
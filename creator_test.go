@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestCreator(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := atomicfile.NewCreator(dir, atomicfile.Permissions(0o600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b", "sub/c"} {
+		name := name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Create(name, atomicfile.Contents(bytes.NewReader([]byte(name)))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, name := range []string{"a", "b", "sub/c"} {
+		checkFile(t, filepath.Join(dir, name), name)
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0o600 {
+			t.Fatalf("permissions are %v, expected %v", fi.Mode().Perm(), os.FileMode(0o600))
+		}
+	}
+
+	// the options passed to Create are applied after the default ones
+	err = c.Create("a", atomicfile.Contents(bytes.NewReader([]byte("new"))))
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+	}
+	err = c.Create("a", atomicfile.Contents(bytes.NewReader([]byte("new"))), atomicfile.Replace())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "a"), "new")
+	fi, err := os.Stat(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Fatalf("permissions are %v, expected %v", fi.Mode().Perm(), os.FileMode(0o600))
+	}
+
+	// the directory is opened only once
+	if err := os.Rename(dir, dir+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Rename(dir+".moved", dir)
+	if err := c.Create("d"); err != nil {
+		t.Fatal(err)
+	}
+	checkDirEntries(t, dir+".moved", "a", "b", "d", "sub")
+
+	if _, err := atomicfile.NewCreator(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("missing directory accepted")
+	}
+}
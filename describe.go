@@ -0,0 +1,62 @@
+package atomicfile
+
+import (
+	"io"
+	"os"
+)
+
+// Settings describes the main settings specified by a set of options, as
+// returned by Describe.
+type Settings struct {
+	// Contents is the reader specified with Contents (or one of its
+	// variants), or nil.
+	Contents io.Reader
+	// Replace reports whether Replace was specified.
+	Replace bool
+	// Perm is the permissions specified with Permissions (with Executable
+	// applied), or 0666 if no permissions were specified.
+	Perm os.FileMode
+	// Uid and Gid are the owner UID and GID specified with Ownership (or one
+	// of its variants), or -1 if not specified.
+	Uid, Gid int
+	// Durability is the requested durability level.
+	Durability DurabilityLevel
+	// Result is the Result specified with Report, or nil.
+	Result *Result
+}
+
+// Describe validates options as Create does, and returns the main settings
+// they specify. It allows implementations of WriteFS that do not create files
+// on the filesystem (e.g. test doubles, see package atomicfiletest) to honor
+// the options passed to WriteFile.
+func Describe(options ...Option) (Settings, error) {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return Settings{}, err
+	}
+	s := Settings{
+		Contents:   cfg.contents,
+		Replace:    cfg.replace,
+		Perm:       0o666,
+		Uid:        cfg.uid,
+		Gid:        cfg.gid,
+		Durability: cfg.durability,
+		Result:     cfg.result,
+	}
+	if cfg.perm != defaultConfig().perm {
+		s.Perm = os.FileMode(cfg.perm).Perm()
+		if cfg.perm&0o4000 != 0 {
+			s.Perm |= os.ModeSetuid
+		}
+		if cfg.perm&0o2000 != 0 {
+			s.Perm |= os.ModeSetgid
+		}
+		if cfg.perm&0o1000 != 0 {
+			s.Perm |= os.ModeSticky
+		}
+	}
+	if cfg.executable {
+		s.Perm |= (s.Perm & 0o444) >> 2
+	}
+	return s, nil
+}
@@ -0,0 +1,201 @@
+package atomicfile
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// encryptedSegmentSize is the size of the plaintext segments encrypted
+// independently by Encrypt.
+const encryptedSegmentSize = 64 << 10
+
+// Encrypt encrypts the contents with aead before writing them to the target
+// file, so that the plaintext is never written to disk. The contents can be
+// decrypted with DecryptReader.
+//
+// The contents are split in segments of 64KiB, each encrypted and
+// authenticated independently (using the STREAM construction), so that
+// truncation, reordering and tampering are detected during decryption.
+// The nonce size of aead must be at least 12 bytes: a random nonce prefix
+// of NonceSize-5 bytes is generated for each file, so the number of files
+// encrypted with the same key should be limited accordingly (e.g. for
+// AES-GCM the random prefix is 7 bytes long; XChaCha20-Poly1305 allows
+// a much larger number of files).
+//
+// If Compress is also specified, it should precede Encrypt, as encrypted
+// data is not compressible.
+// The Hash, VerifyChecksum, MaxSize and ExpectSize options apply to the
+// plaintext contents, while ChecksumXattr and Result.Written refer to the
+// encrypted data written to the target file.
+// As the contents need to be read in userspace, specifying Encrypt prevents
+// the use of zero-copy mechanisms to populate the target file.
+func Encrypt(aead cipher.AEAD) Option {
+	return optionFunc(func(c *config) error {
+		if aead.NonceSize() < 12 {
+			return &werror{"nonce size too small", nil}
+		}
+		c.transforms = append(c.transforms, func(w io.Writer) (io.WriteCloser, error) {
+			return newEncryptWriter(w, aead)
+		})
+		return nil
+	})
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	out     []byte
+}
+
+func newEncryptWriter(w io.Writer, aead cipher.AEAD) (*encryptWriter, error) {
+	nonce := make([]byte, aead.NonceSize())
+	prefix := nonce[:len(nonce)-5]
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:     w,
+		aead:  aead,
+		nonce: nonce,
+		buf:   make([]byte, 0, encryptedSegmentSize),
+		out:   make([]byte, 0, encryptedSegmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == encryptedSegmentSize {
+			// the buffered segment is not the last one, as more data follows
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close encrypts and writes the last segment. It does not close the
+// underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("too much data to encrypt")
+	}
+	setSegmentNonce(e.nonce, e.counter, last)
+	e.out = e.aead.Seal(e.out[:0], e.nonce, e.buf, nil)
+	e.buf = e.buf[:0]
+	e.counter++
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+// setSegmentNonce sets the last 5 bytes of nonce to the segment counter and
+// to the flag that marks the last segment.
+func setSegmentNonce(nonce []byte, counter uint32, last bool) {
+	n := len(nonce)
+	binary.BigEndian.PutUint32(nonce[n-5:n-1], counter)
+	nonce[n-1] = 0
+	if last {
+		nonce[n-1] = 1
+	}
+}
+
+// ErrDecryption is returned by the reader returned by DecryptReader if the
+// encrypted data has been truncated or tampered with, or if it was encrypted
+// with a different key.
+var ErrDecryption = errors.New("decryption failed")
+
+// DecryptReader returns a reader that decrypts the data read from r,
+// that has been written by Create using the Encrypt option with an
+// equivalent aead.
+// Data is returned only after it has been authenticated; if the
+// authentication fails, or the data is truncated, the reader returns
+// ErrDecryption.
+func DecryptReader(r io.Reader, aead cipher.AEAD) io.Reader {
+	return &decryptReader{
+		r:    bufio.NewReader(r),
+		aead: aead,
+		in:   make([]byte, encryptedSegmentSize+aead.Overhead()),
+	}
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	in      []byte
+	buf     []byte
+	done    bool
+	err     error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	if d.nonce == nil {
+		d.nonce = make([]byte, d.aead.NonceSize())
+		if _, err := io.ReadFull(d.r, d.nonce[:len(d.nonce)-5]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrDecryption
+		} else if err != nil {
+			return err
+		}
+	}
+
+	n, err := io.ReadFull(d.r, d.in)
+	if err == io.EOF {
+		return ErrDecryption // the last segment is missing
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if d.counter == ^uint32(0) {
+		return ErrDecryption
+	}
+	setSegmentNonce(d.nonce, d.counter, last)
+	d.buf, err = d.aead.Open(d.in[:0], d.nonce, d.in[:n], nil)
+	if err != nil {
+		return ErrDecryption
+	}
+	d.counter++
+	d.done = last
+	return nil
+}
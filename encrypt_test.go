@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func newAEAD(t *testing.T, key byte) cipher.AEAD {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{key}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func decryptFile(t *testing.T, name string, aead cipher.AEAD) ([]byte, error) {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return io.ReadAll(atomicfile.DecryptReader(f, aead))
+}
+
+func TestEncrypt(t *testing.T) {
+	dir := t.TempDir()
+	aead := newAEAD(t, 1)
+
+	for _, size := range []int{0, 1, 64 << 10, 64<<10 + 1, 200 << 10} {
+		name := filepath.Join(dir, fmt.Sprint("file", size))
+		contents := bytes.Repeat([]byte{'x'}, size)
+		err := atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader(contents)),
+			atomicfile.Encrypt(aead),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := decryptFile(t, name, aead)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(buf, contents) {
+			t.Fatalf("%d bytes: decrypted contents differ", size)
+		}
+	}
+
+	// compression is applied before encryption
+	name := filepath.Join(dir, "compressed")
+	contents := bytes.Repeat([]byte("hello "), 1<<16)
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader(contents)),
+		atomicfile.Compress(atomicfile.Gzip(gzip.BestSpeed)),
+		atomicfile.Encrypt(aead),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(atomicfile.DecryptReader(f, aead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, contents) {
+		t.Fatal("decrypted contents differ")
+	}
+}
+
+func TestDecryptReader(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	aead := newAEAD(t, 1)
+	contents := bytes.Repeat([]byte{'x'}, 100<<10)
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader(contents)),
+		atomicfile.Encrypt(aead),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wrong key
+	if _, err := decryptFile(t, name, newAEAD(t, 2)); !errors.Is(err, atomicfile.ErrDecryption) {
+		t.Fatalf("expected ErrDecryption with the wrong key, got %v", err)
+	}
+
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", encrypted[:len(encrypted)-1]},
+		{"truncated at segment", encrypted[:len(encrypted)/2]},
+		{"tampered", append(append([]byte{}, encrypted[:100]...), append([]byte{encrypted[100] ^ 1}, encrypted[101:]...)...)},
+		{"empty", nil},
+	} {
+		_, err := io.ReadAll(atomicfile.DecryptReader(bytes.NewReader(c.data), aead))
+		if !errors.Is(err, atomicfile.ErrDecryption) {
+			t.Fatalf("%s: expected ErrDecryption, got %v", c.name, err)
+		}
+	}
+}
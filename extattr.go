@@ -0,0 +1,53 @@
+//go:build freebsd || netbsd
+// +build freebsd netbsd
+
+package atomicfile
+
+import (
+	"crypto"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// setExtattr sets the extended attribute name on the file fd. As on Linux,
+// name must be prefixed by its namespace ("user." or "system.").
+func setExtattr(fd int, name string, value []byte) error {
+	var ns int
+	switch {
+	case strings.HasPrefix(name, "user."):
+		ns, name = unix.EXTATTR_NAMESPACE_USER, strings.TrimPrefix(name, "user.")
+	case strings.HasPrefix(name, "system."):
+		ns, name = unix.EXTATTR_NAMESPACE_SYSTEM, strings.TrimPrefix(name, "system.")
+	default:
+		return unix.EOPNOTSUPP
+	}
+	var data uintptr
+	if len(value) > 0 {
+		data = uintptr(unsafe.Pointer(&value[0]))
+	}
+	_, err := unix.ExtattrSetFd(fd, ns, name, data, len(value))
+	runtime.KeepAlive(value)
+	return err
+}
+
+// ChecksumXattr computes the digest of the contents, using the hash function
+// algo, while they are written to the target file, and stores it in an
+// extended attribute of the target file (e.g. "user.atomicfile.sha256" for
+// crypto.SHA256, in the user namespace). The hash function must be linked
+// into the binary (e.g. by importing crypto/sha256 for crypto.SHA256).
+func ChecksumXattr(algo crypto.Hash) Option {
+	return optionFunc(func(c *config) error {
+		if !algo.Available() {
+			return &werror{"unavailable hash function", nil}
+		}
+		name := checksumXattrName(algo)
+		if name == "" {
+			return &werror{"unsupported hash function", nil}
+		}
+		c.checksumXattrs = append(c.checksumXattrs, checksum{algo, algo.New(), nil})
+		return nil
+	})
+}
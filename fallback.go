@@ -0,0 +1,222 @@
+//go:build js || plan9
+// +build js plan9
+
+package atomicfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// On js/wasm and plan9 Create uses only the portable APIs of the os package:
+// it populates a temporary file with a random name in the target directory,
+// and then renames it (or, without Replace, links it) as the target file. The
+// durability guarantees are the ones provided by the platform, and the
+// options that can not be implemented fail with ErrUnsupported.
+
+// Create creates the specified file with the provided options.
+// The file is created by populating a temporary file in the same directory,
+// and then linking it (or, if Replace is specified, renaming it over the
+// existing file) as the target file. If the platform does not support hard
+// links, the temporary file is renamed also when Replace is not specified,
+// after checking that the target file does not exist: in this case a
+// concurrently created target file may be replaced.
+// Create fails if the file already exists, unless Replace is specified.
+// If Create fails after the file has been published, the error matches
+// ErrPublished.
+func Create(filename string, options ...Option) (err error) {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	if err := cfg.canceled(); err != nil {
+		return err
+	}
+
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	// Without a way to read the umask, the default and masked permissions
+	// are applied when the temporary file is created, so that the platform
+	// masks them; exact permissions are set once the file is populated.
+	createPerm, exactPerm := os.FileMode(0o666), false
+	if cfg.perm != defaultConfig().perm {
+		createPerm, exactPerm = fileMode(cfg.perm), !cfg.permMasked
+		if exactPerm {
+			createPerm = 0o600
+		}
+	}
+	f, tmp, err := createTemp(dir, base, createPerm)
+	if err != nil {
+		return &werror{"opening file", err}
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			_ = f.Close()
+		}
+		if tmp != "" {
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	if cfg.uid != defaultConfig().uid || cfg.gid != defaultConfig().gid {
+		if err := f.Chown(cfg.uid, cfg.gid); err != nil {
+			return &werror{"setting ownership", err}
+		}
+	}
+
+	var written int64
+	if cfg.contents != nil {
+		written, err = populateFile(f, &cfg)
+		if err != nil {
+			return &werror{"populating file", err}
+		}
+	}
+
+	if exactPerm || cfg.executable {
+		perm := fileMode(cfg.perm)
+		if !exactPerm {
+			fi, err := f.Stat()
+			if err != nil {
+				return &werror{"reading file metadata", err}
+			}
+			perm = fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		}
+		if cfg.executable {
+			perm |= (perm & 0o444) >> 2
+		}
+		if err := f.Chmod(perm); err != nil {
+			return &werror{"setting permissions", err}
+		}
+	}
+
+	if cfg.durability >= DurabilityData {
+		if err := f.Sync(); err != nil {
+			return &werror{"fsync file", err}
+		}
+	}
+
+	// the file is closed before renaming it, as some platforms do not allow
+	// renaming open files
+	closed = true
+	if err := f.Close(); err != nil {
+		return &werror{"closing file", err}
+	}
+
+	if !cfg.mtime.IsZero() || !cfg.atime.IsZero() {
+		// os.Chtimes always sets both times: the one that was not specified
+		// is set to the current time, as the file has just been written
+		atime, mtime := cfg.atime, cfg.mtime
+		if atime.IsZero() {
+			atime = time.Now()
+		}
+		if mtime.IsZero() {
+			mtime = time.Now()
+		}
+		if err := os.Chtimes(tmp, atime, mtime); err != nil {
+			return &werror{"setting access/modification time", err}
+		}
+	}
+
+	if err := cfg.canceled(); err != nil {
+		return err
+	}
+
+	var backup string
+	if cfg.backupSuffix != "" || cfg.backupRotate > 0 {
+		backup, err = backupFile(filename, &cfg)
+		if err != nil {
+			return &werror{"backing up file", err}
+		}
+	}
+
+	// the errors that occur once the file has been published are reported
+	// as such, as the caller can not assume that the target file is unchanged
+	published := false
+	defer func() {
+		if err != nil && published {
+			err = &publishedError{err}
+		}
+	}()
+
+	target := filepath.Join(dir, base)
+	if cfg.replace {
+		if err := os.Rename(tmp, target); err != nil {
+			return &werror{"renaming file", err}
+		}
+	} else if err := os.Link(tmp, target); err == nil {
+		published = true
+		if err := os.Remove(tmp); err != nil {
+			return &werror{"removing temporary file", err}
+		}
+	} else if errors.Is(err, os.ErrExist) {
+		return &werror{"linking file", err}
+	} else if _, err := os.Lstat(target); err == nil {
+		return &werror{"linking file", &os.LinkError{Op: "link", Old: tmp, New: target, Err: os.ErrExist}}
+	} else if err := os.Rename(tmp, target); err != nil {
+		return &werror{"renaming file", err}
+	}
+	tmp, published = "", true
+
+	if cfg.durability >= DurabilityFull {
+		_ = syncDir(dir)
+	}
+
+	if cfg.backupRotate > 0 {
+		if err := pruneBackups(filename, cfg.backupRotate); err != nil {
+			return &werror{"removing backups", err}
+		}
+	}
+
+	return cfg.finish(Result{Written: written, Backup: backup})
+}
+
+// createTemp creates a new file with a random name, and permissions perm,
+// in the directory dir, suitable for a temporary file that will become base,
+// and returns it together with its path.
+func createTemp(dir, base string, perm os.FileMode) (*os.File, string, error) {
+	for i := 0; ; i++ {
+		name, err := tempName(base)
+		if err != nil {
+			return nil, "", err
+		}
+		name = filepath.Join(dir, name)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if err == nil {
+			return f, name, nil
+		} else if !errors.Is(err, os.ErrExist) || i >= 100 {
+			return nil, "", err
+		}
+	}
+}
+
+// syncDir fsyncs the specified directory. Not all platforms support syncing
+// directories, so this is done on a best-effort basis.
+func syncDir(dir string) error {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+	return nil
+}
+
+// syncParents does nothing, as the parent directories can not be synced
+// reliably on this platform (see SyncParentDirs).
+func syncParents(dir string) error {
+	return nil
+}
+
+// setSymlinkTimes fails with ErrUnsupported if cfg specifies the access or
+// modification time, as they can not be set on symbolic links on this
+// platform.
+func setSymlinkTimes(name string, cfg *config) error {
+	if !cfg.mtime.IsZero() || !cfg.atime.IsZero() {
+		return ErrUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build js || plan9
+// +build js plan9
+
+package atomicfile_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestFallbackUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	for _, opt := range []atomicfile.Option{
+		atomicfile.SyncParentDirs(),
+		atomicfile.IOUring(),
+		atomicfile.Immutable(),
+	} {
+		if err := atomicfile.Create(name, opt); !errors.Is(err, atomicfile.ErrUnsupported) {
+			t.Fatalf("expected an error wrapping ErrUnsupported, got %v", err)
+		}
+	}
+	checkDirEntries(t, dir)
+}
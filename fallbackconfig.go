@@ -0,0 +1,159 @@
+//go:build !linux && !freebsd && !netbsd && !openbsd && !solaris
+// +build !linux,!freebsd,!netbsd,!openbsd,!solaris
+
+package atomicfile
+
+import (
+	"context"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// On the platforms that are not explicitly supported the options are
+// validated like on the other platforms, but only js/wasm and plan9 can
+// create files (see fallback.go): on the others (e.g. darwin and windows) the
+// functions that write to the filesystem fail with ErrUnsupported.
+
+type config struct {
+	contents   io.Reader
+	durability DurabilityLevel
+	// syncParents is never set, as SyncParentDirs is not supported.
+	syncParents bool
+	noReplace   bool
+	replace     bool
+	result      *Result
+	xattrs      []xattr
+	perm        uint32
+	permMasked  bool
+	executable  bool
+	dirGroup    bool
+	uid         int
+	gid         int
+	mtime       time.Time
+	atime       time.Time
+	hashes      []hash.Hash
+	maxSize     int64
+	transforms  []func(io.Writer) (io.WriteCloser, error)
+	compressed  bool
+	// checksumXattrs is never set, as ChecksumXattr is not supported.
+	checksumXattrs []checksum
+	sizeHint       int64
+	expectSize     int64
+	copyBuffer     int
+	ctx            context.Context
+	afterCommit    []func(Result) error
+	backupSuffix   string
+	backupRotate   int
+}
+
+func defaultConfig() config {
+	return config{
+		perm:       ^uint32(0),
+		uid:        -1,
+		gid:        -1,
+		maxSize:    -1,
+		sizeHint:   -1,
+		expectSize: -1,
+	}
+}
+
+func newConfig(options []Option) (config, error) {
+	cfg := defaultConfig()
+	for _, o := range options {
+		if err := o.apply(&cfg); err != nil {
+			return cfg, &werror{"options", err}
+		}
+	}
+	if cfg.replace && cfg.noReplace {
+		return cfg, &werror{"options", &werror{"conflicting Replace and NoReplace", nil}}
+	}
+	if (cfg.backupSuffix != "" || cfg.backupRotate > 0) && !cfg.replace {
+		return cfg, &werror{"options", &werror{"Backup requires Replace", nil}}
+	}
+	if len(cfg.xattrs) > 0 {
+		return cfg, &werror{"options", &werror{"Xattr", ErrUnsupported}}
+	}
+	return cfg, nil
+}
+
+// NoReplace makes Create fail if the target file already exists. This is
+// the default behavior of Create, unless Replace is specified.
+func NoReplace() Option {
+	return optionFunc(func(c *config) error {
+		c.noReplace = true
+		return nil
+	})
+}
+
+// ModificationTime specifies the modification time of the target file.
+func ModificationTime(t time.Time) Option {
+	return optionFunc(func(c *config) error {
+		if !c.mtime.IsZero() {
+			return &werror{"multiple modification times", nil}
+		}
+		c.mtime = t
+		return nil
+	})
+}
+
+// AccessTime specifies the access time of the target file.
+func AccessTime(t time.Time) Option {
+	return optionFunc(func(c *config) error {
+		if !c.atime.IsZero() {
+			return &werror{"multiple access times", nil}
+		}
+		c.atime = t
+		return nil
+	})
+}
+
+// SyncParentDirs is not supported on this platform: it always fails with
+// ErrUnsupported.
+func SyncParentDirs() Option {
+	return unsupported("SyncParentDirs")
+}
+
+// InodeFlags is not supported on this platform: it always fails with
+// ErrUnsupported.
+func InodeFlags(set, clear uint32) Option {
+	return unsupported("InodeFlags")
+}
+
+// Immutable is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Immutable() Option {
+	return unsupported("Immutable")
+}
+
+// unixMode converts the permission and special bits of mode to the
+// corresponding Unix mode bits.
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	return m
+}
+
+// fileMode is the inverse of unixMode.
+func fileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m).Perm()
+	if m&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
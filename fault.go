@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+// InjectFault specifies a function to be invoked by Create after each stage
+// that completed successfully, to inject a fault after it. It is meant to be
+// used in tests, to verify that the target file is either absent or fully
+// formed regardless of the stage at which Create fails or is interrupted
+// (see CheckAtomic). The stages are the ones reported to Observe.
+func InjectFault(fn func(stage Stage) Fault) Option {
+	return optionFunc(func(c *config) error {
+		if c.fault != nil {
+			return &werror{"multiple fault injectors", nil}
+		}
+		c.fault = fn
+		return nil
+	})
+}
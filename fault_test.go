@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestInjectFault(t *testing.T) {
+	// record the stages performed to replace a file
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	opts := func(fn func(atomicfile.Stage) atomicfile.Fault) []atomicfile.Option {
+		return []atomicfile.Option{
+			atomicfile.Contents(bytes.NewReader([]byte("new"))),
+			atomicfile.Replace(),
+			atomicfile.Fsync(),
+			atomicfile.Xattr("user.test", []byte("value")),
+			atomicfile.InjectFault(fn),
+		}
+	}
+	writeFile(t, name, "old")
+	var stages []atomicfile.Stage
+	err := atomicfile.Create(name, opts(func(s atomicfile.Stage) atomicfile.Fault {
+		stages = append(stages, s)
+		return atomicfile.NoFault
+	})...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// failing any stage before the replacement leaves the target file
+	// untouched, and no temporary file behind
+	for _, stage := range stages {
+		writeFile(t, name, "old")
+		err := atomicfile.Create(name, opts(func(s atomicfile.Stage) atomicfile.Fault {
+			if s == stage {
+				return atomicfile.FailStage
+			}
+			return atomicfile.NoFault
+		})...)
+		if !errors.Is(err, atomicfile.ErrInjectedFault) {
+			t.Fatalf("%v: expected an error wrapping ErrInjectedFault, got %v", stage, err)
+		}
+		if err := atomicfile.CheckAtomic(name, []byte("old"), []byte("new")); err != nil {
+			t.Fatalf("%v: %v", stage, err)
+		}
+		checkDirEntries(t, dir, "file")
+		published := errors.Is(err, atomicfile.ErrPublished)
+		if stage == atomicfile.StageReplace || stage == atomicfile.StageDirSync {
+			if !published {
+				t.Fatalf("%v: expected an error wrapping ErrPublished, got %v", stage, err)
+			}
+			checkFile(t, name, "new")
+		} else {
+			if published {
+				t.Fatalf("%v: unexpected error wrapping ErrPublished: %v", stage, err)
+			}
+			checkFile(t, name, "old")
+		}
+	}
+}
+
+func TestCheckAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	if err := atomicfile.CheckAtomic(name, []byte("a")); err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	writeFile(t, name, "a")
+	if err := atomicfile.CheckAtomic(name, []byte("b"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, name, "partial")
+	if err := atomicfile.CheckAtomic(name, []byte("a")); !errors.Is(err, atomicfile.ErrNotAtomic) {
+		t.Fatalf("expected an error wrapping ErrNotAtomic, got %v", err)
+	}
+}
+
+func TestInjectFaultPrealloc(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	// the preallocation of the guessed content size is best-effort, but
+	// the faults injected after it are not ignored
+	for _, fault := range []atomicfile.Fault{atomicfile.FailStage, atomicfile.Crash} {
+		err := atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+			atomicfile.InjectFault(func(s atomicfile.Stage) atomicfile.Fault {
+				if s == atomicfile.StagePrealloc {
+					return fault
+				}
+				return atomicfile.NoFault
+			}),
+		)
+		if !errors.Is(err, atomicfile.ErrInjectedFault) && !errors.Is(err, atomicfile.ErrSimulatedCrash) {
+			t.Fatalf("expected an injected fault, got %v", err)
+		}
+		checkDirEntries(t, dir)
+	}
+}
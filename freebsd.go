@@ -0,0 +1,18 @@
+//go:build freebsd
+// +build freebsd
+
+package atomicfile
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// File flags that can be used with InodeFlags on FreeBSD only.
+const (
+	InodeUserNoUnlink uint32 = 0x00000010 // UF_NOUNLINK: can not be removed or renamed
+	InodeNoUnlink     uint32 = 0x00100000 // SF_NOUNLINK: can not be removed or renamed
+)
+
+const noUnlinkFlags = InodeUserNoUnlink | InodeNoUnlink
+
+const utimeOmit = unix.UTIME_OMIT
@@ -0,0 +1,177 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestHash(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	h1, h2 := sha256.New(), sha512.New()
+	var r atomicfile.Result
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.Hash(h1),
+		atomicfile.Hash(h2),
+		atomicfile.Report(&r),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Written != 5 {
+		t.Fatalf("Written is %d, expected 5", r.Written)
+	}
+	sum1, sum2 := sha256.Sum256([]byte("hello")), sha512.Sum512([]byte("hello"))
+	if len(r.Sums) != 2 || !bytes.Equal(r.Sums[0], sum1[:]) || !bytes.Equal(r.Sums[1], sum2[:]) {
+		t.Fatalf("Sums is %x, expected [%x %x]", r.Sums, sum1, sum2)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	sum := sha256.Sum256([]byte("hello"))
+
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hellO"))),
+		atomicfile.VerifyChecksum(crypto.SHA256, sum[:]),
+	)
+	if !errors.Is(err, atomicfile.ErrChecksumMismatch) {
+		t.Fatalf("expected an error wrapping ErrChecksumMismatch, got %v", err)
+	}
+	checkDirEntries(t, dir)
+
+	// the digest is verified also when the contents are read from a file
+	src := openAt(t, t.TempDir(), []byte("hello"), 0)
+	err = atomicfile.Create(name,
+		atomicfile.Contents(src),
+		atomicfile.VerifyChecksum(crypto.SHA256, sum[:]),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file")
+}
+
+func TestChecksumXattr(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.ChecksumXattr(crypto.SHA256),
+		atomicfile.ChecksumXattr(crypto.SHA512),
+	)
+	if err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	checkXattr(t, name, "user.atomicfile.sha256", string(sum[:]))
+
+	buf, err := atomicfile.ReadFileVerified(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("ReadFileVerified returned %q, expected %q", buf, "hello")
+	}
+
+	// corrupt the file in place
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	_, err = atomicfile.ReadFileVerified(name)
+	var cerr *atomicfile.CorruptionError
+	if !errors.As(err, &cerr) || !errors.Is(err, atomicfile.ErrChecksumMismatch) {
+		t.Fatalf("expected a *CorruptionError, got %v", err)
+	}
+	if cerr.Path != name || !bytes.Equal(cerr.Expected, sum[:]) && cerr.Algorithm == crypto.SHA256 {
+		t.Fatalf("unexpected error %#v", cerr)
+	}
+
+	// files without checksums can not be verified
+	plain := filepath.Join(dir, "plain")
+	writeFile(t, plain, "hello")
+	if _, err := atomicfile.ReadFileVerified(plain); err == nil {
+		t.Fatal("file without checksums verified")
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	dir := t.TempDir()
+
+	err := atomicfile.Create(filepath.Join(dir, "file"),
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.MaxSize(5),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "file"), "hello")
+
+	// the limit applies to all the mechanisms used to populate the file
+	for _, open := range []func() io.Reader{
+		func() io.Reader { return bytes.NewReader([]byte("hello!")) },
+		func() io.Reader { return struct{ io.Reader }{bytes.NewReader([]byte("hello!"))} },
+		func() io.Reader { return openAt(t, t.TempDir(), []byte("hello!"), 0) },
+	} {
+		err := atomicfile.Create(filepath.Join(dir, "large"),
+			atomicfile.Contents(open()),
+			atomicfile.MaxSize(5),
+		)
+		if !errors.Is(err, atomicfile.ErrTooLarge) {
+			t.Fatalf("expected an error wrapping ErrTooLarge, got %v", err)
+		}
+	}
+	checkDirEntries(t, dir, "file")
+}
+
+func TestExpectSize(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	for _, contents := range []string{"hell", "hello!"} {
+		for _, open := range []func() io.Reader{
+			func() io.Reader { return struct{ io.Reader }{bytes.NewReader([]byte(contents))} },
+			func() io.Reader { return openAt(t, t.TempDir(), []byte(contents), 0) },
+		} {
+			err := atomicfile.Create(name,
+				atomicfile.Contents(open()),
+				atomicfile.ExpectSize(5),
+			)
+			if !errors.Is(err, atomicfile.ErrSizeMismatch) {
+				t.Fatalf("%q: expected an error wrapping ErrSizeMismatch, got %v", contents, err)
+			}
+		}
+	}
+	checkDirEntries(t, dir)
+
+	err := atomicfile.Create(name,
+		atomicfile.Contents(struct{ io.Reader }{bytes.NewReader([]byte("hello"))}),
+		atomicfile.ExpectSize(5),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+}
@@ -0,0 +1,165 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestKeepOpen(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	var r atomicfile.Result
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.KeepOpen(),
+		atomicfile.Report(&r),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.File == nil {
+		t.Fatal("File is nil")
+	}
+	defer r.File.Close()
+
+	// the returned file is the target file, even after it is unlinked
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfi, err := r.File.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi, rfi) {
+		t.Fatal("File is not the target file")
+	}
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.File.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := r.File.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "Jello" {
+		t.Fatalf("read %q, expected %q", buf, "Jello")
+	}
+
+	if err := atomicfile.Create(name, atomicfile.KeepOpen()); err == nil {
+		t.Fatal("KeepOpen without Report accepted")
+	}
+	checkDirEntries(t, dir)
+}
+
+func TestAfterCommit(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	var calls []int
+	hook := func(i int, err error) func(atomicfile.Result) error {
+		return func(r atomicfile.Result) error {
+			calls = append(calls, i)
+			if r.Written != 5 {
+				t.Errorf("Written is %d, expected 5", r.Written)
+			}
+			checkFile(t, name, "hello")
+			return err
+		}
+	}
+	errHook := errors.New("hook failed")
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.AfterCommit(hook(1, nil)),
+		atomicfile.AfterCommit(hook(2, errHook)),
+		atomicfile.AfterCommit(hook(3, nil)),
+	)
+	if !errors.Is(err, errHook) {
+		t.Fatalf("expected an error wrapping the hook error, got %v", err)
+	}
+	if len(calls) != 2 || calls[0] != 1 || calls[1] != 2 {
+		t.Fatalf("hooks called in order %v, expected [1 2]", calls)
+	}
+	// the file is not removed when a hook fails
+	checkFile(t, name, "hello")
+
+	// the hooks are not invoked if the file is left untouched
+	calls = nil
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.Replace(),
+		atomicfile.OnlyIfChanged(),
+		atomicfile.AfterCommit(hook(1, nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("hooks called for an unchanged file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	errInvalid := errors.New("invalid contents")
+	var calls int
+	validate := func(f *os.File) error {
+		calls++
+		buf, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if string(buf) != "hello" {
+			return errInvalid
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Mode().Perm() != 0o600 {
+			return errors.New("permissions not set")
+		}
+		return nil
+	}
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.Permissions(0o600),
+		atomicfile.Validate(validate),
+		atomicfile.Validate(validate),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("validated %d times, expected 2", calls)
+	}
+	checkFile(t, name, "hello")
+
+	calls = 0
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("bye"))),
+		atomicfile.Permissions(0o600),
+		atomicfile.Replace(),
+		atomicfile.Validate(validate),
+		atomicfile.Validate(validate),
+	)
+	if !errors.Is(err, errInvalid) || calls != 1 {
+		t.Fatalf("expected a validation failure after 1 call, got %v after %d", err, calls)
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file")
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Inode flags that can be used with InodeFlags (see chattr(1)), as defined in
+// linux/fs.h. Not all filesystems support all flags.
+const (
+	InodeSync      uint32 = 0x00000008 // FS_SYNC_FL: synchronous updates
+	InodeImmutable uint32 = 0x00000010 // FS_IMMUTABLE_FL: immutable file
+	InodeAppend    uint32 = 0x00000020 // FS_APPEND_FL: writes can only append
+	InodeNoDump    uint32 = 0x00000040 // FS_NODUMP_FL: do not dump file
+	InodeNoAtime   uint32 = 0x00000080 // FS_NOATIME_FL: do not update atime
+	InodeNoCOW     uint32 = 0x00800000 // FS_NOCOW_FL: do not copy-on-write
+)
+
+// lateInodeFlags are the inode flags that prevent the target file from being
+// populated or linked, and that are therefore set after it has been linked.
+const lateInodeFlags = InodeImmutable | InodeAppend
+
+// InodeFlags sets the inode flags in set, and clears the ones in clear, on
+// the target file (see chattr(1)), e.g. InodeNoCOW to disable copy-on-write
+// on btrfs for database files. InodeFlags can be specified multiple times.
+// The flags are set before any data is written to the target file, as some
+// flags (e.g. InodeNoCOW) are only effective on empty files; InodeImmutable
+// and InodeAppend are instead set after the target file has been linked,
+// like with Immutable.
+// Not all filesystems support all flags, and some flags (e.g. InodeImmutable
+// and InodeAppend) require the CAP_LINUX_IMMUTABLE capability.
+func InodeFlags(set, clear uint32) Option {
+	return optionFunc(func(c *config) error {
+		if set&clear != 0 || (c.inodeSet|set)&(c.inodeClear|clear) != 0 {
+			return &werror{"conflicting inode flags", nil}
+		}
+		c.inodeSet |= set
+		c.inodeClear |= clear
+		return nil
+	})
+}
+
+// Immutable makes Create set the immutable inode flag (FS_IMMUTABLE_FL, see
+// chattr(1)) on the target file, so that it can not be modified, renamed or
+// deleted until the flag is explicitly cleared.
+// As an immutable file can not be modified, the flag is set as the final
+// step, after the target file has been linked: if setting the flag fails,
+// Create returns an error, but the target file is not removed.
+// Setting the immutable flag requires the CAP_LINUX_IMMUTABLE capability, and
+// not all filesystems support it. Note that the Replace, ReplaceIf, Backup
+// and BackupRotate options fail if the target file being replaced is
+// immutable.
+func Immutable() Option {
+	return InodeFlags(InodeImmutable, 0)
+}
+
+// setInodeFlags sets the flags in set, and clears the ones in clear, on the
+// inode of fd.
+func setInodeFlags(fd int, set, clear uint32) error {
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	if newFlags := (flags | set) &^ clear; newFlags != flags {
+		return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(newFlags))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	var r atomicfile.Result
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.Lock(),
+		atomicfile.Report(&r),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.File == nil {
+		t.Fatal("File is nil")
+	}
+	checkFile(t, name, "hello")
+
+	// readers acquiring a shared lock are blocked until the file is closed
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Fatalf("expected EWOULDBLOCK, got %v", err)
+	}
+	r.File.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := atomicfile.Create(filepath.Join(dir, "other"), atomicfile.Lock()); err == nil {
+		t.Fatal("Lock without Report accepted")
+	}
+	checkDirEntries(t, dir, "file")
+}
+
+func TestWithLockfile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	lockfile := filepath.Join(dir, "lock")
+
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.WithLockfile(lockfile, time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file", "lock")
+
+	// a concurrent writer holding the lock blocks Create
+	l, err := os.Open(lockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := syscall.Flock(int(l.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("new"))),
+		atomicfile.Replace(),
+		atomicfile.WithLockfile(lockfile, 10*time.Millisecond),
+	)
+	if !errors.Is(err, atomicfile.ErrLockTimeout) {
+		t.Fatalf("expected an error wrapping ErrLockTimeout, got %v", err)
+	}
+	checkFile(t, name, "hello")
+
+	done := make(chan error)
+	go func() {
+		done <- atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader([]byte("new"))),
+			atomicfile.Replace(),
+			atomicfile.WithLockfile(lockfile, -1),
+		)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	checkFile(t, name, "hello")
+	l.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "new")
+	checkDirEntries(t, dir, "file", "lock")
+}
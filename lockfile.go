@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithLockfile serializes concurrent calls to Create for the same target file
+// by acquiring an exclusive flock(2) lock on the lock file at path (that is
+// created if it does not exist) for the whole duration of Create, including
+// the checks performed by ReplaceIf and OnlyIfChanged and the creation of
+// backups. All writers of the target file must use the same lock file.
+// If the lock can not be acquired within timeout, ErrLockTimeout is returned;
+// a negative timeout waits indefinitely.
+// The lock file is not removed, as removing it would allow concurrent writers
+// to lock different files.
+func WithLockfile(path string, timeout time.Duration) Option {
+	return optionFunc(func(c *config) error {
+		if c.lockfile != defaultConfig().lockfile {
+			return &werror{"multiple lock files", nil}
+		}
+		if path == "" {
+			return &werror{"invalid lock file", nil}
+		}
+		c.lockfile = path
+		c.lockTimeout = timeout
+		return nil
+	})
+}
+
+// acquireLockfile opens and locks the lock file at path, waiting at most
+// timeout (or indefinitely, if timeout is negative). The lock is released
+// by closing the returned file.
+func acquireLockfile(path string, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout < 0 {
+		err = flock(f, unix.LOCK_EX)
+	} else {
+		deadline := time.Now().Add(timeout)
+		for wait := time.Millisecond; ; wait *= 2 {
+			err = flock(f, unix.LOCK_EX|unix.LOCK_NB)
+			if err != unix.EWOULDBLOCK {
+				break
+			}
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				err = ErrLockTimeout
+				break
+			}
+			if wait > 100*time.Millisecond {
+				wait = 100 * time.Millisecond
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+			time.Sleep(wait)
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func flock(f *os.File, how int) error {
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,171 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// XattrsFrom copies the extended attributes of the file at path (following
+// symbolic links) to the target file. If prefixes are specified, only the
+// extended attributes whose names start with one of them are copied (e.g.
+// "user." or "security.").
+// The extended attributes are read when the options are processed, and are
+// not copied if they are also specified with Xattr (or SELinuxContext).
+func XattrsFrom(path string, prefixes ...string) Option {
+	return optionFunc(func(c *config) error {
+		f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NONBLOCK, 0)
+		if err != nil {
+			return &werror{"opening reference file", err}
+		}
+		defer f.Close()
+
+		xattrs, err := listXattrs(int(f.Fd()))
+		if err != nil {
+			return &werror{"reading reference file xattrs", err}
+		}
+		for _, xattr := range xattrs {
+			if hasPrefix(xattr.name, prefixes) && !hasXattr(c.xattrs, xattr.name) {
+				c.xattrs = append(c.xattrs, xattr)
+			}
+		}
+		return nil
+	})
+}
+
+// MetadataFrom copies the metadata of the file at path (following symbolic
+// links) to the target file, like chmod/chown --reference: the permissions,
+// ownership, access and modification times, and extended attributes
+// (including POSIX ACLs, that are stored as extended attributes) of the
+// reference file are used, unless the corresponding options are specified.
+// Like for Copy, ownership is copied only if the process is allowed to do so.
+// The checksums stored by ChecksumXattr are not copied.
+// The reference file is read when the target file is created.
+func MetadataFrom(path string) Option {
+	return optionFunc(func(c *config) error {
+		if c.metadataFrom != defaultConfig().metadataFrom {
+			return &werror{"multiple metadata references", nil}
+		}
+		if path == "" {
+			return &werror{"invalid metadata reference", nil}
+		}
+		c.metadataFrom = path
+		return nil
+	})
+}
+
+// PreserveMetadata makes Create, when replacing an existing target file (see
+// Replace), preserve the permissions, ownership and extended attributes of
+// the existing target file, unless the corresponding options are specified.
+// Like for Copy, ownership is preserved only if the process is allowed to do
+// so. The checksums stored by ChecksumXattr are not preserved, as they do not
+// match the new contents.
+// If the target file does not exist, or is a symbolic link, nothing is
+// preserved.
+func PreserveMetadata() Option {
+	return optionFunc(func(c *config) error {
+		c.preserve |= inheritMetadata
+		return nil
+	})
+}
+
+// PreserveTimes makes Create, when replacing an existing target file (see
+// Replace), preserve the access and modification times of the existing
+// target file, unless they are specified with AccessTime and
+// ModificationTime. If the target file does not exist, or is a symbolic link,
+// nothing is preserved.
+func PreserveTimes() Option {
+	return optionFunc(func(c *config) error {
+		c.preserve |= inheritTimes
+		return nil
+	})
+}
+
+// The metadata that can be inherited from another file.
+const (
+	// inheritMetadata inherits permissions, ownership and extended
+	// attributes, except for the checksums stored by ChecksumXattr.
+	inheritMetadata = 1 << iota
+	// inheritTimes inherits access and modification times.
+	inheritTimes
+	// inheritChecksums inherits the checksums stored by ChecksumXattr.
+	inheritChecksums
+)
+
+// inheritFrom is like inherit, but reads the metadata of the file name,
+// resolved relative to dirfd. Symbolic links are followed only if follow is
+// true.
+func (c *config) inheritFrom(dirfd int, name string, follow bool, what int) error {
+	flag := os.O_RDONLY | unix.O_NONBLOCK
+	if !follow {
+		flag |= unix.O_NOFOLLOW
+	}
+	f, err := openAt(dirfd, name, flag, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.inherit(int(f.Fd()), what)
+}
+
+// inherit sets the metadata of c specified by what to the one of the file
+// fd, unless it has been specified with the corresponding options.
+func (c *config) inherit(fd int, what int) error {
+	var st unix.Stat_t
+	err := unix.Fstat(fd, &st)
+	if err != nil {
+		return err
+	}
+
+	if what&inheritTimes != 0 {
+		if c.mtime == defaultConfig().mtime {
+			c.mtime = st.Mtim
+		}
+		if c.atime == defaultConfig().atime {
+			c.atime = st.Atim
+		}
+	}
+	if what&inheritMetadata == 0 {
+		return nil
+	}
+
+	if c.perm == defaultConfig().perm {
+		c.perm = st.Mode & uint32(os.ModePerm)
+	}
+	if c.uid == defaultConfig().uid && c.gid == defaultConfig().gid {
+		c.uid, c.gid = int(st.Uid), int(st.Gid)
+		c.ownershipBestEffort = true
+	}
+
+	xattrs, err := listXattrs(fd)
+	if err != nil {
+		return err
+	}
+	for _, xattr := range xattrs {
+		if what&inheritChecksums == 0 && strings.HasPrefix(xattr.name, checksumXattrPrefix) {
+			continue
+		}
+		if !hasXattr(c.xattrs, xattr.name) {
+			c.xattrs = append(c.xattrs, xattr)
+		}
+	}
+	return nil
+}
+
+// hasPrefix reports whether s starts with any of prefixes, or whether
+// prefixes is empty.
+func hasPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
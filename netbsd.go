@@ -0,0 +1,10 @@
+//go:build netbsd
+// +build netbsd
+
+package atomicfile
+
+// NetBSD does not support the no-unlink file flags.
+const noUnlinkFlags = 0
+
+// UTIME_OMIT, as defined in sys/stat.h (missing from x/sys/unix).
+const utimeOmit = 1<<30 - 2
@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"time"
+)
+
+// Observe specifies a function to be invoked by Create after each of the
+// stages it performs, with the time spent in the stage and the error it
+// returned, if any. Stages that are not needed (e.g. StageChown if the
+// ownership is not specified) are not reported. A stage that fails may be
+// reported with an error that Create handles without failing (e.g. when
+// preallocation is not supported by the filesystem).
+// When Replace is specified, the publication of the target file is reported
+// as StageReplace instead of StageLink, even if the target file did not
+// exist: functions that expect StageLink for every file created must handle
+// StageReplace as well.
+// Observe can be specified multiple times: the functions are invoked in the
+// order in which they are specified. The functions are invoked synchronously,
+// so they should return quickly.
+func Observe(fn func(stage Stage, d time.Duration, err error)) Option {
+	return optionFunc(func(c *config) error {
+		c.observers = append(c.observers, fn)
+		return nil
+	})
+}
+
+// observe reports to the functions specified with Observe that stage s,
+// started at start, completed with err. It returns err or, if the stage
+// completed successfully, the fault injected by the function specified with
+// InjectFault, if any.
+func (c *config) observe(s Stage, start time.Time, err error) error {
+	if err == nil && c.fault != nil {
+		err = c.fault(s).err()
+	}
+	if len(c.observers) == 0 {
+		return err
+	}
+	d := time.Since(start)
+	for _, fn := range c.observers {
+		fn(s, d, err)
+	}
+	return err
+}
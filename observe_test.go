@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestObserve(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	for _, replace := range []bool{false, true} {
+		var stages []atomicfile.Stage
+		opts := []atomicfile.Option{
+			atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+			atomicfile.Durability(atomicfile.DurabilityFull),
+			atomicfile.Observe(func(s atomicfile.Stage, _ time.Duration, err error) {
+				if err != nil {
+					t.Errorf("stage %v failed: %v", s, err)
+				}
+				stages = append(stages, s)
+			}),
+		}
+		publish := atomicfile.StageLink
+		if replace {
+			opts = append(opts, atomicfile.Replace())
+			publish = atomicfile.StageReplace
+		}
+		if err := atomicfile.Create(name, opts...); err != nil {
+			t.Fatal(err)
+		}
+		// the stages before the copy depend on the strategy
+		var tail []atomicfile.Stage
+		for i, s := range stages {
+			if s == atomicfile.StageCopy {
+				tail = stages[i:]
+			}
+		}
+		expected := []atomicfile.Stage{atomicfile.StageCopy, atomicfile.StageFsync, publish, atomicfile.StageDirSync}
+		if len(tail) != len(expected) {
+			t.Fatalf("stages are %v, expected them to end with %v", stages, expected)
+		}
+		for i := range tail {
+			if tail[i] != expected[i] {
+				t.Fatalf("stages are %v, expected them to end with %v", stages, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build openbsd
+// +build openbsd
+
+package atomicfile
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// OpenBSD does not support the no-unlink file flags.
+const noUnlinkFlags = 0
+
+const utimeOmit = unix.UTIME_OMIT
+
+// setExtattr fails, as OpenBSD does not support extended attributes.
+func setExtattr(fd int, name string, value []byte) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,510 @@
+package atomicfile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"os/user"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Option is the interface for options passed to Create.
+type Option interface {
+	apply(*config) error
+}
+
+type optionFunc func(*config) error
+
+func (o optionFunc) apply(cfg *config) error {
+	return o(cfg)
+}
+
+// Contents specifies the contents to be written to the target file.
+func Contents(r io.Reader) Option {
+	return optionFunc(func(c *config) error {
+		if c.contents != defaultConfig().contents {
+			return &werror{"multiple contents", nil}
+		}
+		c.contents = r
+		return nil
+	})
+}
+
+// ContentsJSON specifies the contents to be written to the target file,
+// as the JSON encoding of v returned by json.Marshal.
+func ContentsJSON(v interface{}) Option {
+	return optionFunc(func(c *config) error {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return &werror{"marshaling JSON", err}
+		}
+		return Contents(bytes.NewReader(buf)).apply(c)
+	})
+}
+
+// ContentsText specifies the contents to be written to the target file,
+// as returned by the MarshalText method of v.
+func ContentsText(v encoding.TextMarshaler) Option {
+	return optionFunc(func(c *config) error {
+		buf, err := v.MarshalText()
+		if err != nil {
+			return &werror{"marshaling text", err}
+		}
+		return Contents(bytes.NewReader(buf)).apply(c)
+	})
+}
+
+// ContentsBinary specifies the contents to be written to the target file,
+// as returned by the MarshalBinary method of v.
+func ContentsBinary(v encoding.BinaryMarshaler) Option {
+	return optionFunc(func(c *config) error {
+		buf, err := v.MarshalBinary()
+		if err != nil {
+			return &werror{"marshaling binary", err}
+		}
+		return Contents(bytes.NewReader(buf)).apply(c)
+	})
+}
+
+// Fsync enables the invocation of fsync() on the target file and
+// its containing directory.
+// Fsync is equivalent to Durability(DurabilityFull).
+func Fsync() Option {
+	return Durability(DurabilityFull)
+}
+
+// DurabilityLevel specifies the durability guarantees requested for the
+// target file. Higher levels provide stronger guarantees, at the cost of
+// higher latency.
+type DurabilityLevel int
+
+const (
+	// DurabilityNone does not provide any durability guarantee: the target
+	// file may be lost in case of a system crash.
+	DurabilityNone DurabilityLevel = iota
+	// DurabilityData invokes fdatasync() on the target file before it is
+	// linked, so that its contents are durable. The directory entry of the
+	// target file may still be lost in case of a system crash.
+	DurabilityData
+	// DurabilityFull invokes fsync() on the target file before it is linked,
+	// and on its containing directory after it has been linked, so that the
+	// target file is durable.
+	DurabilityFull
+	// DurabilityParanoid is like DurabilityFull, but additionally invokes
+	// fsync() on all parent directories of the target file, up to the mount
+	// point of the filesystem containing it.
+	DurabilityParanoid
+)
+
+// Durability specifies the durability guarantees requested for the target file.
+func Durability(level DurabilityLevel) Option {
+	return optionFunc(func(c *config) error {
+		if c.durability != defaultConfig().durability && c.durability != level {
+			return &werror{"multiple durability levels", nil}
+		}
+		if level < DurabilityNone || level > DurabilityParanoid {
+			return &werror{"invalid durability level", nil}
+		}
+		c.durability = level
+		return nil
+	})
+}
+
+// Xattr specifies an extended attribute to be added to the target file.
+// Multiple externded attributes can be added to the same file; if the same
+// attribute is specified multiple times, the last value is used.
+// Not all filesystems and kernel versions support extended attributes.
+func Xattr(name string, value []byte) Option {
+	return optionFunc(func(c *config) error {
+		c.xattrs = append(c.xattrs, xattr{name, value})
+		return nil
+	})
+}
+
+// Permissions specifies the Unix permissions to be set on the target file,
+// including the setuid, setgid and sticky bits (os.ModeSetuid, os.ModeSetgid
+// and os.ModeSticky).
+// The permissions are set exactly as specified, regardless of the umask of
+// the process (see PermissionsMasked).
+// If no permissions are specified, the target file is created with
+// permissions 0666 masked by the umask of the process.
+func Permissions(mode os.FileMode) Option {
+	return optionFunc(func(c *config) error {
+		if c.perm != defaultConfig().perm {
+			return &werror{"multiple permissions", nil}
+		}
+		c.perm = unixMode(mode)
+		return nil
+	})
+}
+
+// Executable makes the target file executable by the users that can read it,
+// i.e. the execute permission bit is set for each of user, group and others
+// that have the read permission bit set in the permissions specified with
+// Permissions (or in the default ones, if no permissions are specified).
+func Executable() Option {
+	return optionFunc(func(c *config) error {
+		c.executable = true
+		return nil
+	})
+}
+
+// PermissionsExact is equivalent to Permissions: the permissions are set
+// exactly as specified, regardless of the umask of the process.
+func PermissionsExact(mode os.FileMode) Option {
+	return Permissions(mode)
+}
+
+// PermissionsMasked is like Permissions, but the permissions are masked by
+// the umask of the process when the target file is created, like for
+// open(2).
+func PermissionsMasked(mode os.FileMode) Option {
+	return optionFunc(func(c *config) error {
+		if err := Permissions(mode).apply(c); err != nil {
+			return err
+		}
+		c.permMasked = true
+		return nil
+	})
+}
+
+// Ownership specifies the target file owner UID and GID. Either can be -1,
+// in which case it is left unchanged (as for Uid and Gid).
+func Ownership(uid, gid int) Option {
+	return optionFunc(func(c *config) error {
+		if uid < -1 || gid < -1 {
+			return &werror{"invalid ownership", nil}
+		}
+		if uid != -1 {
+			if err := Uid(uid).apply(c); err != nil {
+				return err
+			}
+		}
+		if gid != -1 {
+			if err := Gid(gid).apply(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Uid specifies the target file owner UID, leaving the GID unchanged unless
+// it is specified with Gid (or Group).
+func Uid(uid int) Option {
+	return optionFunc(func(c *config) error {
+		if c.uid != defaultConfig().uid {
+			return &werror{"multiple owners", nil}
+		}
+		if uid < 0 {
+			return &werror{"invalid user ID", nil}
+		}
+		c.uid = uid
+		return nil
+	})
+}
+
+// Gid specifies the target file owner GID, leaving the UID unchanged unless
+// it is specified with Uid (or Owner).
+func Gid(gid int) Option {
+	return optionFunc(func(c *config) error {
+		if c.gid != defaultConfig().gid || c.dirGroup {
+			return &werror{"multiple groups", nil}
+		}
+		if gid < 0 {
+			return &werror{"invalid group ID", nil}
+		}
+		c.gid = gid
+		return nil
+	})
+}
+
+// InheritDirGroup makes the group of the target file match the group of the
+// directory containing it, if the directory has the setgid bit set, as the
+// kernel does when creating files in such directories. This ensures that
+// the group of the directory is used also when it would otherwise be
+// inherited from another file (e.g. by Copy, MetadataFrom or
+// PreserveMetadata). InheritDirGroup can not be combined with Gid or Group.
+func InheritDirGroup() Option {
+	return optionFunc(func(c *config) error {
+		if c.gid != defaultConfig().gid {
+			return &werror{"multiple groups", nil}
+		}
+		c.dirGroup = true
+		return nil
+	})
+}
+
+// Owner specifies the user owning the target file, by user name or numeric
+// UID. User names are resolved using os/user.
+func Owner(name string) Option {
+	return optionFunc(func(c *config) error {
+		uid, err := strconv.Atoi(name)
+		if err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return &werror{"looking up user", err}
+			}
+			uid, err = strconv.Atoi(u.Uid)
+			if err != nil {
+				return &werror{"invalid user ID", err}
+			}
+		}
+		return Uid(uid).apply(c)
+	})
+}
+
+// Group specifies the group owning the target file, by group name or numeric
+// GID. Group names are resolved using os/user.
+func Group(name string) Option {
+	return optionFunc(func(c *config) error {
+		gid, err := strconv.Atoi(name)
+		if err != nil {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return &werror{"looking up group", err}
+			}
+			gid, err = strconv.Atoi(g.Gid)
+			if err != nil {
+				return &werror{"invalid group ID", err}
+			}
+		}
+		return Gid(gid).apply(c)
+	})
+}
+
+// Report makes Create store information about the created file in r,
+// once the file has been successfully created.
+func Report(r *Result) Option {
+	return optionFunc(func(c *config) error {
+		if c.result != defaultConfig().result {
+			return &werror{"multiple results", nil}
+		}
+		c.result = r
+		return nil
+	})
+}
+
+// Replace makes Create atomically replace the target file if it already
+// exists: the new file is linked with a temporary name in the same directory
+// and then renamed over the target file, so that other processes observe
+// either the previous file or the new one.
+func Replace() Option {
+	return optionFunc(func(c *config) error {
+		c.replace = true
+		return nil
+	})
+}
+
+// MaxSize limits the size of the contents to n bytes: if the contents exceed
+// n bytes, the target file is not created and ErrTooLarge is returned.
+// At most n+1 bytes are read from the reader passed to Contents.
+func MaxSize(n int64) Option {
+	return optionFunc(func(c *config) error {
+		if c.maxSize != defaultConfig().maxSize {
+			return &werror{"multiple maximum sizes", nil}
+		}
+		if n < 0 {
+			return &werror{"invalid maximum size", nil}
+		}
+		c.maxSize = n
+		return nil
+	})
+}
+
+// Transform inserts a filter between the contents and the target file: fn is
+// called with the writer that receives the filtered data, and must return a
+// writer to which the contents are written. Close is called on the returned
+// writer once all the contents have been written, and must flush any buffered
+// data; it must not close the underlying writer.
+// Transform can be specified multiple times (and combined with Compress and
+// Encrypt) to build a chain of filters: the contents are passed through the
+// filters in the order in which they are specified.
+// The Hash, VerifyChecksum, MaxSize and ExpectSize options apply to the
+// contents before they are filtered, while ChecksumXattr and Result.Written
+// refer to the filtered data written to the target file. The preallocation
+// hints (ContentSize, or the size guessed from the contents) are also used
+// for the filtered data: any excess allocation is released once the contents
+// have been written.
+// As the contents need to be read in userspace, specifying Transform prevents
+// the use of zero-copy mechanisms to populate the target file.
+func Transform(fn func(w io.Writer) (io.WriteCloser, error)) Option {
+	return optionFunc(func(c *config) error {
+		if fn == nil {
+			return &werror{"invalid transform", nil}
+		}
+		c.transforms = append(c.transforms, fn)
+		return nil
+	})
+}
+
+// Hash computes a digest of the contents while they are written to the
+// target file, by writing them to h. Multiple hashes can be computed at the
+// same time by specifying Hash multiple times. The digests are reported in
+// Result.Sums (see Report).
+// As the contents need to be read in userspace, specifying Hash prevents
+// the use of zero-copy mechanisms to populate the target file.
+func Hash(h hash.Hash) Option {
+	return optionFunc(func(c *config) error {
+		c.hashes = append(c.hashes, h)
+		return nil
+	})
+}
+
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// ErrUnsupported is returned by the options that are not supported on the
+// current platform.
+var ErrUnsupported = errors.New("unsupported on this platform")
+
+// ErrPublished is matched (see errors.Is) by the errors returned when the
+// target file has been published before the failure, e.g. if the directory
+// containing it could not be synced, or an AfterCommit hook failed: the
+// target file exists with the new contents, but the operations that follow
+// its publication did not complete.
+var ErrPublished = errors.New("target file published")
+
+// publishedError wraps the errors that occur after the target file has been
+// published, so that they match ErrPublished.
+type publishedError struct {
+	err error
+}
+
+func (e *publishedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *publishedError) Unwrap() error {
+	return e.err
+}
+
+func (e *publishedError) Is(target error) bool {
+	return target == ErrPublished
+}
+
+type werror struct {
+	msg   string
+	cause error
+}
+
+func (e *werror) Error() string {
+	if e.cause == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.cause.Error()
+}
+
+func (e *werror) Unwrap() error {
+	return e.cause
+}
+
+// tempName returns a random name, suitable for a temporary file
+// in the same directory as a file called base.
+func tempName(base string) (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return "." + base + "." + hex.EncodeToString(b[:]) + ".tmp", nil
+}
+
+type checksum struct {
+	algo     crypto.Hash
+	h        hash.Hash
+	expected []byte
+}
+
+// checksumXattrPrefix is the prefix of the names of the extended attributes
+// used to store digests.
+const checksumXattrPrefix = "user.atomicfile."
+
+// checksumXattrName returns the name of the extended attribute used to
+// store the digest computed with the hash function algo, or an empty
+// string if algo is not supported.
+func checksumXattrName(algo crypto.Hash) string {
+	const prefix = checksumXattrPrefix
+	switch algo {
+	case crypto.MD5:
+		return prefix + "md5"
+	case crypto.SHA1:
+		return prefix + "sha1"
+	case crypto.SHA224:
+		return prefix + "sha224"
+	case crypto.SHA256:
+		return prefix + "sha256"
+	case crypto.SHA384:
+		return prefix + "sha384"
+	case crypto.SHA512:
+		return prefix + "sha512"
+	case crypto.SHA512_224:
+		return prefix + "sha512_224"
+	case crypto.SHA512_256:
+		return prefix + "sha512_256"
+	case crypto.SHA3_224:
+		return prefix + "sha3_224"
+	case crypto.SHA3_256:
+		return prefix + "sha3_256"
+	case crypto.SHA3_384:
+		return prefix + "sha3_384"
+	case crypto.SHA3_512:
+		return prefix + "sha3_512"
+	case crypto.BLAKE2s_256:
+		return prefix + "blake2s_256"
+	case crypto.BLAKE2b_256:
+		return prefix + "blake2b_256"
+	case crypto.BLAKE2b_384:
+		return prefix + "blake2b_384"
+	case crypto.BLAKE2b_512:
+		return prefix + "blake2b_512"
+	}
+	return ""
+}
+
+func numberedBackup(name string, num int) string {
+	return name + ".~" + strconv.Itoa(num) + "~"
+}
+
+// backupNumbers returns the numbers of the numbered backups of name (see
+// BackupRotate) found in names, in increasing order.
+func backupNumbers(name string, names []string) []int {
+	prefix := name + ".~"
+	var nums []int
+	for _, n := range names {
+		if !strings.HasPrefix(n, prefix) || !strings.HasSuffix(n, "~") {
+			continue
+		}
+		num, err := strconv.Atoi(n[len(prefix) : len(n)-1])
+		if err != nil || num < 1 || strconv.Itoa(num) != n[len(prefix):len(n)-1] {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+// checkHonored fails if cfg specifies any option that is not honored by the
+// function op (e.g. Rename): honored, if not nil, resets to their defaults
+// the fields of cfg set by the options that op honors.
+func checkHonored(op string, cfg config, honored func(c *config)) error {
+	if honored != nil {
+		honored(&cfg)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		return &werror{"options", &werror{"option not honored by " + op, nil}}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// ParallelCopy makes Create populate the target file using n goroutines,
+// each copying a different range of the contents with pread and pwrite, if
+// the reader passed to Contents implements io.ReaderAt and io.Seeker and the
+// size of the contents is known (i.e. if it is a regular file, or if it has
+// a Size method like bytes.Reader). This can substantially speed up copying
+// large files on fast storage.
+// As with the other mechanisms used to populate the target file, the
+// contents are copied from the current offset of the reader, and the reader
+// is left positioned at the end of the copied data. Cloning the contents
+// (when supported by the filesystem) is still preferred, and ParallelCopy is
+// ignored if any option requires observing the data as it is written (e.g.
+// Hash, VerifyChecksum, FlushEvery, RateLimit, Progress or Transform).
+func ParallelCopy(n int) Option {
+	return optionFunc(func(c *config) error {
+		if c.parallel != defaultConfig().parallel {
+			return &werror{"multiple parallel copies", nil}
+		}
+		if n < 1 {
+			return &werror{"invalid number of goroutines", nil}
+		}
+		c.parallel = n
+		return nil
+	})
+}
+
+// parallelChunk is the amount of data copied by each goroutine at a time
+// by parallelCopy.
+const parallelChunk = 8 << 20
+
+// parallelCopy attempts to populate the file by copying the remaining
+// contents of src with the specified number of goroutines. If src does not
+// support random access, or its size is not known, handled is false and no
+// data has been copied.
+func (p *populator) parallelCopy(src io.Reader, workers int) (handled bool, err error) {
+	ra, ok := src.(io.ReaderAt)
+	if !ok {
+		return false, nil
+	}
+	sk, ok := src.(io.Seeker)
+	if !ok {
+		return false, nil
+	}
+	var pos, size int64
+	switch src := src.(type) {
+	case *os.File:
+		pos, size = remaining(src)
+	case interface{ Size() int64 }:
+		size = src.Size()
+		if pos, err = sk.Seek(0, io.SeekCurrent); err != nil {
+			return false, nil
+		}
+	}
+	n := size - pos
+	if p.limit >= 0 && n > p.limit-p.written {
+		n = p.limit - p.written
+	}
+	if n <= 0 {
+		return false, nil
+	}
+
+	chunks := (n + parallelChunk - 1) / parallelChunk
+	if int64(workers) > chunks {
+		workers = int(chunks)
+	}
+	var next int64
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			buf := make([]byte, parallelChunk)
+			for {
+				c := atomic.AddInt64(&next, 1) - 1
+				if c >= chunks {
+					return
+				}
+				off := c * parallelChunk
+				b := buf
+				if rem := n - off; rem < int64(len(b)) {
+					b = b[:rem]
+				}
+				if err := p.copyRange(ra, b, pos+off, p.written+off); err != nil {
+					errs[w] = err
+					// stop the other goroutines
+					atomic.StoreInt64(&next, chunks)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return true, err
+		}
+	}
+
+	p.written += n
+	if _, err := sk.Seek(pos+n, io.SeekStart); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// copyRange copies len(buf) bytes from src at offset from to the file at
+// offset to, using buf as the intermediate buffer.
+func (p *populator) copyRange(src io.ReaderAt, buf []byte, from, to int64) error {
+	m, err := src.ReadAt(buf, from)
+	if m < len(buf) {
+		if err == nil || err == io.EOF {
+			// src has been truncated while copying it
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	for len(buf) > 0 {
+		m, err := unix.Pwrite(int(p.f.Fd()), buf, to)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		} else if m == 0 {
+			return io.ErrShortWrite
+		}
+		buf, to = buf[m:], to+int64(m)
+	}
+	return nil
+}
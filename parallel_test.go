@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestParallelCopy(t *testing.T) {
+	dir := t.TempDir()
+	contents := testContents(20<<20 + 12345)
+
+	for _, tc := range []struct {
+		name string
+		src  io.ReadSeeker
+	}{
+		{"reader", bytes.NewReader(contents)},
+		{"file", openAt(t, t.TempDir(), contents, 0)},
+	} {
+		// only the data after the current offset is copied
+		if _, err := tc.src.Seek(100, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(dir, tc.name)
+		err := atomicfile.Create(name, atomicfile.Contents(tc.src), atomicfile.ParallelCopy(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, name, string(contents[100:]))
+		checkOffset(t, tc.src, int64(len(contents)))
+	}
+
+	for _, n := range []int{0, -1} {
+		if err := atomicfile.Create(filepath.Join(dir, "invalid"), atomicfile.ParallelCopy(n)); err == nil {
+			t.Fatalf("ParallelCopy(%d) accepted", n)
+		}
+	}
+	checkDirEntries(t, dir, "file", "reader")
+}
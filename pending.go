@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Pending is a file that has been fully staged by Prepare, but that has not
+// been published yet. Exactly one of Commit or Discard should be called on
+// it to release the resources it holds.
+type Pending struct {
+	cfg       config
+	filename  string
+	dir       string
+	base      string
+	d         *os.File
+	staged    Staged
+	f         *os.File
+	lockfile  *os.File
+	written   int64
+	unchanged bool
+	done      bool
+	// crashed makes close leave the staged file as it is, as after a
+	// power loss (see InjectFault).
+	crashed bool
+	// deferSync makes commit skip the fsync of the directories, and the
+	// invocation of finish, that are left to the caller (see CreateMany).
+	deferSync bool
+	result    Result
+}
+
+// Prepare is like Create, but it returns as soon as the temporary file has
+// been populated, its metadata set and (depending on the durability level)
+// synced to stable storage. The file is published only when Commit is called
+// on the returned Pending, so that the moment in which it becomes visible can
+// be coordinated with other work (e.g. committing a database transaction).
+// If the file should not be published, Discard must be called instead.
+// The lock file specified by WithLockfile, if any, is held until Commit or
+// Discard is called. When OnlyIfChanged is specified, the contents are
+// compared with the ones of the target file by Prepare, not by Commit.
+func Prepare(filename string, options ...Option) (*Pending, error) {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	return stage(unix.AT_FDCWD, filename, cfg)
+}
+
+// Commit publishes the file staged by Prepare, by linking it (or renaming it
+// over the existing file, if Replace was specified) in the target directory.
+// Commit can be called only once, and it can not be called after Discard.
+// If Commit fails, the Pending is discarded. The file may have been published
+// anyway, if the failure occurred afterwards (e.g. while syncing the
+// directory containing it, verifying it with VerifyCommit or running the
+// AfterCommit hooks): in this case the error matches ErrPublished.
+func (p *Pending) Commit() error {
+	if p.done {
+		return &werror{"committing file", os.ErrClosed}
+	}
+	p.done = true
+	keepOpen, err := p.commit()
+	if err != nil {
+		p.crashed = errors.Is(err, ErrSimulatedCrash)
+		err = p.keepOnError(err, &p.cfg)
+	}
+	p.close(keepOpen)
+	return err
+}
+
+// Discard releases the file staged by Prepare without publishing it.
+// Calling Discard after Commit has no effect, so it is safe to defer a call
+// to Discard right after Prepare.
+func (p *Pending) Discard() error {
+	if p.done {
+		return nil
+	}
+	p.done = true
+	p.close(false)
+	return nil
+}
+
+// close closes the files held by p. The temporary file is left open if
+// keepOpen is true.
+func (p *Pending) close(keepOpen bool) {
+	// TODO: check errors
+	if p.staged != nil && !p.crashed {
+		_ = p.staged.Cleanup()
+	}
+	if p.f != nil && !keepOpen {
+		_ = p.f.Close()
+	}
+	if p.d != nil {
+		_ = p.d.Close()
+	}
+	if p.lockfile != nil {
+		_ = p.lockfile.Close()
+	}
+}
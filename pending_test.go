@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestPrepare(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	p, err := atomicfile.Prepare(name, atomicfile.Contents(bytes.NewReader([]byte("hello"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Discard()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("file published before Commit: %v", err)
+	}
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file")
+	if err := p.Commit(); err == nil {
+		t.Fatal("second Commit succeeded")
+	}
+	if err := p.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+
+	// a discarded file is never published
+	p, err = atomicfile.Prepare(name,
+		atomicfile.Contents(bytes.NewReader([]byte("new"))),
+		atomicfile.Replace(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(); err == nil {
+		t.Fatal("Commit after Discard succeeded")
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file")
+
+	// the file is published at Commit time, even if the target file has
+	// been created in the meantime
+	other := filepath.Join(dir, "other")
+	p, err = atomicfile.Prepare(other, atomicfile.Contents(bytes.NewReader([]byte("new"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, other, "concurrent")
+	if err := p.Commit(); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+	}
+	checkFile(t, other, "concurrent")
+	checkDirEntries(t, dir, "file", "other")
+}
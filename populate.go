@@ -0,0 +1,612 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// populateFile writes the contents specified in cfg to f, returning the
+// number of bytes read from the contents and written to f.
+func populateFile(f *os.File, cfg *config) (read, written int64, err error) {
+	p := newPopulator(f)
+	p.ring = cfg.ring
+	p.parallel = cfg.parallel
+	p.bufSize = cfg.copyBuffer
+	p.sparse = cfg.sparse
+	if p.sparse {
+		// the zero blocks at the end of the contents are skipped, so the size
+		// of the file needs to be set explicitly
+		defer func() {
+			if err == nil {
+				err = f.Truncate(p.written)
+			}
+		}()
+	}
+	if cfg.preallocChunk > 0 && cfg.prealloc == 0 && cfg.contentSize() <= 0 && !cfg.sparse {
+		hook, allocated := chunkAllocator(f, cfg)
+		p.addHook(cfg.preallocChunk, hook)
+		defer func() {
+			if err == nil && allocated() > p.written {
+				err = cfg.trimPreallocation(f, allocated(), p.written, true)
+			}
+		}()
+	}
+	if cfg.flushEvery > 0 {
+		p.addHook(cfg.flushEvery, flusher(f, cfg.flushEvery))
+	}
+	if cfg.rateLimit > 0 {
+		p.addHook(throttler(cfg, cfg.rateLimit))
+	}
+	if cfg.ctx != nil && cfg.ctx.Done() != nil {
+		p.addHook(ctxCheckInterval, func(int64) error { return cfg.canceled() })
+	}
+	if cfg.progress != nil {
+		total := cfg.contentSize()
+		if total <= 0 {
+			total = -1
+		}
+		p.addHook(progressInterval, progressHook(cfg.progress, total))
+		defer func() {
+			if err == nil {
+				cfg.progress(p.written, total)
+			}
+		}()
+	}
+	for _, c := range cfg.checksumXattrs {
+		p.addTee(c.h)
+	}
+	if cfg.changeHash != nil {
+		p.addTee(cfg.changeHash)
+	}
+	if cfg.verifyHash != nil {
+		p.addTee(cfg.verifyHash)
+	}
+
+	// hashes and limits apply to the contents, before they are transformed
+	var hashes []io.Writer
+	for _, h := range cfg.hashes {
+		hashes = append(hashes, h)
+	}
+	for _, c := range cfg.checksums {
+		hashes = append(hashes, c.h)
+	}
+	limit := int64(-1)
+	if cfg.maxSize >= 0 {
+		limit = cfg.maxSize + 1
+	}
+	if cfg.expectSize >= 0 && (limit < 0 || cfg.expectSize+1 < limit) {
+		limit = cfg.expectSize + 1
+	}
+
+	if len(cfg.transforms) == 0 {
+		for _, h := range hashes {
+			p.addTee(h)
+		}
+		p.limit = limit
+		written, err = p.populate(cfg.contents)
+		cfg.debug("populated file", "method", p.method, "written", written)
+		return written, written, err
+	}
+
+	r := cfg.contents
+	if limit >= 0 {
+		r = io.LimitReader(r, limit)
+	}
+	if len(hashes) > 0 {
+		r = io.TeeReader(r, io.MultiWriter(hashes...))
+	}
+
+	// the first transform receives the contents, the last one writes to p
+	var w io.Writer = p
+	closers := make([]io.Closer, len(cfg.transforms))
+	for i := len(cfg.transforms) - 1; i >= 0; i-- {
+		wc, err := cfg.transforms[i](w)
+		if err != nil {
+			return 0, p.written, err
+		}
+		w, closers[i] = wc, wc
+	}
+
+	read, err = copyBuffer(w, r, cfg.copyBuffer)
+	if err != nil {
+		return read, p.written, err
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			return read, p.written, err
+		}
+	}
+	return read, p.written, nil
+}
+
+// populator writes the contents of the target file, using zero-copy
+// mechanisms whenever possible.
+type populator struct {
+	f *os.File
+	// chunk is the maximum amount of data copied by a single syscall.
+	chunk int
+	// hooks are invoked, in order, every time data is written to f,
+	// with the total amount of data written so far.
+	hooks []func(written int64) error
+	// tees receive a copy of all data written to f. If any tee is present
+	// the data is always copied in userspace.
+	tees []io.Writer
+	// limit is the maximum amount of data to write, or -1 if unlimited.
+	limit int64
+	// method is the mechanism used by populate to write the contents.
+	method string
+	// parallel is the number of goroutines used by parallelCopy.
+	parallel int
+	// bufSize is the size of the buffer used by copy (see CopyBufferSize).
+	bufSize int
+	// ring, if not nil, is used to write the contents that can not be
+	// written with zero-copy mechanisms (see IOUring).
+	ring *uring
+	// sparse makes writeFile skip the blocks that contain only zeros (see
+	// Sparse).
+	sparse bool
+
+	written int64
+}
+
+func newPopulator(f *os.File) *populator {
+	return &populator{f: f, chunk: maxCopyFileRange, limit: -1}
+}
+
+// next returns the amount of data to copy with the next syscall,
+// that is at most n.
+func (p *populator) next(n int) int {
+	if n > p.chunk {
+		n = p.chunk
+	}
+	if p.limit >= 0 && int64(n) > p.limit-p.written {
+		n = int(p.limit - p.written)
+	}
+	return n
+}
+
+// addHook adds a hook that is invoked every time data is written, and makes
+// sure that at most chunk bytes are written between invocations.
+func (p *populator) addHook(chunk int64, hook func(written int64) error) {
+	if chunk > 0 && chunk < int64(p.chunk) {
+		p.chunk = int(chunk)
+	}
+	p.hooks = append(p.hooks, hook)
+}
+
+// addTee adds a writer that receives a copy of all data written.
+func (p *populator) addTee(w io.Writer) {
+	p.tees = append(p.tees, w)
+}
+
+// wrote records that n bytes have been written and invokes the hooks.
+func (p *populator) wrote(n int64) error {
+	p.written += n
+	for _, hook := range p.hooks {
+		if err := hook(p.written); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write implements io.Writer, so that the populator can be used as a
+// destination by io.Copy when hooks or tees are present.
+func (p *populator) Write(buf []byte) (int, error) {
+	var written int
+	for len(buf) > 0 {
+		b := buf
+		if len(b) > p.chunk {
+			b = b[:p.chunk]
+		}
+		n, err := p.writeFile(b)
+		for _, tee := range p.tees {
+			_, _ = tee.Write(b[:n])
+		}
+		written += n
+		buf = buf[n:]
+		if err != nil {
+			return written, err
+		}
+		if err := p.wrote(int64(n)); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// populate writes the contents read from r to the file, returning the number
+// of bytes written. The file must be empty.
+func (p *populator) populate(r io.Reader) (int64, error) {
+	p.method = "copy"
+	if len(p.tees) > 0 {
+		err := p.copy(r)
+		return p.written, err
+	}
+	if src, ok := r.(*slicesReader); ok && len(p.hooks) == 0 && !p.sparse {
+		p.method = "writev"
+		err := p.writeSlices(src)
+		return p.written, err
+	}
+	if src, ok := r.(*os.File); ok {
+		if handled, err := p.cloneFile(src); handled {
+			p.method = "clone"
+			return p.written, err
+		}
+	}
+	if p.sparse {
+		// the other zero-copy mechanisms do not create holes
+		if src, ok := r.(*os.File); ok && len(p.hooks) == 0 {
+			if handled, err := p.sparseFile(src); handled {
+				p.method = "sparse"
+				return p.written, err
+			}
+		}
+		err := p.copy(r)
+		return p.written, err
+	}
+	if p.parallel > 1 && len(p.hooks) == 0 {
+		if handled, err := p.parallelCopy(r, p.parallel); handled {
+			p.method = "parallel"
+			return p.written, err
+		}
+	}
+	if src, ok := r.(*os.File); ok {
+		if handled, err := p.copyFileRange(src); handled {
+			p.method = "copy_file_range"
+			return p.written, err
+		}
+	}
+	if src, ok := r.(syscall.Conn); ok {
+		if handled, err := p.spliceConn(src); handled {
+			p.method = "splice"
+			return p.written, err
+		}
+	}
+	if p.ring != nil && len(p.hooks) == 0 {
+		p.method = "io_uring"
+		err := p.uringCopy(p.ring, r)
+		return p.written, err
+	}
+	err := p.copy(r)
+	return p.written, err
+}
+
+// copy copies the data from r to the file in userspace.
+// If r implements io.WriterTo, its WriteTo method is used, so that readers
+// that have an efficient way to write their contents (e.g. readers backed
+// by in-memory buffers) can avoid copying it through an intermediate buffer.
+func (p *populator) copy(r io.Reader) error {
+	// when writing through p, p.written is updated by p.Write
+	var w io.Writer = p
+	direct := len(p.hooks) == 0 && len(p.tees) == 0 && !p.sparse
+	if direct {
+		w = p.f
+	}
+	if p.limit >= 0 {
+		r = io.LimitReader(r, p.limit-p.written)
+	}
+	var n int64
+	var err error
+	if wt, ok := r.(io.WriterTo); ok {
+		n, err = wt.WriteTo(w)
+	} else {
+		n, err = copyBuffer(w, r, p.bufSize)
+	}
+	if direct {
+		p.written += n
+	}
+	return err
+}
+
+// defaultCopyBuffer is the default size of the buffers used to copy the
+// contents in userspace.
+const defaultCopyBuffer = 1 << 20
+
+// copyBuffers contains a *sync.Pool of buffers for each buffer size.
+var copyBuffers sync.Map
+
+// copyBuffer copies the data from r to w through a pooled buffer of the
+// specified size (or of the default size, if size is 0).
+func copyBuffer(w io.Writer, r io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		size = defaultCopyBuffer
+	}
+	pool, ok := copyBuffers.Load(size)
+	if !ok {
+		pool, _ = copyBuffers.LoadOrStore(size, &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		})
+	}
+	buf := pool.(*sync.Pool).Get().(*[]byte)
+	defer pool.(*sync.Pool).Put(buf)
+	// hide the ReadFrom method of w (e.g. of *os.File), as it would not use
+	// the buffer: the zero-copy mechanisms have already been attempted
+	return io.CopyBuffer(struct{ io.Writer }{w}, r, *buf)
+}
+
+// cloneFile attempts to populate the file by cloning (reflinking) the
+// remaining contents of src using FICLONERANGE. If the filesystem does not
+// support cloning (or src is not a regular file), handled is false and no
+// data has been copied.
+func (p *populator) cloneFile(src *os.File) (handled bool, err error) {
+	pos, size := remaining(src)
+	if pos >= size || (p.limit >= 0 && size-pos > p.limit-p.written) {
+		return false, nil
+	}
+	if same, err := sameMount(int(src.Fd()), int(p.f.Fd())); err != nil || !same {
+		// cloning across mounts fails with EXDEV
+		return false, nil
+	}
+	if fi, err := p.f.Stat(); err != nil || fi.Size() != 0 {
+		// the file has been extended by the preallocation (see
+		// PreallocExtend), so the amount of data cloned can not be determined
+		return false, nil
+	}
+
+	err = unix.IoctlFileCloneRange(int(p.f.Fd()), &unix.FileCloneRange{
+		Src_fd:     int64(src.Fd()),
+		Src_offset: uint64(pos),
+		// Src_length 0 clones everything up to the end of src
+	})
+	switch err {
+	case nil:
+	case unix.EOPNOTSUPP, unix.EXDEV, unix.EINVAL, unix.ENOTTY, unix.EBADF:
+		// cloning is not supported on this filesystem, between these
+		// filesystems, from this offset, or for these file descriptors
+		return false, nil
+	default:
+		return true, err
+	}
+
+	// src may have changed size after the call to Stat, so check how much
+	// data was actually cloned.
+	fi, err := p.f.Stat()
+	if err != nil {
+		return true, err
+	}
+	if _, err := src.Seek(pos+fi.Size(), io.SeekStart); err != nil {
+		return true, err
+	}
+	return true, p.wrote(fi.Size())
+}
+
+// maxCopyFileRange is the maximum amount of data copied by a single call
+// to copy_file_range.
+const maxCopyFileRange = 1 << 30
+
+// copyFileRange attempts to populate the file by copying the remaining
+// contents of src using copy_file_range, so that data does not need to be
+// copied to userspace (and can be copied server-side on network filesystems
+// that support it). If copy_file_range is not supported (or src is not a
+// regular file), handled is false and no data has been copied. If
+// copy_file_range stops making progress before the end of src, the rest of
+// the data is copied in userspace.
+func (p *populator) copyFileRange(src *os.File) (handled bool, err error) {
+	pos, size := remaining(src)
+	if pos >= size {
+		return false, nil
+	}
+
+	var written int64
+	for {
+		chunk := p.next(maxCopyFileRange)
+		if chunk == 0 {
+			return true, nil
+		}
+		n, err := unix.CopyFileRange(int(src.Fd()), nil, int(p.f.Fd()), nil, chunk, 0)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			switch err {
+			case unix.ENOSYS, unix.EOPNOTSUPP, unix.EXDEV, unix.EINVAL, unix.EBADF, unix.EPERM:
+				if written == 0 {
+					// copy_file_range is not supported on this kernel,
+					// filesystem or between these filesystems
+					return false, nil
+				}
+			}
+			return true, err
+		} else if n == 0 {
+			break
+		}
+		written += int64(n)
+		if err := p.wrote(int64(n)); err != nil {
+			return true, err
+		}
+	}
+
+	if pos+written < size {
+		// copy_file_range returned short: copy the rest of the data
+		return true, p.copy(src)
+	}
+	return true, nil
+}
+
+// remaining returns the current offset and size of f, if f is a regular
+// file. Otherwise, it returns a size of 0.
+func remaining(f *os.File) (pos, size int64) {
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0, 0
+	}
+	pos, err = f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0
+	}
+	return pos, fi.Size()
+}
+
+// maxSplice is the maximum amount of data moved by a single call to splice.
+const maxSplice = 1 << 20
+
+// spliceConn attempts to populate the file by splicing the contents of src,
+// if src is a pipe or a stream socket, so that data does not need to be
+// copied to userspace. If splice is not supported (or src is neither a pipe
+// nor a stream socket), handled is false and no data has been copied.
+func (p *populator) spliceConn(src syscall.Conn) (handled bool, err error) {
+	rc, err := src.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	var mode uint32
+	var sotype int
+	err = rc.Control(func(fd uintptr) {
+		var st unix.Stat_t
+		if unix.Fstat(int(fd), &st) != nil {
+			return
+		}
+		mode = st.Mode & unix.S_IFMT
+		if mode == unix.S_IFSOCK {
+			sotype, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TYPE)
+		}
+	})
+	if err != nil {
+		return false, nil
+	}
+
+	switch {
+	case mode == unix.S_IFIFO:
+		return p.splicePipe(rc)
+	case mode == unix.S_IFSOCK && sotype == unix.SOCK_STREAM:
+		return p.spliceSocket(rc)
+	}
+	return false, nil
+}
+
+// splicePipe splices all data from the pipe src to the file.
+func (p *populator) splicePipe(src syscall.RawConn) (handled bool, err error) {
+	var written int64
+	for {
+		chunk := p.next(maxSplice)
+		if chunk == 0 {
+			return true, nil
+		}
+		var n int64
+		var serr error
+		err := src.Read(func(fd uintptr) bool {
+			n, serr = splice(int(fd), int(p.f.Fd()), chunk)
+			return serr != unix.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			if written == 0 && isSpliceUnsupported(err) {
+				return false, nil
+			}
+			return true, err
+		} else if n == 0 {
+			return true, nil
+		}
+		written += n
+		if err := p.wrote(n); err != nil {
+			return true, err
+		}
+	}
+}
+
+// spliceSocket splices all data from the stream socket src to the file,
+// through an intermediate pipe.
+func (p *populator) spliceSocket(src syscall.RawConn) (handled bool, err error) {
+	var pipe [2]int
+	if err := unix.Pipe2(pipe[:], unix.O_CLOEXEC); err != nil {
+		return false, nil
+	}
+	defer unix.Close(pipe[0])
+	defer unix.Close(pipe[1])
+	// the pipe is always drained before splicing more data into it, so
+	// that splicing into it never blocks
+	_, _ = unix.FcntlInt(uintptr(pipe[1]), unix.F_SETPIPE_SZ, maxSplice)
+	size, err := unix.FcntlInt(uintptr(pipe[1]), unix.F_GETPIPE_SZ, 0)
+	if err != nil {
+		return false, nil
+	}
+
+	var written int64
+	for {
+		chunk := p.next(size)
+		if chunk == 0 {
+			return true, nil
+		}
+		var n int64
+		var serr error
+		err := src.Read(func(fd uintptr) bool {
+			n, serr = splice(int(fd), pipe[1], chunk)
+			return serr != unix.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			if written == 0 && isSpliceUnsupported(err) {
+				return false, nil
+			}
+			return true, err
+		} else if n == 0 {
+			return true, nil
+		}
+		for n > 0 {
+			m, err := splice(pipe[0], int(p.f.Fd()), int(n))
+			if err != nil {
+				return true, err
+			} else if m == 0 {
+				return true, io.ErrUnexpectedEOF
+			}
+			n -= m
+			written += m
+			if err := p.wrote(m); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+func splice(rfd, wfd, n int) (int64, error) {
+	for {
+		m, err := unix.Splice(rfd, nil, wfd, nil, n, unix.SPLICE_F_MOVE)
+		if err == unix.EINTR {
+			continue
+		}
+		return int64(m), err
+	}
+}
+
+func isSpliceUnsupported(err error) bool {
+	return err == unix.EINVAL || err == unix.ENOSYS || err == unix.EOPNOTSUPP
+}
+
+// flusher returns a hook that starts the writeback of the data written to f
+// every n bytes, and that waits for the writeback of the previous n bytes
+// to complete, so that at most about 2*n bytes of dirty pages are pending.
+func flusher(f *os.File, n int64) func(written int64) error {
+	var waited, flushed int64
+	return func(written int64) error {
+		if written-flushed < n {
+			return nil
+		}
+		fd := int(f.Fd())
+		err := unix.SyncFileRange(fd, flushed, written-flushed, unix.SYNC_FILE_RANGE_WRITE)
+		if err != nil {
+			return &werror{"starting writeback", err}
+		}
+		if waited < flushed {
+			err := unix.SyncFileRange(fd, waited, flushed-waited, unix.SYNC_FILE_RANGE_WAIT_BEFORE|unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER)
+			if err != nil {
+				return &werror{"waiting for writeback", err}
+			}
+		}
+		waited, flushed = flushed, written
+		return nil
+	}
+}
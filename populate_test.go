@@ -0,0 +1,217 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+	"golang.org/x/sys/unix"
+)
+
+// testContents returns n bytes of non-repeating test data.
+func testContents(n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(i*7 + i>>13)
+	}
+	return buf
+}
+
+// openAt creates a file in dir with the specified contents, and returns it
+// opened for reading at offset.
+func openAt(t *testing.T, dir string, contents []byte, offset int64) *os.File {
+	t.Helper()
+	f, err := os.CreateTemp(dir, "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := f.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// checkOffset checks that the source f is positioned at offset.
+func checkOffset(t *testing.T, f io.Seeker, offset int64) {
+	t.Helper()
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != offset {
+		t.Fatalf("source file positioned at %d, expected %d", pos, offset)
+	}
+}
+
+func TestCloneFile(t *testing.T) {
+	dir := t.TempDir()
+	contents := testContents(1<<20 + 4096)
+
+	// cloning is attempted first for regular files: if the filesystem does
+	// not support it, the contents are copied
+	a, b := openAt(t, dir, nil, 0), openAt(t, dir, nil, 0)
+	if err := unix.IoctlFileClone(int(b.Fd()), int(a.Fd())); err != nil {
+		t.Logf("cloning not supported by the filesystem (%v): testing the fallback", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		offset int64
+		opts   []atomicfile.Option
+	}{
+		{"whole", 0, nil},
+		{"aligned", 4096, nil},
+		{"unaligned", 1234, nil},
+		{"prealloc", 0, []atomicfile.Option{atomicfile.Preallocate(int64(len(contents)))}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := openAt(t, dir, contents, tc.offset)
+			name := filepath.Join(dir, tc.name)
+			opts := append(tc.opts, atomicfile.Contents(src))
+			if err := atomicfile.Create(name, opts...); err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, name, string(contents[tc.offset:]))
+			checkOffset(t, src, int64(len(contents)))
+		})
+	}
+}
+
+func TestCopyFileRange(t *testing.T) {
+	contents := testContents(3<<20 + 12345)
+
+	// copy_file_range may not be supported across filesystems: in that case
+	// the contents are copied in userspace
+	dirs := []string{t.TempDir()}
+	if shm, err := os.MkdirTemp("/dev/shm", "atomicfile"); err == nil {
+		t.Cleanup(func() { os.RemoveAll(shm) })
+		dirs = append(dirs, shm)
+	}
+	for _, srcDir := range dirs {
+		dir := t.TempDir()
+		for _, offset := range []int64{0, 1, 1 << 20} {
+			src := openAt(t, srcDir, contents, offset)
+			name := filepath.Join(dir, fmt.Sprint("file", offset))
+			if err := atomicfile.Create(name, atomicfile.Contents(src)); err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, name, string(contents[offset:]))
+			checkOffset(t, src, int64(len(contents)))
+		}
+
+		// nothing is left to copy
+		src := openAt(t, srcDir, contents, int64(len(contents)))
+		name := filepath.Join(dir, "empty")
+		if err := atomicfile.Create(name, atomicfile.Contents(src)); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, name, "")
+	}
+}
+
+func TestSplice(t *testing.T) {
+	contents := testContents(3<<20 + 12345)
+
+	pipe := func(t *testing.T) io.Reader {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.Close() })
+		go func() {
+			w.Write(contents)
+			w.Close()
+		}()
+		return r
+	}
+	socket := func(t *testing.T) io.Reader {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns := make([]net.Conn, 2)
+		for i, fd := range fds {
+			f := os.NewFile(uintptr(fd), "socket")
+			conns[i], err = net.FileConn(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Cleanup(func() { conns[0].Close() })
+		go func() {
+			conns[1].Write(contents)
+			conns[1].Close()
+		}()
+		return conns[0]
+	}
+	tcp := func(t *testing.T) io.Reader {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		defer l.Close()
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write(contents)
+			c.Close()
+		}()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	for _, tc := range []struct {
+		name string
+		open func(t *testing.T) io.Reader
+	}{
+		{"pipe", pipe},
+		{"socket", socket},
+		{"tcp", tcp},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := filepath.Join(dir, "file")
+			if err := atomicfile.Create(name, atomicfile.Contents(tc.open(t))); err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, name, string(contents))
+			checkDirEntries(t, dir, "file")
+		})
+	}
+
+	// a datagram socket can not be spliced, so it is read in userspace
+	dir := t.TempDir()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	r, w := os.NewFile(uintptr(fds[0]), "r"), os.NewFile(uintptr(fds[1]), "w")
+	defer r.Close()
+	go func() {
+		w.Write([]byte("packet"))
+		w.Close()
+	}()
+	name := filepath.Join(dir, "file")
+	if err := atomicfile.Create(name, atomicfile.Contents(r)); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "packet")
+}
@@ -0,0 +1,367 @@
+//go:build !linux
+// +build !linux
+
+package atomicfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ContentSize specifies the expected size of the contents, for cases in which
+// it can not be determined automatically from the reader passed to Contents.
+// On this platform space is not preallocated for the target file, so the size
+// is only validated.
+func ContentSize(n int64) Option {
+	return optionFunc(func(c *config) error {
+		if c.sizeHint != defaultConfig().sizeHint {
+			return &werror{"multiple content sizes", nil}
+		}
+		if n < 0 {
+			return &werror{"invalid content size", nil}
+		}
+		c.sizeHint = n
+		return nil
+	})
+}
+
+// ExpectSize specifies the exact size of the contents: if the number of bytes
+// read from the reader passed to Contents differs from n (e.g. because of a
+// truncated upload), the target file is not created and ErrSizeMismatch is
+// returned. At most n+1 bytes are read from the reader passed to Contents.
+func ExpectSize(n int64) Option {
+	return optionFunc(func(c *config) error {
+		if c.expectSize != defaultConfig().expectSize {
+			return &werror{"multiple expected sizes", nil}
+		}
+		if n < 0 {
+			return &werror{"invalid expected size", nil}
+		}
+		c.expectSize = n
+		return nil
+	})
+}
+
+// CopyBufferSize specifies the size of the buffer used to copy the contents
+// when they have to be copied in userspace (i.e. when the reader passed to
+// Contents does not implement io.WriterTo, and the target file can not read
+// from it directly). By default the buffer size of io.Copy is used.
+func CopyBufferSize(n int) Option {
+	return optionFunc(func(c *config) error {
+		if c.copyBuffer != defaultConfig().copyBuffer {
+			return &werror{"multiple copy buffer sizes", nil}
+		}
+		if n <= 0 {
+			return &werror{"invalid copy buffer size", nil}
+		}
+		c.copyBuffer = n
+		return nil
+	})
+}
+
+// ContentsSlices specifies the contents to be written to the target file, as
+// the concatenation of bufs. The buffers must not be modified until Create
+// returns.
+func ContentsSlices(bufs ...[]byte) Option {
+	rs := make([]io.Reader, len(bufs))
+	for i, b := range bufs {
+		rs[i] = bytes.NewReader(b)
+	}
+	return Contents(io.MultiReader(rs...))
+}
+
+// Context makes Create stop, and fail with the error returned by ctx.Err(),
+// if ctx is canceled before the target file is linked. Cancellation is
+// checked before starting to create the temporary file, before each read
+// from the reader passed to Contents, and before linking the temporary file.
+// Once the target file has been linked, the creation is always completed.
+func Context(ctx context.Context) Option {
+	return optionFunc(func(c *config) error {
+		if c.ctx != defaultConfig().ctx {
+			return &werror{"multiple contexts", nil}
+		}
+		if ctx == nil {
+			return &werror{"invalid context", nil}
+		}
+		c.ctx = ctx
+		return nil
+	})
+}
+
+// AfterCommit specifies a function to be invoked with the Result of Create
+// once the target file has been linked and, depending on the durability
+// level, synced to stable storage together with its containing directory.
+// AfterCommit can be specified multiple times: the functions are invoked in
+// the order in which they are specified, stopping at the first one that
+// returns an error. As the target file has already been created, an error
+// returned by the function is reported by Create (matching ErrPublished)
+// but does not cause the target file to be removed.
+func AfterCommit(fn func(r Result) error) Option {
+	return optionFunc(func(c *config) error {
+		c.afterCommit = append(c.afterCommit, fn)
+		return nil
+	})
+}
+
+// Backup makes Create, when replacing an existing target file (see Replace),
+// preserve the previous version of the target file with the name of the
+// target file followed by suffix (e.g. ".bak"), replacing any previous
+// backup. The name of the backup is reported in Result.Backup (see Report).
+// If the target file does not exist, no backup is made.
+// On this platform the previous version is hard linked as the backup before
+// the target file is replaced, so that the target file is never missing: if
+// the target file is replaced concurrently, the backup may contain a version
+// other than the one replaced by Create. Hard links must be supported.
+func Backup(suffix string) Option {
+	return optionFunc(func(c *config) error {
+		if c.backupSuffix != defaultConfig().backupSuffix || c.backupRotate != defaultConfig().backupRotate {
+			return &werror{"multiple backups", nil}
+		}
+		if suffix == "" || strings.Contains(suffix, "/") {
+			return &werror{"invalid backup suffix", nil}
+		}
+		c.backupSuffix = suffix
+		return nil
+	})
+}
+
+// BackupRotate is like Backup, but keeps the last n replaced versions of the
+// target file, using numbered suffixes like `cp --backup=numbered`: the
+// previous version of the target file is linked with the name of the target
+// file followed by ".~N~", where N is one more than the highest number of the
+// existing backups, and once the target file has been replaced the oldest
+// backups are removed so that at most n remain.
+func BackupRotate(n int) Option {
+	return optionFunc(func(c *config) error {
+		if c.backupSuffix != defaultConfig().backupSuffix || c.backupRotate != defaultConfig().backupRotate {
+			return &werror{"multiple backups", nil}
+		}
+		if n < 1 {
+			return &werror{"invalid number of backups", nil}
+		}
+		c.backupRotate = n
+		return nil
+	})
+}
+
+// populateFile writes the contents specified in cfg to f, returning the
+// number of bytes written to f. Hash, ChecksumXattr, MaxSize and ExpectSize
+// apply to the contents, before they are filtered by the Transform options.
+func populateFile(f *os.File, cfg *config) (int64, error) {
+	var read int64
+	var r io.Reader = &countingReader{r: cfg.contents, n: &read}
+	if cfg.ctx != nil {
+		r = &ctxReader{ctx: cfg.ctx, r: r}
+	}
+	limit := int64(-1)
+	if cfg.maxSize >= 0 {
+		limit = cfg.maxSize + 1
+	}
+	if cfg.expectSize >= 0 && (limit < 0 || cfg.expectSize+1 < limit) {
+		limit = cfg.expectSize + 1
+	}
+	if limit >= 0 {
+		r = io.LimitReader(r, limit)
+	}
+	var hashes []io.Writer
+	for _, h := range cfg.hashes {
+		hashes = append(hashes, h)
+	}
+	for _, c := range cfg.checksumXattrs {
+		hashes = append(hashes, c.h)
+	}
+	if len(hashes) > 0 {
+		r = io.TeeReader(r, io.MultiWriter(hashes...))
+	}
+
+	// the first transform receives the contents, the last one writes to f
+	cw := &countingWriter{w: f}
+	var w io.Writer = cw
+	closers := make([]io.Closer, len(cfg.transforms))
+	for i := len(cfg.transforms) - 1; i >= 0; i-- {
+		wc, err := cfg.transforms[i](w)
+		if err != nil {
+			return cw.n, err
+		}
+		w, closers[i] = wc, wc
+	}
+
+	var buf []byte
+	if cfg.copyBuffer > 0 {
+		buf = make([]byte, cfg.copyBuffer)
+	}
+	if _, err := io.CopyBuffer(w, r, buf); err != nil {
+		return cw.n, err
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			return cw.n, err
+		}
+	}
+	if cfg.maxSize >= 0 && read > cfg.maxSize {
+		return cw.n, ErrTooLarge
+	}
+	if cfg.expectSize >= 0 && read != cfg.expectSize {
+		return cw.n, ErrSizeMismatch
+	}
+	return cw.n, nil
+}
+
+// canceled returns the error of the context specified with Context, if it
+// has been canceled.
+func (c *config) canceled() error {
+	if c.ctx == nil {
+		return nil
+	}
+	return c.ctx.Err()
+}
+
+// ctxReader fails with the error of ctx once it has been canceled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// backupFile links the existing target file filename as its backup (see
+// Backup and BackupRotate), and returns the name of the backup. If the
+// target file does not exist, no backup is made.
+func backupFile(filename string, cfg *config) (string, error) {
+	if cfg.backupRotate > 0 {
+		return linkNumberedBackup(filename)
+	}
+
+	// the backup is linked with a temporary name, and then renamed over
+	// the previous backup
+	dir, base := filepath.Split(filename)
+	var tmp string
+	for i := 0; ; i++ {
+		name, err := tempName(base)
+		if err != nil {
+			return "", err
+		}
+		tmp = filepath.Join(dir, name)
+		err = os.Link(filename, tmp)
+		if err == nil {
+			break
+		} else if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		} else if !errors.Is(err, os.ErrExist) || i >= 100 {
+			return "", err
+		}
+	}
+	backup := filename + cfg.backupSuffix
+	if err := os.Rename(tmp, backup); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return backup, nil
+}
+
+// linkNumberedBackup links the existing target file filename as its next
+// numbered backup (see BackupRotate), and returns the name of the backup.
+// If the target file does not exist, no backup is made.
+func linkNumberedBackup(filename string) (string, error) {
+	nums, err := numberedBackups(filename)
+	if err != nil {
+		return "", err
+	}
+	next := 1
+	if len(nums) > 0 {
+		next = nums[len(nums)-1] + 1
+	}
+	for i := 0; ; i++ {
+		backup := numberedBackup(filename, next)
+		err := os.Link(filename, backup)
+		if err == nil {
+			return backup, nil
+		} else if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		} else if !errors.Is(err, os.ErrExist) || i >= 100 {
+			return "", err
+		}
+		next++
+	}
+}
+
+// pruneBackups removes the oldest numbered backups of filename, so that at
+// most n remain.
+func pruneBackups(filename string, n int) error {
+	nums, err := numberedBackups(filename)
+	if err != nil {
+		return err
+	}
+	for len(nums) > n {
+		err := os.Remove(numberedBackup(filename, nums[0]))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		nums = nums[1:]
+	}
+	return nil
+}
+
+// numberedBackups returns the numbers of the existing numbered backups of
+// filename, in increasing order.
+func numberedBackups(filename string) ([]int, error) {
+	d, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	return backupNumbers(filepath.Base(filename), names), nil
+}
+
+// finish stores r, with the digests computed by the Hash options, in the
+// Result specified with Report, if any, and invokes the AfterCommit hooks.
+func (c *config) finish(r Result) error {
+	for _, h := range c.hashes {
+		r.Sums = append(r.Sums, h.Sum(nil))
+	}
+	if c.result != nil {
+		*c.result = r
+	}
+	for _, fn := range c.afterCommit {
+		if err := fn(r); err != nil {
+			return &werror{"running AfterCommit hook", err}
+		}
+	}
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
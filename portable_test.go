@@ -0,0 +1,170 @@
+//go:build linux || freebsd || netbsd || openbsd || solaris || js || plan9
+// +build linux freebsd netbsd openbsd solaris js plan9
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+// upperWriter converts the ASCII letters written to it to upper case.
+type upperWriter struct {
+	w io.Writer
+}
+
+func (u upperWriter) Write(p []byte) (int, error) {
+	return u.w.Write(bytes.ToUpper(p))
+}
+
+func (u upperWriter) Close() error {
+	return nil
+}
+
+func TestPortableOptions(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	h := sha256.New()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var r atomicfile.Result
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.Transform(func(w io.Writer) (io.WriteCloser, error) { return upperWriter{w}, nil }),
+		atomicfile.Hash(h),
+		atomicfile.MaxSize(5),
+		atomicfile.ModificationTime(mtime),
+		atomicfile.Fsync(),
+		atomicfile.Report(&r),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "HELLO")
+	sum := sha256.Sum256([]byte("hello"))
+	if r.Written != 5 || len(r.Sums) != 1 || !bytes.Equal(r.Sums[0], sum[:]) {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Fatalf("modification time is %v, expected %v", fi.ModTime(), mtime)
+	}
+
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello!"))),
+		atomicfile.MaxSize(5),
+		atomicfile.Replace(),
+	)
+	if !errors.Is(err, atomicfile.ErrTooLarge) {
+		t.Fatalf("expected an error wrapping ErrTooLarge, got %v", err)
+	}
+	checkFile(t, name, "HELLO")
+	checkDirEntries(t, dir, "file")
+}
+
+func TestPortableContents(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	var committed []atomicfile.Result
+	err := atomicfile.Create(name,
+		atomicfile.ContentsSlices([]byte("hel"), nil, []byte("lo")),
+		atomicfile.ContentSize(5),
+		atomicfile.ExpectSize(5),
+		atomicfile.CopyBufferSize(2),
+		atomicfile.Context(context.Background()),
+		atomicfile.AfterCommit(func(r atomicfile.Result) error {
+			committed = append(committed, r)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+	if len(committed) != 1 || committed[0].Written != 5 {
+		t.Fatalf("unexpected AfterCommit results %+v", committed)
+	}
+
+	errHook := errors.New("hook failed")
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("world"))),
+		atomicfile.Replace(),
+		atomicfile.AfterCommit(func(atomicfile.Result) error { return errHook }),
+	)
+	if !errors.Is(err, errHook) || !errors.Is(err, atomicfile.ErrPublished) {
+		t.Fatalf("expected an error wrapping the hook error and ErrPublished, got %v", err)
+	}
+	checkFile(t, name, "world")
+
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("truncated"))),
+		atomicfile.ExpectSize(10),
+		atomicfile.Replace(),
+	)
+	if !errors.Is(err, atomicfile.ErrSizeMismatch) {
+		t.Fatalf("expected an error wrapping ErrSizeMismatch, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("canceled"))),
+		atomicfile.Context(ctx),
+		atomicfile.Replace(),
+	)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected an error wrapping context.Canceled, got %v", err)
+	}
+	checkFile(t, name, "world")
+	checkDirEntries(t, dir, "file")
+}
+
+func TestPortableBackup(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	writeFile(t, name, "v0")
+
+	var r atomicfile.Result
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("v1"))),
+		atomicfile.Replace(),
+		atomicfile.Backup(".bak"),
+		atomicfile.Report(&r),
+	)
+	if err != nil {
+		t.Skipf("backups not supported: %v", err)
+	}
+	if r.Backup != name+".bak" {
+		t.Fatalf("Backup is %q, expected %q", r.Backup, name+".bak")
+	}
+	checkFile(t, name, "v1")
+	checkFile(t, name+".bak", "v0")
+
+	for i := 2; i <= 4; i++ {
+		err := atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader([]byte{'v', '0' + byte(i)})),
+			atomicfile.Replace(),
+			atomicfile.BackupRotate(2),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFile(t, name, "v4")
+	checkFile(t, name+".~2~", "v2")
+	checkFile(t, name+".~3~", "v3")
+	checkDirEntries(t, dir, "file", "file.bak", "file.~2~", "file.~3~")
+}
@@ -0,0 +1,169 @@
+//go:build freebsd || netbsd || openbsd || solaris || js || plan9
+// +build freebsd netbsd openbsd solaris js plan9
+
+package atomicfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Rename atomically renames oldpath to newpath, and then fsyncs the
+// directories containing them (both of them, if they differ) so that the
+// rename is durable once Rename returns.
+// If the NoReplace option is specified, Rename fails if newpath already
+// exists: as this platform can not rename a file without replacing an
+// existing one, oldpath is linked as newpath and then removed, so only files
+// (and not directories) can be renamed with NoReplace.
+// Only the NoReplace option is honored: Rename fails if any other option is
+// specified.
+func Rename(oldpath, newpath string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	err = checkHonored("Rename", cfg, func(c *config) { c.noReplace = false })
+	if err != nil {
+		return err
+	}
+
+	if cfg.noReplace {
+		err = renameNoReplace(oldpath, newpath)
+	} else {
+		err = os.Rename(oldpath, newpath)
+	}
+	if err != nil {
+		return &werror{"renaming file", err}
+	}
+
+	newdir := filepath.Dir(newpath)
+	if err := syncDir(newdir); err != nil {
+		return &werror{"fsync directory", err}
+	}
+	if olddir := filepath.Dir(oldpath); olddir != newdir {
+		if err := syncDir(olddir); err != nil {
+			return &werror{"fsync directory", err}
+		}
+	}
+
+	return nil
+}
+
+// renameNoReplace renames oldpath to newpath, failing if newpath exists, by
+// linking oldpath as newpath and then removing oldpath.
+func renameNoReplace(oldpath, newpath string) error {
+	if err := os.Link(oldpath, newpath); err != nil {
+		return err
+	}
+	return os.Remove(oldpath)
+}
+
+// Remove removes the specified file (or empty directory), and then fsyncs
+// the directory containing it so that the removal is durable once Remove
+// returns.
+// No options are currently honored by Remove: it fails if any is specified.
+func Remove(name string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	if err := checkHonored("Remove", cfg, nil); err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if err != nil {
+		return &werror{"removing file", err}
+	}
+
+	if err := syncDir(filepath.Dir(name)); err != nil {
+		return &werror{"fsync directory", err}
+	}
+
+	return nil
+}
+
+// Symlink atomically creates or replaces linkname as a symbolic link to target.
+// The symbolic link is first created with a temporary name in the same
+// directory and then renamed over linkname, so that other processes observe
+// either the previous state of linkname or the new symbolic link.
+// Only the Fsync, Durability, SyncParentDirs, NoReplace, ownership (Ownership,
+// Uid, Gid, Owner and Group), ModificationTime and AccessTime options are
+// honored: Symlink fails if any other option is specified. With NoReplace,
+// the symbolic link is linked as linkname (see Rename).
+func Symlink(target, linkname string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	err = checkHonored("Symlink", cfg, func(c *config) {
+		def := defaultConfig()
+		c.durability, c.syncParents, c.noReplace = def.durability, def.syncParents, def.noReplace
+		c.uid, c.gid, c.mtime, c.atime = def.uid, def.gid, def.mtime, def.atime
+	})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(linkname)
+
+	var tmp string
+	for i := 0; ; i++ {
+		name, err := tempName(filepath.Base(linkname))
+		if err != nil {
+			return &werror{"generating temporary name", err}
+		}
+		tmp = filepath.Join(dir, name)
+		err = os.Symlink(target, tmp)
+		if err == nil {
+			break
+		} else if !errors.Is(err, os.ErrExist) || i >= 100 {
+			return &werror{"creating symlink", err}
+		}
+	}
+
+	if err := setupSymlink(tmp, linkname, cfg); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if cfg.durability >= DurabilityFull || cfg.syncParents {
+		if err := syncDir(dir); err != nil {
+			return &werror{"fsync directory", err}
+		}
+	}
+
+	if cfg.durability >= DurabilityParanoid || cfg.syncParents {
+		if err := syncParents(dir); err != nil {
+			return &werror{"fsync parent directories", err}
+		}
+	}
+
+	return nil
+}
+
+func setupSymlink(tmp, linkname string, cfg config) error {
+	if cfg.uid != defaultConfig().uid || cfg.gid != defaultConfig().gid {
+		err := os.Lchown(tmp, cfg.uid, cfg.gid)
+		if err != nil {
+			return &werror{"setting ownership", err}
+		}
+	}
+
+	if err := setSymlinkTimes(tmp, &cfg); err != nil {
+		return &werror{"setting access/modification time", err}
+	}
+
+	var err error
+	if cfg.noReplace {
+		err = renameNoReplace(tmp, linkname)
+	} else {
+		err = os.Rename(tmp, linkname)
+	}
+	if err != nil {
+		return &werror{"renaming symlink", err}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// PreallocateMode specifies how space is preallocated for the target file.
+// With PreallocExtend and PreallocZeroRange, the target file is always
+// truncated to the size of the contents after it has been populated.
+// Cloning the contents (see Create) is not possible in these modes.
+func PreallocateMode(mode PreallocMode) Option {
+	return optionFunc(func(c *config) error {
+		if c.preallocMode != defaultConfig().preallocMode {
+			return &werror{"multiple preallocation modes", nil}
+		}
+		if mode < PreallocKeepSize || mode > PreallocZeroRange {
+			return &werror{"invalid preallocation mode", nil}
+		}
+		c.preallocMode = mode
+		return nil
+	})
+}
+
+// TrimPreallocation specifies whether the space preallocated past the end
+// of the contents is released (if trim is true), or kept allocated past the
+// end of the target file (if trim is false), so that it can be used if the
+// file is later appended to.
+// By default, the excess space is released if the preallocation size was
+// guessed from the size of the contents, and kept if it was specified with
+// Preallocate.
+func TrimPreallocation(trim bool) Option {
+	return optionFunc(func(c *config) error {
+		if c.preallocTrim != defaultConfig().preallocTrim {
+			return &werror{"multiple preallocation trims", nil}
+		}
+		c.preallocTrim = -1
+		if trim {
+			c.preallocTrim = 1
+		}
+		return nil
+	})
+}
+
+// ReserveSpace is like Preallocate, but it is meant for callers that need to
+// know upfront whether n bytes are available for the target file: if the
+// space can not be allocated, Create fails before any of the contents is
+// read, with ErrNoSpace if there is not enough free space (or quota), so
+// that the caller does not discover that the filesystem is full halfway
+// through writing the contents.
+func ReserveSpace(n int64) Option {
+	return optionFunc(func(c *config) error {
+		if err := Preallocate(n).apply(c); err != nil {
+			return err
+		}
+		c.reserve = true
+		return nil
+	})
+}
+
+// fallocate preallocates size bytes for f, using the preallocation mode in
+// c.
+func (c *config) fallocate(f *os.File, size int64) error {
+	var mode uint32
+	switch c.preallocMode {
+	case PreallocKeepSize:
+		mode = unix.FALLOC_FL_KEEP_SIZE
+	case PreallocZeroRange:
+		mode = unix.FALLOC_FL_ZERO_RANGE
+	}
+	return unix.Fallocate(int(f.Fd()), mode, 0, size)
+}
+
+// trimPreallocation releases (or keeps, see TrimPreallocation) the space
+// preallocated for f past the end of its contents. guessed reports whether
+// the preallocation size was guessed from the size of the contents.
+func (c *config) trimPreallocation(f *os.File, prealloc, written int64, guessed bool) error {
+	trim := guessed
+	if c.preallocTrim != 0 {
+		trim = c.preallocTrim > 0
+	}
+	if !trim && c.preallocMode == PreallocKeepSize {
+		return nil
+	}
+
+	// Some filesystems (e.g. ext4) ignore requests to punch holes past
+	// the end of the file, so truncate the file to its current size
+	// instead: this releases the blocks allocated past the end.
+	c.debug("releasing excess preallocation", "preallocated", prealloc, "written", written)
+	err := unix.Ftruncate(int(f.Fd()), written)
+	if c.preallocMode == PreallocKeepSize {
+		// the size of the file is already correct
+		// TODO: should we fail in this case?
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !trim {
+		// allocate again the space past the end of the file
+		_ = unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, written, prealloc-written)
+	}
+	return nil
+}
+
+// PreallocateChunks makes Create preallocate space for the target file in
+// chunks of n bytes while the contents are written, if the size of the
+// contents is not known (see ContentSize), to reduce fragmentation. The
+// space preallocated past the end of the contents is released at the end
+// (see TrimPreallocation).
+func PreallocateChunks(n int64) Option {
+	return optionFunc(func(c *config) error {
+		if c.preallocChunk != defaultConfig().preallocChunk {
+			return &werror{"multiple preallocation chunk sizes", nil}
+		}
+		if n <= 0 {
+			return &werror{"invalid preallocation chunk size", nil}
+		}
+		c.preallocChunk = n
+		return nil
+	})
+}
+
+// chunkAllocator preallocates the first chunk of f, and returns a hook that
+// keeps at least one chunk preallocated past the data written. It returns a
+// function that reports the amount of space preallocated.
+func chunkAllocator(f *os.File, c *config) (hook func(written int64) error, allocated func() int64) {
+	var alloc int64
+	failed := false
+	grow := func(written int64) error {
+		for !failed && alloc-written < c.preallocChunk {
+			err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, alloc, c.preallocChunk)
+			if err != nil {
+				// preallocation is best-effort: stop trying
+				c.debug("ignoring preallocation error", "offset", alloc, "size", c.preallocChunk, "error", err)
+				failed = true
+				break
+			}
+			alloc += c.preallocChunk
+		}
+		return nil
+	}
+	_ = grow(0)
+	return grow, func() int64 { return alloc }
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestPreallocateModes(t *testing.T) {
+	contents := bytes.Repeat([]byte("x"), 10000)
+	for _, tc := range []struct {
+		name string
+		mode atomicfile.PreallocMode
+	}{
+		{"keep-size", atomicfile.PreallocKeepSize},
+		{"extend", atomicfile.PreallocExtend},
+		{"zero-range", atomicfile.PreallocZeroRange},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, opts := range [][]atomicfile.Option{
+				{atomicfile.Preallocate(1 << 20)},
+				{atomicfile.Preallocate(1 << 20), atomicfile.TrimPreallocation(true)},
+				{atomicfile.ContentSize(int64(len(contents)))},
+			} {
+				name := filepath.Join(dir, "file")
+				reader := struct{ io.Reader }{bytes.NewReader(contents)}
+				opts = append(opts, atomicfile.Contents(reader), atomicfile.PreallocateMode(tc.mode), atomicfile.Replace())
+				if err := atomicfile.Create(name, opts...); err != nil {
+					t.Fatal(err)
+				}
+				checkFile(t, name, string(contents))
+			}
+		})
+	}
+}
+
+func TestReserveSpace(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.ReserveSpace(int64(st.Bavail)*st.Bsize+1<<30),
+	)
+	if !errors.Is(err, atomicfile.ErrNoSpace) {
+		t.Fatalf("expected an error wrapping ErrNoSpace, got %v", err)
+	}
+	checkDirEntries(t, dir)
+}
+
+func TestPreallocateChunks(t *testing.T) {
+	dir := t.TempDir()
+	contents := bytes.Repeat([]byte("x"), 10000)
+	for _, mode := range []atomicfile.PreallocMode{atomicfile.PreallocKeepSize, atomicfile.PreallocExtend, atomicfile.PreallocZeroRange} {
+		name := filepath.Join(dir, "file")
+		err := atomicfile.Create(name,
+			atomicfile.Contents(struct{ io.Reader }{bytes.NewReader(contents)}),
+			atomicfile.PreallocateChunks(4096),
+			atomicfile.PreallocateMode(mode),
+			atomicfile.Replace(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, name, string(contents))
+	}
+	checkDirEntries(t, dir, "file")
+
+	if err := atomicfile.Create(filepath.Join(dir, "other"), atomicfile.PreallocateChunks(0)); err == nil {
+		t.Fatal("invalid chunk size accepted")
+	}
+}
@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReplaceIf is like Replace, but the target file is replaced only if it
+// exists and all the specified preconditions hold: otherwise the target file
+// is left untouched and ErrPreconditionFailed is returned. This allows
+// concurrent writers to detect conflicting updates (optimistic concurrency).
+// The preconditions are checked immediately before the new file is renamed
+// over the target file, but the check and the rename are not atomic: a
+// concurrent update of the target file between them goes undetected, and is
+// lost. Concurrent writers must therefore also serialize their updates with
+// WithLockfile, using the same lock file, for ReplaceIf to reliably detect
+// conflicting updates. ReplaceIf can be specified multiple times.
+func ReplaceIf(preconditions ...Precondition) Option {
+	return optionFunc(func(c *config) error {
+		for _, p := range preconditions {
+			if p == nil {
+				return &werror{"invalid precondition", nil}
+			}
+		}
+		c.replace = true
+		c.preconditions = append(c.preconditions, preconditions...)
+		return nil
+	})
+}
+
+// checkPreconditions returns ErrPreconditionFailed if name in the directory
+// dirfd does not exist or if any of the preconditions does not hold for it.
+func checkPreconditions(dirfd int, name string, preconditions []Precondition) error {
+	f, err := openAt(dirfd, name, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if errors.Is(err, unix.ENOENT) {
+		return ErrPreconditionFailed
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	for _, p := range preconditions {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		ok, err := p.holds(f, fi)
+		if err != nil {
+			return err
+		} else if !ok {
+			return ErrPreconditionFailed
+		}
+	}
+	return nil
+}
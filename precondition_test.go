@@ -0,0 +1,128 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestReplaceIf(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	// the target file must exist
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("new"))),
+		atomicfile.ReplaceIf(atomicfile.IfSize(0)),
+	)
+	if !errors.Is(err, atomicfile.ErrPreconditionFailed) {
+		t.Fatalf("expected an error wrapping ErrPreconditionFailed, got %v", err)
+	}
+	checkDirEntries(t, dir)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	reset := func() {
+		writeFile(t, name, "old")
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldSum := sha256.Sum256([]byte("old"))
+	for _, tc := range []struct {
+		name  string
+		conds []atomicfile.Precondition
+		holds bool
+	}{
+		{"size", []atomicfile.Precondition{atomicfile.IfSize(4)}, false},
+		{"modtime", []atomicfile.Precondition{atomicfile.IfModTime(mtime.Add(-time.Second))}, false},
+		{"sum", []atomicfile.Precondition{atomicfile.IfSum(crypto.SHA256, make([]byte, sha256.Size))}, false},
+		{"some", []atomicfile.Precondition{atomicfile.IfSize(3), atomicfile.IfSize(4)}, false},
+		{"size", []atomicfile.Precondition{atomicfile.IfSize(3)}, true},
+		{"modtime", []atomicfile.Precondition{atomicfile.IfModTime(mtime)}, true},
+		{"sum", []atomicfile.Precondition{atomicfile.IfSum(crypto.SHA256, oldSum[:])}, true},
+		{"all", []atomicfile.Precondition{atomicfile.IfSize(3), atomicfile.IfSum(crypto.SHA256, oldSum[:])}, true},
+	} {
+		reset()
+		err := atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader([]byte("new"))),
+			atomicfile.ReplaceIf(tc.conds...),
+		)
+		if tc.holds {
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			checkFile(t, name, "new")
+		} else {
+			if !errors.Is(err, atomicfile.ErrPreconditionFailed) {
+				t.Fatalf("%s: expected an error wrapping ErrPreconditionFailed, got %v", tc.name, err)
+			}
+			checkFile(t, name, "old")
+		}
+		checkDirEntries(t, dir, "file")
+	}
+	if err := atomicfile.Create(name, atomicfile.ReplaceIf(nil)); err == nil {
+		t.Fatal("nil precondition accepted")
+	}
+}
+
+func TestReplaceIfConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "counter")
+	lock := filepath.Join(dir, "lock")
+	writeFile(t, name, "0")
+
+	// each writer increments the counter, retrying on conflicts: with
+	// WithLockfile no increment is lost
+	const writers, increments = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; {
+				buf, err := os.ReadFile(name)
+				if err != nil {
+					errs <- err
+					return
+				}
+				n, err := strconv.Atoi(string(buf))
+				if err != nil {
+					errs <- err
+					return
+				}
+				sum := sha256.Sum256(buf)
+				err = atomicfile.Create(name,
+					atomicfile.Contents(bytes.NewReader([]byte(strconv.Itoa(n+1)))),
+					atomicfile.ReplaceIf(atomicfile.IfSum(crypto.SHA256, sum[:])),
+					atomicfile.WithLockfile(lock, -1),
+				)
+				if errors.Is(err, atomicfile.ErrPreconditionFailed) {
+					continue
+				} else if err != nil {
+					errs <- err
+					return
+				}
+				j++
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	checkFile(t, name, strconv.Itoa(writers*increments))
+}
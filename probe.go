@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Probe reports the capabilities of the filesystem containing dir, so that
+// applications can adapt their behavior (or warn) at startup instead of
+// failing when creating the first file. Probe creates (and removes) a few
+// small temporary files in dir, so dir must be writable.
+func Probe(dir string) (Capabilities, error) {
+	var caps Capabilities
+	d, err := openAt(unix.AT_FDCWD, dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	if err != nil {
+		return caps, &werror{"opening directory", err}
+	}
+	defer d.Close()
+	dirfd := int(d.Fd())
+
+	fd, err := unix.Openat(dirfd, ".", unix.O_TMPFILE|unix.O_RDWR|unix.O_CLOEXEC, 0o600)
+	if err == nil {
+		caps.TmpFile = true
+		_ = unix.Close(fd)
+	} else if !isUnsupported(err) && err != unix.EISDIR {
+		return caps, &werror{"probing O_TMPFILE", err}
+	}
+
+	// the other capabilities are probed on named files, so that they do not
+	// depend on the support for O_TMPFILE
+	var names [2]string
+	var files [2]*os.File
+	for i := range files {
+		if names[i], err = tempName("atomicfile-probe"); err != nil {
+			return caps, &werror{"generating temporary name", err}
+		}
+		files[i], err = openAt(dirfd, names[i], os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return caps, &werror{"creating temporary file", err}
+		}
+		defer files[i].Close()
+		defer unix.Unlinkat(dirfd, names[i], 0)
+	}
+	src, dst := files[0], files[1]
+
+	err = unix.Fallocate(int(src.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, 4096)
+	if caps.Fallocate, err = probeResult(err); err != nil {
+		return caps, &werror{"probing fallocate", err}
+	}
+
+	err = unix.Fsetxattr(int(src.Fd()), "user.atomicfile.probe", []byte{1}, 0)
+	if caps.Xattrs, err = probeResult(err); err != nil {
+		return caps, &werror{"probing xattrs", err}
+	}
+
+	if _, err := src.Write(make([]byte, 4096)); err != nil {
+		return caps, &werror{"writing temporary file", err}
+	}
+	err = unix.IoctlFileCloneRange(int(dst.Fd()), &unix.FileCloneRange{Src_fd: int64(src.Fd())})
+	if err == unix.EBADF {
+		// returned by some filesystems that do not support cloning
+		err = unix.EOPNOTSUPP
+	}
+	if caps.Reflink, err = probeResult(err); err != nil {
+		return caps, &werror{"probing reflink", err}
+	}
+
+	if caps.Verity, err = probeVerity(dirfd); err != nil {
+		return caps, &werror{"probing fs-verity", err}
+	}
+
+	err = unix.Renameat2(dirfd, names[0], dirfd, names[1], unix.RENAME_NOREPLACE)
+	if err == unix.EEXIST {
+		err = nil
+	}
+	if caps.RenameNoReplace, err = probeResult(err); err != nil {
+		return caps, &werror{"probing RENAME_NOREPLACE", err}
+	}
+
+	err = unix.Renameat2(dirfd, names[0], dirfd, names[1], unix.RENAME_EXCHANGE)
+	if caps.RenameExchange, err = probeResult(err); err != nil {
+		return caps, &werror{"probing RENAME_EXCHANGE", err}
+	}
+
+	return caps, nil
+}
+
+// probeVerity reports whether fs-verity can be enabled on the files in the
+// directory dirfd, by enabling it on a new empty file. Filesystems that
+// support fs-verity fail with EOPNOTSUPP if the feature is not enabled on
+// the filesystem itself (e.g. with tune2fs -O verity).
+func probeVerity(dirfd int) (bool, error) {
+	name, err := tempName("atomicfile-probe")
+	if err != nil {
+		return false, err
+	}
+	f, err := openAt(dirfd, name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return false, err
+	}
+	defer unix.Unlinkat(dirfd, name, 0)
+	_ = f.Close()
+	// fs-verity can be enabled only on files that are not open for writing
+	f, err = openAt(dirfd, name, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	arg := unix.FsverityEnableArg{
+		Version:        1,
+		Hash_algorithm: unix.FS_VERITY_HASH_ALG_SHA256,
+		Block_size:     uint32(os.Getpagesize()),
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_ENABLE_VERITY, uintptr(unsafe.Pointer(&arg)))
+	if errno == unix.ENOPKG {
+		// the hash algorithm is not available in the kernel
+		errno = unix.EOPNOTSUPP
+	}
+	return probeResult(errnoErr(errno))
+}
+
+// probeResult reports whether a capability is supported, given the error
+// returned when using it. Errors that do not mean that the capability is
+// not supported are returned.
+func probeResult(err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	} else if isUnsupported(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// isUnsupported reports whether err is returned by a system call that is
+// not supported by the kernel or by the filesystem.
+func isUnsupported(err error) bool {
+	switch err {
+	case unix.EOPNOTSUPP, unix.ENOTTY, unix.EINVAL, unix.ENOSYS, unix.EXDEV:
+		return true
+	}
+	return false
+}
+
+// errnoErr returns nil if errno is 0, and errno otherwise.
+func errnoErr(errno unix.Errno) error {
+	if errno == 0 {
+		return nil
+	}
+	return errno
+}
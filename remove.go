@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+	"path"
+)
+
+// Remove removes the specified file (or empty directory), and then fsyncs
+// the directory containing it so that the removal is durable once Remove
+// returns.
+// No options are currently honored by Remove: it fails if any is specified.
+func Remove(name string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	if err := checkHonored("Remove", cfg, nil); err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if err != nil {
+		return &werror{"removing file", err}
+	}
+
+	if err := syncDir(path.Dir(name)); err != nil {
+		return &werror{"fsync directory", err}
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build linux || freebsd || netbsd || openbsd || solaris || js || plan9
+// +build linux freebsd netbsd openbsd solaris js plan9
+
+package atomicfile_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestRemove(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "file"), "data")
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "full"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "full", "file"), "data")
+
+	for _, name := range []string{"file", "empty"} {
+		if err := atomicfile.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkDirEntries(t, dir, "full")
+
+	if err := atomicfile.Remove(filepath.Join(dir, "full")); err == nil {
+		t.Fatal("non-empty directory removed")
+	}
+	err := atomicfile.Remove(filepath.Join(dir, "missing"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected an error wrapping os.ErrNotExist, got %v", err)
+	}
+	checkDirEntries(t, dir, "full")
+}
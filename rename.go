@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rename atomically renames oldpath to newpath, and then fsyncs the
+// directories containing them (both of them, if they differ) so that the
+// rename is durable once Rename returns.
+// If the NoReplace option is specified, Rename fails if newpath already exists.
+// Only the NoReplace option is honored: Rename fails if any other option is
+// specified.
+func Rename(oldpath, newpath string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	err = checkHonored("Rename", cfg, func(c *config) { c.noReplace = false })
+	if err != nil {
+		return err
+	}
+
+	err = rename(oldpath, newpath, cfg.noReplace)
+	if err != nil {
+		return &werror{"renaming file", err}
+	}
+
+	newdir := path.Dir(newpath)
+	if err := syncDir(newdir); err != nil {
+		return &werror{"fsync directory", err}
+	}
+	if olddir := path.Dir(oldpath); olddir != newdir {
+		if err := syncDir(olddir); err != nil {
+			return &werror{"fsync directory", err}
+		}
+	}
+
+	return nil
+}
+
+// Swap atomically exchanges path1 and path2, that must both exist, and then
+// fsyncs the directories containing them (both of them, if they differ) so
+// that the exchange is durable once Swap returns.
+// Not all filesystems and kernel versions support exchanging files (see
+// Capabilities.RenameExchange).
+// No options are currently honored by Swap: it fails if any is specified.
+func Swap(path1, path2 string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	if err := checkHonored("Swap", cfg, nil); err != nil {
+		return err
+	}
+
+	err = unix.Renameat2(unix.AT_FDCWD, path1, unix.AT_FDCWD, path2, unix.RENAME_EXCHANGE)
+	if err != nil {
+		return &werror{"exchanging files", &os.LinkError{Op: "exchange", Old: path1, New: path2, Err: err}}
+	}
+
+	dir2 := path.Dir(path2)
+	if err := syncDir(dir2); err != nil {
+		return &werror{"fsync directory", err}
+	}
+	if dir1 := path.Dir(path1); dir1 != dir2 {
+		if err := syncDir(dir1); err != nil {
+			return &werror{"fsync directory", err}
+		}
+	}
+
+	return nil
+}
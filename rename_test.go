@@ -0,0 +1,90 @@
+//go:build linux || freebsd || netbsd || openbsd || solaris || js || plan9
+// +build linux freebsd netbsd openbsd solaris js plan9
+
+package atomicfile_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestRename(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "a"), "a")
+	writeFile(t, filepath.Join(dir, "b"), "b")
+
+	// the target file is replaced by default
+	if err := atomicfile.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "b"), "a")
+	checkDirEntries(t, dir, "b", "sub")
+
+	// across directories
+	if err := atomicfile.Rename(filepath.Join(dir, "b"), filepath.Join(sub, "c")); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(sub, "c"), "a")
+	checkDirEntries(t, dir, "sub")
+
+	err := atomicfile.Rename(filepath.Join(dir, "missing"), filepath.Join(dir, "d"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected an error wrapping os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a"), "a")
+	writeFile(t, filepath.Join(dir, "b"), "b")
+
+	err := atomicfile.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b"), atomicfile.NoReplace())
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+	}
+	checkFile(t, filepath.Join(dir, "a"), "a")
+	checkFile(t, filepath.Join(dir, "b"), "b")
+
+	err = atomicfile.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "c"), atomicfile.NoReplace())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "c"), "a")
+	checkDirEntries(t, dir, "b", "c")
+}
+
+func TestUnhonoredOptions(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	writeFile(t, a, "a")
+	writeFile(t, b, "b")
+
+	for _, opt := range []atomicfile.Option{atomicfile.Replace(), atomicfile.Permissions(0o600)} {
+		if err := atomicfile.Rename(a, filepath.Join(dir, "c"), opt); err == nil {
+			t.Fatal("Rename accepted an option it does not honor")
+		}
+		if err := atomicfile.Swap(a, b, opt); err == nil {
+			t.Fatal("Swap accepted an option it does not honor")
+		}
+		if err := atomicfile.Remove(a, opt); err == nil {
+			t.Fatal("Remove accepted an option it does not honor")
+		}
+		if err := atomicfile.Symlink("a", filepath.Join(dir, "link"), opt); err == nil {
+			t.Fatal("Symlink accepted an option it does not honor")
+		}
+	}
+	if err := atomicfile.Remove(a, atomicfile.Fsync()); err == nil {
+		t.Fatal("Remove accepted an option it does not honor")
+	}
+	checkFile(t, a, "a")
+	checkFile(t, b, "b")
+	checkDirEntries(t, dir, "a", "b")
+}
@@ -0,0 +1,182 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// SecureResolve makes Create and CreateAt open the directory containing the
+// target file using openat2 with RESOLVE_NO_SYMLINKS and RESOLVE_BENEATH, so
+// that the resolution of its path fails if it involves symbolic links, or if
+// it escapes (e.g. via ".." components) the directory passed to CreateAt, or
+// the current working directory for relative paths passed to Create.
+// Absolute paths passed to Create are resolved beneath the root directory,
+// while absolute paths passed to CreateAt are rejected.
+// As the target file itself is never followed when linked, this prevents
+// redirection attacks when writing into directories that can be influenced
+// by untrusted users.
+// SecureResolve requires Linux >= 5.6: on older kernels Create fails.
+func SecureResolve() Option {
+	return optionFunc(func(c *config) error {
+		c.secureResolve = true
+		return nil
+	})
+}
+
+// openBeneath opens the directory name, resolved relative to dirfd, without
+// following symbolic links and without escaping dirfd. If dirfd is
+// AT_FDCWD, absolute paths are resolved relative to the root directory.
+func openBeneath(dirfd int, name string) (*os.File, error) {
+	if dirfd == unix.AT_FDCWD && strings.HasPrefix(name, "/") {
+		root, err := openAt(unix.AT_FDCWD, "/", unix.O_DIRECTORY|os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer root.Close()
+		rel := strings.TrimLeft(name, "/")
+		if rel == "" {
+			rel = "."
+		}
+		return openBeneath(int(root.Fd()), rel)
+	}
+
+	how := &unix.OpenHow{
+		Flags:   unix.O_DIRECTORY | unix.O_RDONLY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_BENEATH,
+	}
+	for {
+		fd, err := unix.Openat2(dirfd, name, how)
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: "openat2", Path: name, Err: err}
+		}
+		return os.NewFile(uintptr(fd), name), nil
+	}
+}
+
+// NoForeignSymlinks makes Create, CreateAt and CreateInRoot fail with an
+// UnsafePathError if any component of the path of the directory containing
+// the target file is a symbolic link owned by a user other than root or the
+// effective user of the process, as such symbolic links could be used by
+// other users to redirect the target file (e.g. in world-writable
+// directories like /tmp).
+// For relative paths passed to CreateAt and CreateInRoot, only the
+// components of the path itself are checked.
+// After the checks, the directory is verified to be the one that was opened
+// to create the target file.
+func NoForeignSymlinks() Option {
+	return optionFunc(func(c *config) error {
+		c.noForeignLinks = true
+		return nil
+	})
+}
+
+// RequireDirOwner makes Create, CreateAt and CreateInRoot fail with an
+// UnsafePathError if the directory containing the target file is not owned
+// by uid. The check is performed immediately before the target file is
+// linked in the directory.
+func RequireDirOwner(uid int) Option {
+	return optionFunc(func(c *config) error {
+		if c.dirOwner != defaultConfig().dirOwner {
+			return &werror{"multiple directory owners", nil}
+		}
+		if uid < 0 {
+			return &werror{"invalid directory owner", nil}
+		}
+		c.dirOwner = uid
+		return nil
+	})
+}
+
+// RequireDirMode makes Create, CreateAt and CreateInRoot fail with an
+// UnsafePathError if the directory containing the target file has any
+// permission bit that is not set in mask (e.g. RequireDirMode(0o755) rejects
+// directories writable by users other than their owner, while
+// RequireDirMode(0o777|os.ModeSticky) also accepts world-writable directories
+// that have the sticky bit set, like /tmp). The check is performed
+// immediately before the target file is linked in the directory.
+// Note that world-writable directories are accepted only if they have the
+// sticky bit set, even if mask includes the write permission bits.
+func RequireDirMode(mask os.FileMode) Option {
+	return optionFunc(func(c *config) error {
+		if c.dirMode != defaultConfig().dirMode {
+			return &werror{"multiple directory modes", nil}
+		}
+		c.dirMode = unixMode(mask)
+		return nil
+	})
+}
+
+// checkDir returns an UnsafePathError if the directory d does not satisfy the
+// requirements specified with RequireDirOwner and RequireDirMode.
+func checkDir(d *os.File, dir string, cfg *config) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(d.Fd()), &st); err != nil {
+		return err
+	}
+	if cfg.dirOwner != defaultConfig().dirOwner && int(st.Uid) != cfg.dirOwner {
+		return &UnsafePathError{dir, "directory owned by another user"}
+	}
+	if cfg.dirMode != defaultConfig().dirMode {
+		mode := st.Mode & 0o7777
+		if mode&^cfg.dirMode != 0 {
+			return &UnsafePathError{dir, "directory permissions not allowed"}
+		}
+		if mode&0o002 != 0 && mode&unix.S_ISVTX == 0 {
+			return &UnsafePathError{dir, "world-writable directory without sticky bit"}
+		}
+	}
+	return nil
+}
+
+// checkForeignSymlinks returns an UnsafePathError if any of the components
+// of dir, resolved relative to dirfd, is a symbolic link owned by a user
+// other than root or the effective user, or if dir does not refer to d.
+func checkForeignSymlinks(dirfd int, dir string, d *os.File) error {
+	if dirfd == unix.AT_FDCWD && !filepath.IsAbs(dir) {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		dir = abs
+	}
+
+	euid := os.Geteuid()
+	prefix := ""
+	if strings.HasPrefix(dir, "/") {
+		prefix = "/"
+	}
+	for _, c := range strings.Split(dir, "/") {
+		if c == "" || c == "." {
+			continue
+		}
+		prefix += c
+		var st unix.Stat_t
+		if err := unix.Fstatat(dirfd, prefix, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return &os.PathError{Op: "lstat", Path: prefix, Err: err}
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFLNK && int(st.Uid) != euid && st.Uid != 0 {
+			return &UnsafePathError{prefix, "symbolic link owned by another user"}
+		}
+		prefix += "/"
+	}
+
+	var st, dst unix.Stat_t
+	if err := unix.Fstatat(dirfd, dir, &st, 0); err != nil {
+		return &os.PathError{Op: "stat", Path: dir, Err: err}
+	}
+	if err := unix.Fstat(int(d.Fd()), &dst); err != nil {
+		return err
+	}
+	if st.Dev != dst.Dev || st.Ino != dst.Ino {
+		return &UnsafePathError{dir, "directory changed while checking"}
+	}
+	return nil
+}
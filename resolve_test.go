@@ -0,0 +1,133 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestSecureResolve(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	err = atomicfile.CreateAt(d, "sub/file", atomicfile.SecureResolve())
+	if err != nil {
+		t.Skipf("openat2 not supported: %v", err)
+	}
+	checkFile(t, filepath.Join(dir, "sub", "file"), "")
+	if err := atomicfile.Create(filepath.Join(dir, "sub", "abs"), atomicfile.SecureResolve()); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "sub", "abs"), "")
+
+	for _, name := range []string{"link/file", "../file", "sub/../../file", filepath.Join(dir, "sub", "file2")} {
+		if err := atomicfile.CreateAt(d, name, atomicfile.SecureResolve()); err == nil {
+			t.Fatalf("%s: path resolved", name)
+		}
+	}
+	if err := atomicfile.Create(filepath.Join(dir, "link", "file"), atomicfile.SecureResolve()); err == nil {
+		t.Fatal("symbolic link followed")
+	}
+	checkDirEntries(t, outside)
+}
+
+func TestNoForeignSymlinks(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of symbolic links requires root")
+	}
+	dir := t.TempDir()
+	target := t.TempDir()
+	if err := os.Symlink(target, filepath.Join(dir, "own")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, "foreign")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Lchown(filepath.Join(dir, "foreign"), 12345, 12345); err != nil {
+		t.Fatal(err)
+	}
+
+	err := atomicfile.Create(filepath.Join(dir, "own", "file"), atomicfile.NoForeignSymlinks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(target, "file"), "")
+
+	err = atomicfile.Create(filepath.Join(dir, "foreign", "file2"), atomicfile.NoForeignSymlinks())
+	var uerr *atomicfile.UnsafePathError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected an UnsafePathError, got %v", err)
+	}
+	checkDirEntries(t, target, "file")
+
+	// without the option the symbolic link is followed
+	if err := atomicfile.Create(filepath.Join(dir, "foreign", "file2")); err != nil {
+		t.Fatal(err)
+	}
+	checkDirEntries(t, target, "file", "file2")
+}
+
+func TestRequireDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o775); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "file")
+	var uerr *atomicfile.UnsafePathError
+
+	err := atomicfile.Create(name, atomicfile.RequireDirOwner(os.Geteuid()+1))
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected an UnsafePathError, got %v", err)
+	}
+	err = atomicfile.Create(name, atomicfile.RequireDirMode(0o755))
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected an UnsafePathError, got %v", err)
+	}
+	checkDirEntries(t, dir)
+
+	err = atomicfile.Create(name, atomicfile.RequireDirOwner(os.Geteuid()), atomicfile.RequireDirMode(0o775))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDirEntries(t, dir, "file")
+
+	// world-writable directories are accepted only with the sticky bit
+	if err := os.Chmod(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	err = atomicfile.Create(name, atomicfile.Replace(), atomicfile.RequireDirMode(0o777|os.ModeSticky))
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected an UnsafePathError, got %v", err)
+	}
+	if err := os.Chmod(dir, 0o777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	err = atomicfile.Create(name, atomicfile.Replace(), atomicfile.RequireDirMode(0o777|os.ModeSticky))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := atomicfile.Create(name, atomicfile.RequireDirOwner(-1)); err == nil {
+		t.Fatal("invalid owner accepted")
+	}
+	if err := atomicfile.Create(name, atomicfile.RequireDirOwner(0), atomicfile.RequireDirOwner(0)); err == nil {
+		t.Fatal("multiple owners accepted")
+	}
+}
@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// Retry makes Create retry the creation of the temporary file, and its
+// population, when they fail because of a transient error (EINTR, EAGAIN,
+// ESTALE and, if requested by the policy, ENOSPC and EDQUOT). The temporary
+// file of the failed attempt is discarded before retrying.
+// As the contents need to be read again, failures are retried only if the
+// reader passed to Contents implements io.Seeker: the reader is rewound to
+// its initial offset before retrying.
+// The linking of the target file (and its renaming, if Replace is specified)
+// is never retried, as it may have taken effect even if an error was
+// reported (e.g. on NFS), so retrying it could publish the file twice.
+func Retry(policy RetryPolicy) Option {
+	return optionFunc(func(c *config) error {
+		if c.retry != defaultConfig().retry {
+			return &werror{"multiple retry policies", nil}
+		}
+		if policy.Attempts < 1 || policy.Backoff < 0 || policy.MaxBackoff < 0 {
+			return &werror{"invalid retry policy", nil}
+		}
+		c.retry = policy
+		return nil
+	})
+}
+
+// retryable reports whether err is a transient error that should be retried
+// according to the policy.
+func (p RetryPolicy) retryable(err error) bool {
+	if errors.Is(err, ErrNoSpace) {
+		return p.NoSpace
+	}
+	var errno unix.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case unix.EINTR, unix.EAGAIN, unix.ESTALE:
+		return true
+	case unix.ENOSPC, unix.EDQUOT:
+		return p.NoSpace
+	}
+	return false
+}
+
+// stage is like stageOnce, but retries transient failures as specified
+// with Retry.
+func stage(dirfd int, filename string, cfg config) (*Pending, error) {
+	if cfg.retry.Attempts <= 1 {
+		return stageOnce(dirfd, filename, cfg)
+	}
+
+	seeker, _ := cfg.contents.(io.Seeker)
+	var offset int64
+	if seeker != nil {
+		var err error
+		if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+
+	delay := cfg.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		p, err := stageOnce(dirfd, filename, cfg)
+		if err == nil || attempt >= cfg.retry.Attempts || !cfg.retry.retryable(err) {
+			return p, err
+		}
+		if cfg.contents != nil {
+			if seeker == nil {
+				return nil, err
+			}
+			if _, serr := seeker.Seek(offset, io.SeekStart); serr != nil {
+				return nil, err
+			}
+		}
+		cfg.resetHashes()
+		cfg.debug("retrying after transient error", "attempt", attempt, "delay", delay, "error", err)
+
+		if err := cfg.sleep(delay); err != nil {
+			return nil, err
+		}
+		delay *= 2
+		if cfg.retry.MaxBackoff > 0 && delay > cfg.retry.MaxBackoff {
+			delay = cfg.retry.MaxBackoff
+		}
+	}
+}
+
+// resetHashes resets the hashes that are fed the contents, so that they can
+// be populated again.
+func (c *config) resetHashes() {
+	for _, h := range c.hashes {
+		h.Reset()
+	}
+	for _, s := range c.checksums {
+		s.h.Reset()
+	}
+	for _, s := range c.checksumXattrs {
+		s.h.Reset()
+	}
+}
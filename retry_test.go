@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+// flakyReader is an io.ReadSeeker that fails with err the first fails times
+// it is read past offset.
+type flakyReader struct {
+	r      *bytes.Reader
+	offset int64
+	fails  int
+	err    error
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	pos, _ := r.r.Seek(0, io.SeekCurrent)
+	if pos >= r.offset && r.fails > 0 {
+		r.fails--
+		return 0, r.err
+	}
+	if n := r.offset - pos; n > 0 && int64(len(p)) > n {
+		p = p[:n]
+	}
+	return r.r.Read(p)
+}
+
+func (r *flakyReader) Seek(offset int64, whence int) (int64, error) {
+	return r.r.Seek(offset, whence)
+}
+
+func TestRetry(t *testing.T) {
+	dir := t.TempDir()
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+
+	name := filepath.Join(dir, "retried")
+	r := &flakyReader{r: bytes.NewReader(contents), offset: 5000, fails: 2, err: syscall.EAGAIN}
+	err := atomicfile.Create(name,
+		atomicfile.Contents(r),
+		atomicfile.Retry(atomicfile.RetryPolicy{Attempts: 3, Backoff: time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, string(contents))
+
+	name = filepath.Join(dir, "exhausted")
+	r = &flakyReader{r: bytes.NewReader(contents), offset: 5000, fails: 3, err: syscall.EAGAIN}
+	err = atomicfile.Create(name,
+		atomicfile.Contents(r),
+		atomicfile.Retry(atomicfile.RetryPolicy{Attempts: 3, Backoff: time.Millisecond}),
+	)
+	if !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("expected an error wrapping EAGAIN, got %v", err)
+	}
+
+	name = filepath.Join(dir, "permanent")
+	r = &flakyReader{r: bytes.NewReader(contents), offset: 5000, fails: 1, err: syscall.EIO}
+	err = atomicfile.Create(name,
+		atomicfile.Contents(r),
+		atomicfile.Retry(atomicfile.RetryPolicy{Attempts: 3, Backoff: time.Millisecond}),
+	)
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected an error wrapping EIO, got %v", err)
+	}
+	checkDirEntries(t, dir, "retried")
+
+	err = atomicfile.Create(name, atomicfile.Retry(atomicfile.RetryPolicy{Attempts: 0}))
+	if err == nil {
+		t.Fatal("invalid retry policy accepted")
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux && go1.24
+// +build linux,go1.24
+
+package atomicfile
+
+import (
+	"os"
+	"path"
+	"runtime"
+)
+
+// CreateInRoot is like Create, but name is resolved inside root, so that the
+// target file can not be created outside of it (e.g. by following symbolic
+// links or ".." path components): the directory containing the target file
+// is opened through root, and the target file is then created relative to it
+// as done by CreateAt. All options are honored.
+func CreateInRoot(root *os.Root, name string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+
+	dir, base := path.Split(name)
+	if base == "" || base == "." || base == ".." {
+		return &werror{"invalid file name", nil}
+	}
+	if dir == "" {
+		dir = "."
+	}
+	d, err := root.Open(dir)
+	if err != nil {
+		return &werror{"opening directory", err}
+	}
+	defer d.Close()
+
+	err = create(int(d.Fd()), base, cfg)
+	runtime.KeepAlive(d)
+	return err
+}
+
+// RootFS returns a WriteFS that creates files inside root, as CreateInRoot
+// does.
+func RootFS(root *os.Root) WriteFS {
+	return rootFS{root}
+}
+
+type rootFS struct {
+	root *os.Root
+}
+
+func (r rootFS) WriteFile(name string, options ...Option) error {
+	return CreateInRoot(r.root, name, options...)
+}
@@ -0,0 +1,62 @@
+//go:build linux && go1.24
+// +build linux,go1.24
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestCreateInRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	err = atomicfile.CreateInRoot(root, "sub/file", atomicfile.Contents(bytes.NewReader([]byte("hello"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "sub", "file"), "hello")
+
+	for _, name := range []string{"../file", "escape/file", "/file", "sub/..", "sub/"} {
+		if err := atomicfile.CreateInRoot(root, name); err == nil {
+			t.Fatalf("%s: file created outside of the root", name)
+		}
+	}
+	checkDirEntries(t, outside)
+	checkDirEntries(t, dir, "escape", "sub")
+}
+
+func TestRootFS(t *testing.T) {
+	dir := t.TempDir()
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	fsys := atomicfile.RootFS(root)
+	if err := fsys.WriteFile("file", atomicfile.Contents(bytes.NewReader([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "file"), "hello")
+	if err := fsys.WriteFile("../file"); err == nil {
+		t.Fatal("file created outside of the root")
+	}
+	checkDirEntries(t, dir, "file")
+}
@@ -0,0 +1,20 @@
+//go:build linux && go1.21
+// +build linux,go1.21
+
+package atomicfile
+
+import "log/slog"
+
+// WithLogger makes Create emit debug logs through l, describing the choices
+// made while creating the target file (e.g. the mechanism used to populate
+// it, or the fallbacks taken when some feature is not supported by the
+// kernel or filesystem). A nil l disables logging.
+func WithLogger(l *slog.Logger) Option {
+	return optionFunc(func(c *config) error {
+		c.logger = nil
+		if l != nil {
+			c.logger = l
+		}
+		return nil
+	})
+}
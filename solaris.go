@@ -0,0 +1,61 @@
+//go:build solaris
+// +build solaris
+
+package atomicfile
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const utimeOmit = unix.UTIME_OMIT
+
+// illumos and Solaris do not support chflags, so no file flags are set after
+// the target file has been linked.
+const lateInodeFlags = 0
+
+// InodeFlags is not supported on this platform: it always fails with
+// ErrUnsupported.
+func InodeFlags(set, clear uint32) Option {
+	return unsupported("InodeFlags")
+}
+
+// Immutable is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Immutable() Option {
+	return unsupported("Immutable")
+}
+
+// setFileFlags fails, as InodeFlags is not supported.
+func setFileFlags(fd int, set, clear uint32) error {
+	return ErrUnsupported
+}
+
+// linkAt links the file oldname as newname, both in the directory dirfd
+// (whose path is dir). As linkat is not available, the names are resolved
+// relative to dir instead.
+func linkAt(dirfd int, dir, oldname, newname string) error {
+	return unix.Link(path.Join(dir, oldname), path.Join(dir, newname))
+}
+
+// setExtattr sets the extended attribute name on the file fd, like
+// attropen(3C) does, by creating it in the extended attribute directory of
+// the file. Extended attributes do not have namespaces, so only the names in
+// the "user." namespace are supported, without the prefix.
+func setExtattr(fd int, name string, value []byte) error {
+	if !strings.HasPrefix(name, "user.") {
+		return unix.EOPNOTSUPP
+	}
+	f, err := openAt(fd, strings.TrimPrefix(name, "user."), unix.O_XATTR|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
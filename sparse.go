@@ -0,0 +1,144 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sparse makes Create store the target file sparsely, like
+// `cp --sparse=always`: blocks of the contents that contain only zeros are
+// not written, leaving holes in the target file. If the reader passed to
+// Contents is a regular file, its holes are detected with SEEK_DATA and
+// SEEK_HOLE, so that they don't need to be read.
+// Sparse disables the preallocation of the target file based on the size of
+// the contents, and the use of copy_file_range and splice, as they do not
+// create holes; cloning the contents (that preserves their holes) is still
+// used when supported by the filesystem.
+func Sparse() Option {
+	return optionFunc(func(c *config) error {
+		c.sparse = true
+		return nil
+	})
+}
+
+// sparseBlock is the size of the blocks that are checked for zeros.
+const sparseBlock = 4096
+
+var zeroBlock [sparseBlock]byte
+
+// writeFile writes b to the file at its current offset. If p.sparse is set,
+// the blocks of b that contain only zeros are skipped instead of being
+// written (the size of the file is adjusted by populateFile at the end).
+func (p *populator) writeFile(b []byte) (int, error) {
+	if !p.sparse {
+		return p.f.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		// find the run of data, or of zero blocks, at the start of b
+		off := p.written + int64(written)
+		n := sparseBlock - int(off%sparseBlock)
+		if n > len(b) {
+			n = len(b)
+		}
+		zero := n == sparseBlock && bytes.Equal(b[:n], zeroBlock[:])
+		for n < len(b) {
+			m := len(b) - n
+			if m > sparseBlock {
+				m = sparseBlock
+			}
+			if z := m == sparseBlock && bytes.Equal(b[n:n+m], zeroBlock[:]); z != zero {
+				break
+			}
+			n += m
+		}
+
+		if zero {
+			if _, err := p.f.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else {
+			m, err := p.f.Write(b[:n])
+			if err != nil {
+				return written + m, err
+			}
+		}
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// sparseFile attempts to populate the file with the remaining contents of
+// src, skipping the holes of src (found with SEEK_DATA and SEEK_HOLE) and the
+// blocks that contain only zeros. If src is not a regular file, or SEEK_DATA
+// is not supported, handled is false and no data has been copied.
+func (p *populator) sparseFile(src *os.File) (handled bool, err error) {
+	pos, size := remaining(src)
+	if pos >= size || (p.limit >= 0 && size-pos > p.limit-p.written) {
+		return false, nil
+	}
+	fd := int(src.Fd())
+	if _, err := unix.Seek(fd, pos, unix.SEEK_DATA); err != nil && err != unix.ENXIO {
+		// SEEK_DATA is not supported (or fails): restore the offset
+		_, _ = src.Seek(pos, io.SeekStart)
+		return false, nil
+	}
+
+	base := p.written
+	buf := make([]byte, defaultCopyBuffer)
+	for off := pos; off < size; {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// no more data: the rest of src is a hole
+			break
+		} else if err != nil {
+			return true, err
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return true, err
+		}
+		if hole > size {
+			hole = size
+		}
+
+		// skip the hole, and copy the data that follows it
+		p.written = base + data - pos
+		if _, err := p.f.Seek(p.written, io.SeekStart); err != nil {
+			return true, err
+		}
+		for off = data; off < hole; {
+			b := buf
+			if rem := hole - off; rem < int64(len(b)) {
+				b = b[:rem]
+			}
+			n, err := src.ReadAt(b, off)
+			if n > 0 {
+				if _, err := p.writeFile(b[:n]); err != nil {
+					return true, err
+				}
+				p.written += int64(n)
+				off += int64(n)
+			}
+			if err == io.EOF {
+				// src has been truncated while copying it
+				hole, size = off, off
+			} else if err != nil {
+				return true, err
+			}
+		}
+	}
+
+	p.written = base + size - pos
+	if _, err := src.Seek(size, io.SeekStart); err != nil {
+		return true, err
+	}
+	return true, nil
+}
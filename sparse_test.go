@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestSparse(t *testing.T) {
+	dir := t.TempDir()
+	const hole = 4 << 20
+	contents := append(append([]byte("head"), make([]byte, hole)...), "tail"...)
+
+	// the contents are read from a reader, so that the blocks of zeros
+	// must be detected, and from a sparse file, whose holes are skipped
+	src := filepath.Join(dir, "src")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(contents[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(contents[4+hole:], 4+hole); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		open func() io.Reader
+	}{
+		{"reader", func() io.Reader { return struct{ io.Reader }{bytes.NewReader(contents)} }},
+		{"file", func() io.Reader {
+			f, err := os.Open(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { f.Close() })
+			return f
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(dir, tc.name)
+			err := atomicfile.Create(name, atomicfile.Contents(tc.open()), atomicfile.Sparse())
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, name, string(contents))
+			var st syscall.Stat_t
+			if err := syscall.Stat(name, &st); err != nil {
+				t.Fatal(err)
+			}
+			if st.Blocks*512 >= hole {
+				t.Fatalf("file uses %d bytes, expected less than %d", st.Blocks*512, hole)
+			}
+		})
+	}
+}
@@ -0,0 +1,547 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithStrategy specifies the mechanism used to stage the temporary file and
+// to publish it as the target file. By default, TmpFileStrategy is used,
+// falling back to RenameStrategy if the filesystem (or the kernel) does not
+// support O_TMPFILE.
+func WithStrategy(s Strategy) Option {
+	return optionFunc(func(c *config) error {
+		if c.strategy != nil {
+			return &werror{"multiple strategies", nil}
+		}
+		if s == nil {
+			return &werror{"invalid strategy", nil}
+		}
+		c.strategy = s
+		return nil
+	})
+}
+
+// stager is implemented by the built-in strategies, that need access to the
+// configuration of the file being created.
+type stager interface {
+	stage(dir *os.File, name string, cfg *config) (Staged, error)
+}
+
+// stageFile creates the temporary file that will be published as name in
+// the directory dir, using the strategy specified in cfg.
+func stageFile(dir *os.File, name string, cfg *config) (Staged, error) {
+	switch s := cfg.strategy.(type) {
+	case nil:
+		if cfg.stageDir != "" {
+			return renameStrategy{}.stage(dir, name, cfg)
+		}
+		if cfg.dirCache.isOverlay(dir) {
+			// depending on the kernel version, O_TMPFILE is not supported
+			// by overlayfs, or linking the unnamed file fails in confusing
+			// ways (e.g. with ENOENT)
+			cfg.debug("overlayfs detected, falling back to a temporary name")
+			return renameStrategy{}.stage(dir, name, cfg)
+		}
+		if cfg.dirCache.has(noTmpFile) {
+			return renameStrategy{}.stage(dir, name, cfg)
+		}
+		staged, err := tmpFileStrategy{}.stage(dir, name, cfg)
+		if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EISDIR) {
+			// kernels that do not support O_TMPFILE fail with EISDIR
+			cfg.debug("O_TMPFILE not supported, falling back to a temporary name", "error", err)
+			cfg.dirCache.set(noTmpFile)
+			return renameStrategy{}.stage(dir, name, cfg)
+		}
+		return staged, err
+	case stager:
+		return s.stage(dir, name, cfg)
+	default:
+		return s.Stage(dir, name)
+	}
+}
+
+// isOverlay reports whether the directory dir is on overlayfs.
+func isOverlay(dir *os.File) bool {
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(int(dir.Fd()), &st); err != nil {
+		return false
+	}
+	return st.Type == unix.OVERLAYFS_SUPER_MAGIC
+}
+
+// dirCache records the mechanisms that stageFile and linkFile found to be
+// unsupported in a directory, so that they are not attempted again for each
+// file created in it (see Creator). A nil *dirCache records nothing.
+type dirCache struct {
+	overlayOnce sync.Once
+	overlay     bool
+	flags       uint32
+}
+
+// The mechanisms recorded by dirCache.
+const (
+	// noTmpFile records that O_TMPFILE is not supported.
+	noTmpFile = 1 << iota
+	// noEmptyPath records that linkat with AT_EMPTY_PATH is not permitted.
+	noEmptyPath
+)
+
+// isOverlay is like the isOverlay function, but it checks the directory only
+// once.
+func (c *dirCache) isOverlay(dir *os.File) bool {
+	if c == nil {
+		return isOverlay(dir)
+	}
+	c.overlayOnce.Do(func() {
+		c.overlay = isOverlay(dir)
+	})
+	return c.overlay
+}
+
+// has reports whether flag has been recorded.
+func (c *dirCache) has(flag uint32) bool {
+	return c != nil && atomic.LoadUint32(&c.flags)&flag != 0
+}
+
+// set records flag.
+func (c *dirCache) set(flag uint32) {
+	if c == nil {
+		return
+	}
+	for {
+		old := atomic.LoadUint32(&c.flags)
+		if atomic.CompareAndSwapUint32(&c.flags, old, old|flag) {
+			return
+		}
+	}
+}
+
+// mechanism is implemented by the files staged by the built-in strategies,
+// to report the mechanism used to create the target file (see Result).
+type mechanism interface {
+	mechanism() BuiltinStrategy
+}
+
+// TmpFileStrategy returns the default Strategy, that stages the contents in
+// an unnamed file created with O_TMPFILE, and publishes it with linkat(2).
+// The temporary file is never visible in the target directory, and it does
+// not need to be removed if Create fails.
+func TmpFileStrategy() Strategy {
+	return tmpFileStrategy{}
+}
+
+// ForceStrategy makes Create use only the specified mechanism, without
+// falling back to the other ones if it is not supported. This is mostly
+// useful to exercise the fallback mechanisms (e.g. in tests) even where the
+// preferred ones are supported.
+// ForceStrategy can not be used together with WithStrategy.
+func ForceStrategy(s BuiltinStrategy) Option {
+	return optionFunc(func(c *config) error {
+		switch s {
+		case StrategyLinkat, StrategyProcLink:
+			return WithStrategy(tmpFileStrategy{mode: s}).apply(c)
+		case StrategyRename:
+			return WithStrategy(renameStrategy{}).apply(c)
+		}
+		return &werror{"invalid strategy", nil}
+	})
+}
+
+// ProcMount specifies the directory where procfs is mounted (by default
+// /proc), that is used to link the temporary file through /proc/self/fd when
+// linkat with AT_EMPTY_PATH is not permitted (see StrategyProcLink).
+func ProcMount(dir string) Option {
+	return optionFunc(func(c *config) error {
+		if dir == "" {
+			return &werror{"invalid procfs mountpoint", nil}
+		} else if c.procMount != "" {
+			return &werror{"multiple procfs mountpoints", nil}
+		}
+		c.procMount = dir
+		return nil
+	})
+}
+
+// NoProcLink disables the fallback that links the temporary file through
+// /proc/self/fd when linkat with AT_EMPTY_PATH is not permitted, e.g. in
+// containers where /proc is not mounted or is masked: in this case Create
+// fails with the error returned by linkat. The mechanism that was used to
+// link the file is reported in Result.Strategy.
+func NoProcLink() Option {
+	return optionFunc(func(c *config) error {
+		c.noProcLink = true
+		return nil
+	})
+}
+
+type tmpFileStrategy struct {
+	// mode, if not 0, is the only mechanism used to link the file.
+	mode BuiltinStrategy
+}
+
+func (s tmpFileStrategy) Stage(dir *os.File, name string) (Staged, error) {
+	cfg := defaultConfig()
+	return s.stage(dir, name, &cfg)
+}
+
+func (s tmpFileStrategy) stage(dir *os.File, name string, cfg *config) (Staged, error) {
+	f, err := openAt(int(dir.Fd()), ".", unix.O_TMPFILE|os.O_RDWR, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	return &tmpFile{f: f, dirfd: int(dir.Fd()), mode: s.mode, cfg: cfg}, nil
+}
+
+// tmpFile is a file staged by TmpFileStrategy.
+type tmpFile struct {
+	f     *os.File
+	dirfd int
+	mode  BuiltinStrategy
+	cfg   *config
+	// used is the mechanism used to link the file.
+	used BuiltinStrategy
+}
+
+func (s *tmpFile) File() *os.File {
+	return s.f
+}
+
+func (s *tmpFile) Link(name string) error {
+	used, err := linkFile(s.f, s.dirfd, name, s.mode, s.cfg)
+	if err == nil {
+		s.used = used
+	}
+	return err
+}
+
+func (s *tmpFile) Replace(name string) error {
+	tmp, err := linkTemp(s, name, s.cfg)
+	if err != nil {
+		return err
+	}
+	err = renameAt(s.dirfd, tmp, name, false)
+	if err != nil {
+		_ = unix.Unlinkat(s.dirfd, tmp, 0)
+	}
+	return err
+}
+
+func (s *tmpFile) Cleanup() error {
+	return nil
+}
+
+func (s *tmpFile) mechanism() BuiltinStrategy {
+	return s.used
+}
+
+// RenameStrategy returns a Strategy that stages the contents in a regular
+// file with a temporary name in the target directory, and publishes it by
+// renaming it, for filesystems that do not support O_TMPFILE. The temporary
+// file is created with restrictive permissions, and it is removed if Create
+// fails; it may be left behind if the process crashes while creating the
+// target file.
+func RenameStrategy() Strategy {
+	return renameStrategy{}
+}
+
+type renameStrategy struct{}
+
+func (s renameStrategy) Stage(dir *os.File, name string) (Staged, error) {
+	cfg := defaultConfig()
+	return s.stage(dir, name, &cfg)
+}
+
+func (renameStrategy) stage(dir *os.File, name string, cfg *config) (_ Staged, err error) {
+	s := &renameFile{dirfd: int(dir.Fd()), tmpdirfd: int(dir.Fd()), tmpdir: dir.Name()}
+	if cfg.stageDir != "" {
+		d, err := openStageDir(dir, cfg.stageDir)
+		if errors.Is(err, unix.EXDEV) {
+			// the file could not be renamed from the staging directory
+			cfg.debug("staging directory on a different filesystem, staging in the target directory", "dir", cfg.stageDir)
+		} else if err != nil {
+			return nil, err
+		} else {
+			s.stageDir, s.tmpdirfd, s.tmpdir = d, int(d.Fd()), cfg.stageDir
+		}
+	}
+	if s.stageDir != nil {
+		defer func() {
+			if err != nil {
+				_ = s.stageDir.Close()
+			}
+		}()
+	}
+
+	for i := 0; ; i++ {
+		tmp, err := cfg.tempName(name)
+		if err != nil {
+			return nil, err
+		}
+		// the temporary file is visible in the directory, so it is created
+		// with restrictive permissions that are relaxed once it is populated
+		f, err := openAt(s.tmpdirfd, tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, unix.EEXIST) && i < 100 {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if cfg.perm == defaultConfig().perm {
+			cfg.perm, cfg.permMasked = 0o666, true
+		}
+		s.f, s.tmp = f, tmp
+		return s, nil
+	}
+}
+
+// StageDir makes Create stage the contents with RenameStrategy (unless a
+// different strategy is specified) in a temporary file created in the
+// directory dir, instead of in the directory that will contain the target
+// file, so that temporary files left behind by crashes can be found and
+// removed easily. As temporary files can not be renamed across filesystems,
+// if dir is not on the same filesystem as the target file the temporary file
+// is created in the directory containing the target file instead.
+func StageDir(dir string) Option {
+	return optionFunc(func(c *config) error {
+		if c.stageDir != "" {
+			return &werror{"multiple staging directories", nil}
+		}
+		if dir == "" {
+			return &werror{"invalid staging directory", nil}
+		}
+		c.stageDir = dir
+		return nil
+	})
+}
+
+// TempPattern specifies the pattern of the names of the temporary files
+// that are visible in the directory containing the target file (or in the
+// directory specified with StageDir), e.g. the ones created by
+// RenameStrategy, and the ones that are renamed over the existing file by
+// Replace. The following placeholders are expanded (see os.Expand):
+//
+//	${name}  the name of the target file
+//	${rand}  a random string (required)
+//	${pid}   the process ID
+//	${time}  the current time, e.g. 20221015T150405.123456789Z
+//
+// The default pattern is ".${name}.${rand}.tmp".
+func TempPattern(pattern string) Option {
+	return optionFunc(func(c *config) error {
+		if c.tempPattern != "" {
+			return &werror{"multiple temporary name patterns", nil}
+		}
+		valid, hasRand := !strings.Contains(pattern, "/"), false
+		os.Expand(pattern, func(v string) string {
+			switch v {
+			case "rand":
+				hasRand = true
+			case "name", "pid", "time":
+			default:
+				valid = false
+			}
+			return ""
+		})
+		if !valid || !hasRand {
+			return &werror{"invalid temporary name pattern", nil}
+		}
+		c.tempPattern = pattern
+		return nil
+	})
+}
+
+// tempName returns a random name for a temporary file in the same
+// directory as a file called base, using the pattern specified with
+// TempPattern, if any.
+func (c *config) tempName(base string) (string, error) {
+	if c.tempPattern == "" {
+		return tempName(base)
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return os.Expand(c.tempPattern, func(v string) string {
+		switch v {
+		case "name":
+			return base
+		case "rand":
+			return hex.EncodeToString(b[:])
+		case "pid":
+			return strconv.Itoa(os.Getpid())
+		case "time":
+			return time.Now().UTC().Format(versionTimeFormat)
+		}
+		return ""
+	}), nil
+}
+
+// openStageDir opens the staging directory path, and checks that it is on
+// the same mount (of the same filesystem) as the directory dir.
+func openStageDir(dir *os.File, path string) (*os.File, error) {
+	d, err := openAt(unix.AT_FDCWD, path, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	same, err := sameMount(int(d.Fd()), int(dir.Fd()))
+	if err != nil {
+		_ = d.Close()
+		return nil, err
+	} else if !same {
+		_ = d.Close()
+		return nil, &os.LinkError{Op: "stage", Old: path, New: dir.Name(), Err: unix.EXDEV}
+	}
+	return d, nil
+}
+
+// sameMount reports whether the files a and b are on the same mount of the
+// same filesystem, so that they can be renamed, linked or cloned from one
+// into the other without failing with EXDEV. If the mount ID is not
+// reported by the kernel (before Linux 5.8), only the filesystems are
+// compared.
+func sameMount(a, b int) (bool, error) {
+	var sa, sb unix.Statx_t
+	if err := unix.Statx(a, "", unix.AT_EMPTY_PATH, unix.STATX_MNT_ID, &sa); err != nil {
+		return false, err
+	}
+	if err := unix.Statx(b, "", unix.AT_EMPTY_PATH, unix.STATX_MNT_ID, &sb); err != nil {
+		return false, err
+	}
+	if sa.Dev_major != sb.Dev_major || sa.Dev_minor != sb.Dev_minor {
+		return false, nil
+	}
+	if sa.Mask&sb.Mask&unix.STATX_MNT_ID != 0 && sa.Mnt_id != sb.Mnt_id {
+		return false, nil
+	}
+	return true, nil
+}
+
+// renameFile is a file staged by RenameStrategy.
+type renameFile struct {
+	f     *os.File
+	dirfd int
+	// tmp is the temporary name of the file, or "" once it has been renamed.
+	tmp string
+	// tmpdirfd is the directory containing the temporary file, that is
+	// stageDir (see StageDir) or dirfd, and tmpdir is its path.
+	tmpdirfd int
+	tmpdir   string
+	stageDir *os.File
+}
+
+func (s *renameFile) File() *os.File {
+	return s.f
+}
+
+func (s *renameFile) Link(name string) error {
+	err := unix.Renameat2(s.tmpdirfd, s.tmp, s.dirfd, name, unix.RENAME_NOREPLACE)
+	if err == unix.EINVAL || err == unix.ENOSYS {
+		// RENAME_NOREPLACE is not supported: hard link the file instead
+		return unix.Linkat(s.tmpdirfd, s.tmp, s.dirfd, name, 0)
+	} else if err != nil {
+		return err
+	}
+	s.tmp = ""
+	return nil
+}
+
+func (s *renameFile) Replace(name string) error {
+	err := unix.Renameat(s.tmpdirfd, s.tmp, s.dirfd, name)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: s.tmp, New: name, Err: err}
+	}
+	s.tmp = ""
+	return nil
+}
+
+func (s *renameFile) mechanism() BuiltinStrategy {
+	return StrategyRename
+}
+
+func (s *renameFile) Cleanup() error {
+	var err error
+	if s.tmp != "" {
+		err = unix.Unlinkat(s.tmpdirfd, s.tmp, 0)
+		s.tmp = ""
+	}
+	if s.stageDir != nil {
+		_ = s.stageDir.Close()
+		s.stageDir = nil
+	}
+	return err
+}
+
+// KeepOnError makes Create keep the temporary file, instead of removing it,
+// if the creation of the target file fails after the temporary file has been
+// created, so that the data written to it can be inspected. The path of the
+// temporary file is reported in the returned error.
+// KeepOnError has effect only when the contents are staged in a named
+// temporary file (i.e. when RenameStrategy is used, either explicitly or as
+// a fallback): unnamed temporary files can not be kept.
+func KeepOnError() Option {
+	return optionFunc(func(c *config) error {
+		c.keepOnError = true
+		return nil
+	})
+}
+
+// keeper is implemented by the staged files that can be kept if the creation
+// of the target file fails (see KeepOnError).
+type keeper interface {
+	// keep makes Cleanup leave the temporary file in place, and returns its
+	// path. If there is no temporary file to keep, ok is false.
+	keep() (path string, ok bool)
+}
+
+func (s *renameFile) keep() (string, bool) {
+	if s.tmp == "" {
+		return "", false
+	}
+	p := path.Join(s.tmpdir, s.tmp)
+	s.tmp = ""
+	return p, true
+}
+
+// keepOnError keeps the temporary file of p if requested by KeepOnError, and
+// adds its path to err.
+func (p *Pending) keepOnError(err error, cfg *config) error {
+	if !cfg.keepOnError {
+		return err
+	}
+	if k, ok := p.staged.(keeper); ok {
+		if name, ok := k.keep(); ok {
+			return &werror{"temporary file kept as " + name, err}
+		}
+	}
+	return err
+}
+
+// linkTemp links the staged file s with a temporary name derived from name,
+// and returns the chosen name.
+func linkTemp(s Staged, name string, cfg *config) (string, error) {
+	for i := 0; ; i++ {
+		tmp, err := cfg.tempName(name)
+		if err != nil {
+			return "", err
+		}
+		err = s.Link(tmp)
+		if err == nil {
+			return tmp, nil
+		} else if !errors.Is(err, unix.EEXIST) || i >= 100 {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,229 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+// countingStrategy is a Strategy that wraps another one, counting the
+// temporary files it stages and publishes.
+type countingStrategy struct {
+	atomicfile.Strategy
+	staged, published int
+}
+
+func (s *countingStrategy) Stage(dir *os.File, name string) (atomicfile.Staged, error) {
+	st, err := s.Strategy.Stage(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	s.staged++
+	return &countingStaged{Staged: st, s: s}, nil
+}
+
+type countingStaged struct {
+	atomicfile.Staged
+	s *countingStrategy
+}
+
+func (st *countingStaged) Link(name string) error {
+	err := st.Staged.Link(name)
+	if err == nil {
+		st.s.published++
+	}
+	return err
+}
+
+func (st *countingStaged) Replace(name string) error {
+	err := st.Staged.Replace(name)
+	if err == nil {
+		st.s.published++
+	}
+	return err
+}
+
+func TestCustomStrategy(t *testing.T) {
+	for _, base := range []atomicfile.Strategy{atomicfile.TmpFileStrategy(), atomicfile.RenameStrategy()} {
+		dir := t.TempDir()
+		name := filepath.Join(dir, "file")
+		s := &countingStrategy{Strategy: base}
+		err := atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+			atomicfile.WithStrategy(s),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, name, "hello")
+		if s.staged != 1 || s.published != 1 {
+			t.Fatalf("staged %d and published %d files, expected 1 and 1", s.staged, s.published)
+		}
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	for _, s := range []atomicfile.BuiltinStrategy{
+		atomicfile.StrategyLinkat,
+		atomicfile.StrategyProcLink,
+		atomicfile.StrategyRename,
+	} {
+		t.Run(s.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			name := filepath.Join(dir, "file")
+			for _, contents := range []string{"first", "second"} {
+				var r atomicfile.Result
+				err := atomicfile.Create(name,
+					atomicfile.Contents(bytes.NewReader([]byte(contents))),
+					atomicfile.ForceStrategy(s),
+					atomicfile.Replace(),
+					atomicfile.Fsync(),
+					atomicfile.Report(&r),
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkFile(t, name, contents)
+				checkDirEntries(t, dir, "file")
+				if r.Strategy != s {
+					t.Fatalf("Strategy is %v, expected %v", r.Strategy, s)
+				}
+			}
+		})
+	}
+	// custom strategies are not reported
+	var r atomicfile.Result
+	err := atomicfile.Create(filepath.Join(t.TempDir(), "file"),
+		atomicfile.WithStrategy(&countingStrategy{Strategy: atomicfile.RenameStrategy()}),
+		atomicfile.Report(&r),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Strategy != 0 {
+		t.Fatalf("Strategy is %v, expected 0 for a custom strategy", r.Strategy)
+	}
+}
+
+func TestStageDir(t *testing.T) {
+	dir := t.TempDir()
+	stageDir := filepath.Join(dir, "stage")
+	if err := os.Mkdir(stageDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "file")
+
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.WithStrategy(atomicfile.RenameStrategy()),
+		atomicfile.StageDir(stageDir),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file", "stage")
+	checkDirEntries(t, stageDir)
+
+	// a failed creation does not leave the temporary file behind
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("new"))),
+		atomicfile.WithStrategy(atomicfile.RenameStrategy()),
+	)
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file", "stage")
+}
+
+func TestStageDirOtherMount(t *testing.T) {
+	stageDir, err := os.MkdirTemp("/dev/shm", "atomicfile")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(stageDir)
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	// the temporary file is created next to the target file instead
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.StageDir(stageDir),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file")
+	checkDirEntries(t, stageDir)
+}
+
+func TestTempPattern(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	var tmp string
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.WithStrategy(atomicfile.RenameStrategy()),
+		atomicfile.TempPattern("${name}-${pid}-${rand}~"),
+		atomicfile.Validate(func(f *os.File) error {
+			tmp = filepath.Base(f.Name())
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+	checkDirEntries(t, dir, "file")
+	prefix := "file-" + strconv.Itoa(os.Getpid()) + "-"
+	if !strings.HasPrefix(tmp, prefix) || !strings.HasSuffix(tmp, "~") || len(tmp) <= len(prefix)+1 {
+		t.Fatalf("temporary file named %q", tmp)
+	}
+
+	for _, pattern := range []string{"", "${name}", "a/${rand}", "${rand}${other}"} {
+		if err := atomicfile.Create(name, atomicfile.TempPattern(pattern)); err == nil {
+			t.Fatalf("invalid pattern %q accepted", pattern)
+		}
+	}
+}
+
+func TestKeepOnError(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	errInvalid := errors.New("invalid contents")
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.WithStrategy(atomicfile.RenameStrategy()),
+		atomicfile.TempPattern("tmp-${rand}"),
+		atomicfile.KeepOnError(),
+		atomicfile.Validate(func(f *os.File) error { return errInvalid }),
+	)
+	if !errors.Is(err, errInvalid) {
+		t.Fatalf("expected an error wrapping the validation error, got %v", err)
+	}
+	entries, rerr := os.ReadDir(dir)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "tmp-") {
+		t.Fatalf("temporary file not kept: %v", entries)
+	}
+	tmp := filepath.Join(dir, entries[0].Name())
+	if !strings.Contains(err.Error(), tmp) {
+		t.Fatalf("error %q does not report the temporary file %s", err, tmp)
+	}
+	checkFile(t, tmp, "hello")
+}
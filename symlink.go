@@ -0,0 +1,98 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"os"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// Symlink atomically creates or replaces linkname as a symbolic link to target.
+// The symbolic link is first created with a temporary name in the same
+// directory and then renamed over linkname, so that other processes observe
+// either the previous state of linkname or the new symbolic link.
+// Only the Fsync, Durability, SyncParentDirs, NoReplace, ownership (Ownership,
+// Uid, Gid, Owner and Group), ModificationTime, AccessTime and TempPattern
+// options are honored: Symlink fails if any other option is specified.
+func Symlink(target, linkname string, options ...Option) error {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	err = checkHonored("Symlink", cfg, func(c *config) {
+		def := defaultConfig()
+		c.durability, c.syncParents, c.noReplace = def.durability, def.syncParents, def.noReplace
+		c.uid, c.gid, c.mtime, c.atime = def.uid, def.gid, def.mtime, def.atime
+		c.tempPattern = def.tempPattern
+	})
+	if err != nil {
+		return err
+	}
+	return symlink(target, linkname, cfg)
+}
+
+// symlink creates or replaces linkname as a symbolic link to target, as
+// specified by cfg (see Symlink).
+func symlink(target, linkname string, cfg config) error {
+	dir := path.Dir(linkname)
+
+	var tmp string
+	for i := 0; ; i++ {
+		name, err := cfg.tempName(path.Base(linkname))
+		if err != nil {
+			return &werror{"generating temporary name", err}
+		}
+		tmp = path.Join(dir, name)
+		err = unix.Symlink(target, tmp)
+		if err == nil {
+			break
+		} else if err != unix.EEXIST || i >= 100 {
+			return &werror{"creating symlink", &os.LinkError{Op: "symlink", Old: target, New: tmp, Err: err}}
+		}
+	}
+
+	if err := setupSymlink(tmp, linkname, cfg); err != nil {
+		_ = unix.Unlink(tmp)
+		return err
+	}
+
+	if cfg.durability >= DurabilityFull || cfg.syncParents {
+		if err := syncDir(dir); err != nil {
+			return &werror{"fsync directory", err}
+		}
+	}
+
+	if cfg.durability >= DurabilityParanoid || cfg.syncParents {
+		if err := syncParents(dir); err != nil {
+			return &werror{"fsync parent directories", err}
+		}
+	}
+
+	return nil
+}
+
+func setupSymlink(tmp, linkname string, cfg config) error {
+	if cfg.uid != defaultConfig().uid || cfg.gid != defaultConfig().gid {
+		err := unix.Lchown(tmp, cfg.uid, cfg.gid)
+		if err != nil {
+			return &werror{"setting ownership", err}
+		}
+	}
+
+	if cfg.mtime != defaultConfig().mtime || cfg.atime != defaultConfig().atime {
+		err := unix.UtimesNanoAt(unix.AT_FDCWD, tmp, []unix.Timespec{cfg.atime, cfg.mtime}, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return &werror{"setting access/modification time", err}
+		}
+	}
+
+	err := rename(tmp, linkname, cfg.noReplace)
+	if err != nil {
+		return &werror{"renaming symlink", err}
+	}
+
+	return nil
+}
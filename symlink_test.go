@@ -0,0 +1,103 @@
+//go:build linux || freebsd || netbsd || openbsd || solaris || js || plan9
+// +build linux freebsd netbsd openbsd solaris js plan9
+
+package atomicfile_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestSymlink(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "current")
+
+	if err := atomicfile.Symlink("v1", link); err != nil {
+		t.Fatal(err)
+	}
+	checkSymlink(t, link, "v1")
+	checkDirEntries(t, dir, "current")
+}
+
+func TestSymlinkReplace(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "current")
+
+	if err := atomicfile.Symlink("v1", link); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomicfile.Symlink("v2", link); err != nil {
+		t.Fatal(err)
+	}
+	checkSymlink(t, link, "v2")
+	checkDirEntries(t, dir, "current")
+
+	// a regular file is replaced as well
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomicfile.Symlink("v3", file); err != nil {
+		t.Fatal(err)
+	}
+	checkSymlink(t, file, "v3")
+}
+
+func TestSymlinkNoReplace(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "current")
+
+	if err := atomicfile.Symlink("v1", link, atomicfile.NoReplace()); err != nil {
+		t.Fatal(err)
+	}
+	err := atomicfile.Symlink("v2", link, atomicfile.NoReplace())
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected an error wrapping os.ErrExist, got %v", err)
+	}
+	checkSymlink(t, link, "v1")
+	checkDirEntries(t, dir, "current")
+}
+
+func TestSymlinkFsync(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "current")
+
+	for _, opt := range []atomicfile.Option{
+		atomicfile.Fsync(),
+		atomicfile.Durability(atomicfile.DurabilityParanoid),
+		atomicfile.SyncParentDirs(),
+	} {
+		err := atomicfile.Symlink("v1", link, opt)
+		if errors.Is(err, atomicfile.ErrUnsupported) {
+			// e.g. SyncParentDirs on the platforms without a port
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		checkSymlink(t, link, "v1")
+	}
+	checkDirEntries(t, dir, "current")
+}
+
+func TestSymlinkMissingDir(t *testing.T) {
+	dir := t.TempDir()
+	err := atomicfile.Symlink("v1", filepath.Join(dir, "missing", "current"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected an error wrapping os.ErrNotExist, got %v", err)
+	}
+}
+
+func checkSymlink(t *testing.T, link, target string) {
+	t.Helper()
+	got, err := os.Readlink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != target {
+		t.Fatalf("symlink %s points to %q, expected %q", link, got, target)
+	}
+}
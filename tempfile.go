@@ -0,0 +1,321 @@
+//go:build freebsd || netbsd || openbsd || solaris
+// +build freebsd netbsd openbsd solaris
+
+package atomicfile
+
+import (
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// The BSDs and illumos/Solaris do not support unnamed temporary files
+// (O_TMPFILE), so Create populates a temporary file with a random name in the
+// target directory and then renames it (or, without Replace, links it) as the
+// target file. Only the options that can be implemented this way are
+// available: the ones that depend on Linux-specific features fail with
+// ErrUnsupported.
+
+type config struct {
+	contents    io.Reader
+	durability  DurabilityLevel
+	syncParents bool
+	noReplace   bool
+	replace     bool
+	result      *Result
+	xattrs      []xattr
+	perm        uint32
+	permMasked  bool
+	executable  bool
+	dirGroup    bool
+	uid         int
+	gid         int
+	mtime       unix.Timespec
+	atime       unix.Timespec
+	flagsSet    uint32
+	flagsClear  uint32
+	hashes      []hash.Hash
+	maxSize     int64
+	transforms  []func(io.Writer) (io.WriteCloser, error)
+	compressed  bool
+	// checksumXattrs is only set on the platforms that support ChecksumXattr.
+	checksumXattrs []checksum
+	sizeHint       int64
+	expectSize     int64
+	copyBuffer     int
+	ctx            context.Context
+	afterCommit    []func(Result) error
+	backupSuffix   string
+	backupRotate   int
+}
+
+func defaultConfig() config {
+	return config{
+		perm:       ^uint32(0),
+		uid:        -1,
+		gid:        -1,
+		mtime:      unix.Timespec{Nsec: utimeOmit},
+		atime:      unix.Timespec{Nsec: utimeOmit},
+		maxSize:    -1,
+		sizeHint:   -1,
+		expectSize: -1,
+	}
+}
+
+func newConfig(options []Option) (config, error) {
+	cfg := defaultConfig()
+	for _, o := range options {
+		if err := o.apply(&cfg); err != nil {
+			return cfg, &werror{"options", err}
+		}
+	}
+	if cfg.replace && cfg.noReplace {
+		return cfg, &werror{"options", &werror{"conflicting Replace and NoReplace", nil}}
+	}
+	if (cfg.backupSuffix != "" || cfg.backupRotate > 0) && !cfg.replace {
+		return cfg, &werror{"options", &werror{"Backup requires Replace", nil}}
+	}
+	return cfg, nil
+}
+
+// NoReplace makes Create fail if the target file already exists. This is
+// the default behavior of Create, unless Replace is specified.
+func NoReplace() Option {
+	return optionFunc(func(c *config) error {
+		c.noReplace = true
+		return nil
+	})
+}
+
+// SyncParentDirs enables the invocation of fsync() on the directory
+// containing the target file, and on all its parent directories up to the
+// mount point of the filesystem, after the target file has been linked.
+func SyncParentDirs() Option {
+	return optionFunc(func(c *config) error {
+		c.syncParents = true
+		return nil
+	})
+}
+
+// Create creates the specified file with the provided options.
+// The file is created atomically in a fully-formed state by populating a
+// temporary file in the same directory, and then linking it (or, if Replace
+// is specified, renaming it over the existing file) as the target file.
+// Create fails if the file already exists, unless Replace is specified.
+// If Create fails after the file has been published (e.g. because the
+// directory could not be synced), the error matches ErrPublished.
+func Create(filename string, options ...Option) (err error) {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+	if err := cfg.canceled(); err != nil {
+		return err
+	}
+
+	dir, base := path.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	d, err := openAt(unix.AT_FDCWD, dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	if err != nil {
+		return &werror{"opening directory", err}
+	}
+	defer d.Close()
+	dirfd := int(d.Fd())
+
+	f, tmp, err := createTemp(dirfd, base)
+	if err != nil {
+		return &werror{"opening file", err}
+	}
+	defer func() {
+		if tmp != "" {
+			_ = unix.Unlinkat(dirfd, tmp, 0)
+		}
+		_ = f.Close()
+	}()
+
+	if cfg.uid != defaultConfig().uid || cfg.gid != defaultConfig().gid {
+		if err := unix.Fchown(int(f.Fd()), cfg.uid, cfg.gid); err != nil {
+			return &werror{"setting ownership", err}
+		}
+	}
+
+	if set := cfg.flagsSet &^ lateInodeFlags; set != 0 || cfg.flagsClear != 0 {
+		if err := setFileFlags(int(f.Fd()), set, cfg.flagsClear); err != nil {
+			return &werror{"setting inode flags", err}
+		}
+	}
+
+	var written int64
+	if cfg.contents != nil {
+		written, err = populateFile(f, &cfg)
+		if err != nil {
+			return &werror{"populating file", err}
+		}
+	}
+
+	// Permissions are set after the file has been populated, as writing to
+	// the file may clear the setuid/setgid bits. The temporary file is
+	// created with restrictive permissions, so the default ones are applied
+	// explicitly.
+	perm := cfg.perm
+	if perm == defaultConfig().perm {
+		perm = 0o666 &^ umask()
+	} else if cfg.permMasked {
+		perm &^= umask()
+	}
+	if cfg.executable {
+		perm |= (perm & 0o444) >> 2
+	}
+	if err := unix.Fchmod(int(f.Fd()), perm); err != nil {
+		return &werror{"setting permissions", err}
+	}
+
+	for _, c := range cfg.checksumXattrs {
+		cfg.xattrs = append(cfg.xattrs, xattr{checksumXattrName(c.algo), c.h.Sum(nil)})
+	}
+	for _, xattr := range cfg.xattrs {
+		if err := setExtattr(int(f.Fd()), xattr.name, xattr.value); err != nil {
+			return &werror{"setting xattr", err}
+		}
+	}
+
+	if cfg.mtime != defaultConfig().mtime || cfg.atime != defaultConfig().atime {
+		err := unix.UtimesNanoAt(dirfd, tmp, []unix.Timespec{cfg.atime, cfg.mtime}, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return &werror{"setting access/modification time", err}
+		}
+	}
+
+	if cfg.durability >= DurabilityData {
+		if err := f.Sync(); err != nil {
+			return &werror{"fsync file", err}
+		}
+	}
+
+	if err := cfg.canceled(); err != nil {
+		return err
+	}
+
+	var backup string
+	if cfg.backupSuffix != "" || cfg.backupRotate > 0 {
+		backup, err = backupFile(filename, &cfg)
+		if err != nil {
+			return &werror{"backing up file", err}
+		}
+	}
+
+	// the errors that occur once the file has been published are reported
+	// as such, as the caller can not assume that the target file is unchanged
+	published := false
+	defer func() {
+		if err != nil && published {
+			err = &publishedError{err}
+		}
+	}()
+
+	if cfg.replace {
+		if err := unix.Renameat(dirfd, tmp, dirfd, base); err != nil {
+			return &werror{"renaming file", &os.LinkError{Op: "renameat", Old: tmp, New: base, Err: err}}
+		}
+		published = true
+	} else {
+		// linkat fails if the target file exists, unlike renameat
+		if err := linkAt(dirfd, dir, tmp, base); err != nil {
+			return &werror{"linking file", &os.LinkError{Op: "linkat", Old: tmp, New: base, Err: err}}
+		}
+		published = true
+		if err := unix.Unlinkat(dirfd, tmp, 0); err != nil {
+			return &werror{"removing temporary file", err}
+		}
+	}
+	tmp = ""
+
+	if set := cfg.flagsSet & lateInodeFlags; set != 0 {
+		if err := setFileFlags(int(f.Fd()), set, 0); err != nil {
+			return &werror{"setting inode flags", err}
+		}
+		if cfg.durability >= DurabilityFull {
+			if err := f.Sync(); err != nil {
+				return &werror{"fsync file", err}
+			}
+		}
+	}
+
+	if cfg.durability >= DurabilityFull || cfg.syncParents {
+		if err := d.Sync(); err != nil {
+			return &werror{"fsync directory", err}
+		}
+		if cfg.durability >= DurabilityParanoid || cfg.syncParents {
+			if err := syncParentsAt(dirfd); err != nil {
+				return &werror{"fsync parent directories", err}
+			}
+		}
+	}
+
+	if cfg.backupRotate > 0 {
+		if err := pruneBackups(filename, cfg.backupRotate); err != nil {
+			return &werror{"removing backups", err}
+		}
+	}
+
+	return cfg.finish(Result{Written: written, Backup: backup})
+}
+
+// createTemp creates a new file with a random name in the directory dirfd,
+// suitable for a temporary file that will become base, and returns it
+// together with its name.
+func createTemp(dirfd int, base string) (*os.File, string, error) {
+	for i := 0; ; i++ {
+		name, err := tempName(base)
+		if err != nil {
+			return nil, "", err
+		}
+		f, err := openAt(dirfd, name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			return f, name, nil
+		} else if !errors.Is(err, unix.EEXIST) || i >= 100 {
+			return nil, "", err
+		}
+	}
+}
+
+// syncDir fsyncs the specified directory.
+func syncDir(dir string) error {
+	d, err := openAt(unix.AT_FDCWD, dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncParents fsyncs all parent directories of the specified directory,
+// up to the mount point of the filesystem containing it. The specified
+// directory itself is not fsynced.
+func syncParents(dir string) error {
+	d, err := openAt(unix.AT_FDCWD, dir, unix.O_DIRECTORY|os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return syncParentsAt(int(d.Fd()))
+}
+
+// setSymlinkTimes sets the access and modification times specified in cfg,
+// if any, on the symbolic link name.
+func setSymlinkTimes(name string, cfg *config) error {
+	if cfg.mtime == defaultConfig().mtime && cfg.atime == defaultConfig().atime {
+		return nil
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, name, []unix.Timespec{cfg.atime, cfg.mtime}, unix.AT_SYMLINK_NOFOLLOW)
+}
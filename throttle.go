@@ -0,0 +1,134 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"context"
+	"time"
+)
+
+// Context makes Create stop, and fail with the error returned by ctx.Err(),
+// if ctx is canceled before the target file is linked. Cancellation is
+// checked before starting to create the temporary file, periodically while
+// populating it (also while throttled by RateLimit), and before linking it.
+// Once the target file has been linked, the creation is always completed.
+func Context(ctx context.Context) Option {
+	return optionFunc(func(c *config) error {
+		if c.ctx != defaultConfig().ctx {
+			return &werror{"multiple contexts", nil}
+		}
+		if ctx == nil {
+			return &werror{"invalid context", nil}
+		}
+		c.ctx = ctx
+		return nil
+	})
+}
+
+// RateLimit limits the rate at which the contents are written to the target
+// file to about bytesPerSec bytes per second, so that writing large files
+// does not saturate the bandwidth of the underlying storage.
+// The rate limit is applied to the data written to the target file (i.e.
+// after the filters specified with Transform, if any).
+func RateLimit(bytesPerSec int64) Option {
+	return optionFunc(func(c *config) error {
+		if c.rateLimit != defaultConfig().rateLimit {
+			return &werror{"multiple rate limits", nil}
+		}
+		if bytesPerSec <= 0 {
+			return &werror{"invalid rate limit", nil}
+		}
+		c.rateLimit = bytesPerSec
+		return nil
+	})
+}
+
+// Progress specifies a function to be invoked periodically while the target
+// file is populated, with the number of bytes written so far and the size of
+// the contents, or -1 if the size is not known (see ContentSize). The function
+// is invoked at most every 100ms, and once more when the population has
+// completed successfully.
+// The number of bytes written refers to the data written to the target file
+// (i.e. after the filters specified with Transform, if any), so it may not
+// match the size of the contents if Transform is specified.
+func Progress(fn func(written, total int64)) Option {
+	return optionFunc(func(c *config) error {
+		if c.progress != nil {
+			return &werror{"multiple progress functions", nil}
+		}
+		c.progress = fn
+		return nil
+	})
+}
+
+const (
+	// progressInterval is the maximum amount of data written between checks
+	// of whether the function specified with Progress should be invoked.
+	progressInterval = 1 << 20
+	// progressPeriod is the minimum time between invocations of the
+	// function specified with Progress.
+	progressPeriod = 100 * time.Millisecond
+)
+
+// progressHook returns a hook that invokes fn at most every progressPeriod.
+func progressHook(fn func(written, total int64), total int64) func(written int64) error {
+	var last time.Time
+	return func(written int64) error {
+		if now := time.Now(); now.Sub(last) >= progressPeriod {
+			last = now
+			fn(written, total)
+		}
+		return nil
+	}
+}
+
+// ctxCheckInterval is the maximum amount of data written between checks of
+// the cancellation of the context specified with Context.
+const ctxCheckInterval = 16 << 20
+
+// canceled returns the error of the context specified with Context, if it
+// has been canceled.
+func (c *config) canceled() error {
+	if c.ctx == nil {
+		return nil
+	}
+	return c.ctx.Err()
+}
+
+// sleep waits for d, or until the context specified with Context is
+// canceled, in which case the error of the context is returned.
+func (c *config) sleep(d time.Duration) error {
+	if c.ctx == nil {
+		time.Sleep(d)
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
+// throttler returns a hook that delays writing so that on average no more
+// than rate bytes per second are written. It also returns the amount of
+// data that should be written between invocations of the hook, so that the
+// writes are spread over time.
+func throttler(cfg *config, rate int64) (chunk int64, hook func(written int64) error) {
+	// aim for about 10 writes per second
+	chunk = rate / 10
+	if chunk < 4096 {
+		chunk = 4096
+	}
+	start := time.Now()
+	return chunk, func(written int64) error {
+		due := time.Duration(float64(written) / float64(rate) * float64(time.Second))
+		if wait := due - time.Since(start); wait > 0 {
+			return cfg.sleep(wait)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,409 @@
+package atomicfile
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ErrTooLarge is returned when the contents exceed the size specified with
+// MaxSize.
+var ErrTooLarge = errors.New("contents too large")
+
+// ErrSizeMismatch is returned when the size of the contents differs from
+// the one specified with ExpectSize.
+var ErrSizeMismatch = errors.New("contents size mismatch")
+
+// ErrChecksumMismatch is returned when the digest of the contents does not
+// match the one specified with VerifyChecksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Result contains information about a file created by Create.
+type Result struct {
+	// Written is the number of bytes written to the target file.
+	Written int64
+	// Sums contains the digests computed by the Hash options, in the same
+	// order in which the Hash options were specified.
+	Sums [][]byte
+	// Backup is the name of the backup of the replaced file, if any
+	// (see Backup).
+	Backup string
+	// Unchanged reports whether the target file was left untouched because
+	// its contents were identical to the new ones (see OnlyIfChanged).
+	Unchanged bool
+	// Strategy is the built-in mechanism used to create the target file
+	// (e.g. StrategyProcLink if linkat with AT_EMPTY_PATH was not permitted),
+	// or 0 if a Strategy specified with WithStrategy was used.
+	Strategy BuiltinStrategy
+	// File is the target file, still open for reading and writing and
+	// positioned at its beginning (see KeepOpen and Lock). The caller is responsible for
+	// closing it.
+	File *os.File
+}
+
+// SizeHinter can be implemented by readers passed to Contents to report the
+// amount of data that they are expected to return, so that space for the
+// target file can be preallocated. Readers that implement a Len() int method
+// (such as *bytes.Reader) are also recognized.
+type SizeHinter interface {
+	// SizeHint returns the expected amount of data remaining to be read,
+	// or a non-positive value if unknown.
+	SizeHint() int64
+}
+
+// Stage identifies one of the steps performed by Create, as reported to the
+// functions specified with Observe.
+type Stage int
+
+const (
+	// StageOpenDir is the opening of the directory containing the target file.
+	StageOpenDir Stage = iota
+	// StageOpen is the creation of the temporary file.
+	StageOpen
+	// StageChown is the setting of the ownership of the temporary file
+	// (see Ownership).
+	StageChown
+	// StagePrealloc is the preallocation of space for the temporary file
+	// (see Preallocate and ContentSize).
+	StagePrealloc
+	// StageCopy is the population of the temporary file with the contents.
+	StageCopy
+	// StageXattr is the setting of the extended attributes of the temporary
+	// file (see Xattr and ChecksumXattr).
+	StageXattr
+	// StageFsync is the fsync (or fdatasync) of the temporary file
+	// (see Durability).
+	StageFsync
+	// StageLink is the linking of the temporary file as the target file.
+	// It is not reported when Replace is specified (see StageReplace).
+	StageLink
+	// StageDirSync is the fsync of the directory containing the target file,
+	// and of its parent directories if requested (see Durability and
+	// SyncParentDirs).
+	StageDirSync
+	// StageReplace is the replacement of the target file with the temporary
+	// file, in place of StageLink, when Replace is specified.
+	StageReplace
+)
+
+var stageNames = [...]string{
+	StageOpenDir:  "opendir",
+	StageOpen:     "open",
+	StageChown:    "chown",
+	StagePrealloc: "prealloc",
+	StageCopy:     "copy",
+	StageXattr:    "xattr",
+	StageFsync:    "fsync",
+	StageLink:     "link",
+	StageDirSync:  "dirsync",
+	StageReplace:  "replace",
+}
+
+func (s Stage) String() string {
+	if s >= 0 && int(s) < len(stageNames) {
+		return stageNames[s]
+	}
+	return "Stage(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Fault is the fault injected by Create after a stage, as decided by the
+// function specified with InjectFault.
+type Fault int
+
+const (
+	// NoFault lets Create proceed normally.
+	NoFault Fault = iota
+	// FailStage makes the stage fail with ErrInjectedFault, as if the
+	// underlying system call had failed: Create cleans up and returns the
+	// error.
+	FailStage
+	// Crash simulates a crash (e.g. a power loss) right after the stage:
+	// Create returns ErrSimulatedCrash immediately, without cleaning up, so
+	// that the filesystem is left in the state it would be in after the
+	// crash (except for the data that was not yet synced to stable storage,
+	// that a real power loss may also lose).
+	Crash
+)
+
+// ErrInjectedFault is returned by Create when a stage fails because of
+// FailStage (see InjectFault).
+var ErrInjectedFault = errors.New("injected fault")
+
+// ErrSimulatedCrash is returned by Create when a crash is simulated with
+// Crash (see InjectFault).
+var ErrSimulatedCrash = errors.New("simulated crash")
+
+// err returns the error corresponding to f.
+func (f Fault) err() error {
+	switch f {
+	case FailStage:
+		return ErrInjectedFault
+	case Crash:
+		return ErrSimulatedCrash
+	}
+	return nil
+}
+
+// ErrNotAtomic is returned by CheckAtomic when a file is neither absent nor
+// fully formed.
+var ErrNotAtomic = errors.New("file is neither absent nor fully formed")
+
+// CheckAtomic checks that filename is either absent, or that it has exactly
+// one of the specified contents (e.g. the ones of the file that was being
+// replaced, and the new ones), as Create guarantees even if it fails or is
+// interrupted at any stage. If not, it returns an error wrapping
+// ErrNotAtomic.
+func CheckAtomic(filename string, contents ...[]byte) error {
+	buf, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return &werror{"reading file", err}
+	}
+	for _, c := range contents {
+		if bytes.Equal(buf, c) {
+			return nil
+		}
+	}
+	return &werror{filename, ErrNotAtomic}
+}
+
+// Strategy is the mechanism used by Create to stage the temporary file that
+// is populated, and to publish it as the target file (see WithStrategy).
+// Applications can implement their own strategies, e.g. to stage the
+// contents somewhere else than in the target directory.
+type Strategy interface {
+	// Stage creates a temporary file in the directory dir, that will be
+	// published with a name derived from name (see Staged).
+	Stage(dir *os.File, name string) (Staged, error)
+}
+
+// Staged is a temporary file created by a Strategy.
+type Staged interface {
+	// File returns the temporary file, that is populated by Create. The
+	// file is closed by Create after calling Cleanup.
+	File() *os.File
+	// Link publishes the file as name in the directory in which it was
+	// staged. If name already exists, Link must fail with an error wrapping
+	// EEXIST, in which case it may be called again with a different name.
+	// Link is also used to link the file with a temporary name, before
+	// renaming it over the existing file (see Replace and Backup).
+	Link(name string) error
+	// Replace publishes the file as name in the directory in which it was
+	// staged, atomically replacing the existing file, if any.
+	Replace(name string) error
+	// Cleanup releases the resources held by the staged file, except for
+	// the file itself, discarding it if it has not been published. Cleanup
+	// is called exactly once.
+	Cleanup() error
+}
+
+// BuiltinStrategy identifies one of the mechanisms used by the built-in
+// strategies (see ForceStrategy).
+type BuiltinStrategy int
+
+const (
+	// StrategyLinkat stages the contents in an unnamed file created with
+	// O_TMPFILE, and publishes it with linkat(2) and AT_EMPTY_PATH.
+	StrategyLinkat BuiltinStrategy = iota + 1
+	// StrategyProcLink is like StrategyLinkat, but the unnamed file is
+	// linked through /proc/self/fd, as done when AT_EMPTY_PATH is not
+	// permitted (it requires CAP_DAC_READ_SEARCH on older kernels).
+	StrategyProcLink
+	// StrategyRename is the mechanism used by RenameStrategy, that is used
+	// when O_TMPFILE is not supported.
+	StrategyRename
+)
+
+var builtinStrategyNames = [...]string{
+	StrategyLinkat:   "linkat",
+	StrategyProcLink: "proc-link",
+	StrategyRename:   "rename",
+}
+
+func (s BuiltinStrategy) String() string {
+	if s > 0 && int(s) < len(builtinStrategyNames) {
+		return builtinStrategyNames[s]
+	}
+	return "BuiltinStrategy(" + strconv.Itoa(int(s)) + ")"
+}
+
+// PreallocMode specifies how space is preallocated for the target file (see
+// Preallocate and ContentSize).
+type PreallocMode int
+
+const (
+	// PreallocKeepSize allocates space without changing the size of the file
+	// (FALLOC_FL_KEEP_SIZE). This is the default.
+	PreallocKeepSize PreallocMode = iota
+	// PreallocExtend allocates space and extends the size of the file to the
+	// preallocated size, so that writing the contents does not need to
+	// update the size of the file. On some filesystems this avoids metadata
+	// updates when the file is fsynced.
+	PreallocExtend
+	// PreallocZeroRange is like PreallocExtend, but uses
+	// FALLOC_FL_ZERO_RANGE, that on some filesystems converts existing
+	// extents to unwritten extents instead of allocating new ones.
+	PreallocZeroRange
+)
+
+// ErrNoSpace is returned when the space requested with ReserveSpace can not
+// be allocated because there is not enough free space (or quota).
+var ErrNoSpace = errors.New("not enough space")
+
+// Precondition is a condition on the existing target file that must hold for
+// it to be replaced (see ReplaceIf).
+type Precondition interface {
+	holds(f *os.File, fi os.FileInfo) (bool, error)
+}
+
+type preconditionFunc func(f *os.File, fi os.FileInfo) (bool, error)
+
+func (p preconditionFunc) holds(f *os.File, fi os.FileInfo) (bool, error) {
+	return p(f, fi)
+}
+
+// IfSize is a Precondition that holds if the size of the existing target
+// file is n bytes.
+func IfSize(n int64) Precondition {
+	return preconditionFunc(func(_ *os.File, fi os.FileInfo) (bool, error) {
+		return fi.Size() == n, nil
+	})
+}
+
+// IfModTime is a Precondition that holds if the modification time of the
+// existing target file is t.
+func IfModTime(t time.Time) Precondition {
+	return preconditionFunc(func(_ *os.File, fi os.FileInfo) (bool, error) {
+		return fi.ModTime().Equal(t), nil
+	})
+}
+
+// IfSum is a Precondition that holds if the digest of the contents of the
+// existing target file, computed using the hash function algo, is sum.
+// The hash function must be linked into the binary (e.g. by importing
+// crypto/sha256 for crypto.SHA256).
+func IfSum(algo crypto.Hash, sum []byte) Precondition {
+	return preconditionFunc(func(f *os.File, _ os.FileInfo) (bool, error) {
+		if !algo.Available() {
+			return false, &werror{"unavailable hash function", nil}
+		}
+		h := algo.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return false, err
+		}
+		return bytes.Equal(h.Sum(nil), sum), nil
+	})
+}
+
+// ErrPreconditionFailed is returned when the existing target file does not
+// satisfy the preconditions specified with ReplaceIf, or when it does not
+// exist.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// CorruptionError is returned by ReadFileVerified when the contents of a file
+// do not match the digest stored in its extended attributes.
+type CorruptionError struct {
+	// Path is the path of the corrupted file.
+	Path string
+	// Algorithm is the hash function used to compute the digests.
+	Algorithm crypto.Hash
+	// Expected is the digest stored in the extended attributes of the file.
+	Expected []byte
+	// Actual is the digest of the contents of the file.
+	Actual []byte
+}
+
+func (e *CorruptionError) Error() string {
+	return "corrupted file " + e.Path + ": " + e.Algorithm.String() + " " + ErrChecksumMismatch.Error()
+}
+
+// Unwrap returns ErrChecksumMismatch.
+func (e *CorruptionError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// ErrTargetChanged is returned when the target path does not refer to the
+// file created by Create anymore (see VerifyCommit).
+var ErrTargetChanged = errors.New("target file changed concurrently")
+
+// UnsafePathError is returned when the path of the target file fails one
+// of the safety checks requested with the options.
+type UnsafePathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *UnsafePathError) Error() string {
+	return "unsafe path " + e.Path + ": " + e.Reason
+}
+
+// Capabilities reports which of the features used by Create are supported
+// by the filesystem containing a directory (see Probe).
+type Capabilities struct {
+	// TmpFile reports whether unnamed temporary files (O_TMPFILE) are
+	// supported. If they are not, Create fails unless RenameStrategy is
+	// used (see WithStrategy).
+	TmpFile bool
+	// Fallocate reports whether space can be preallocated (see Preallocate).
+	Fallocate bool
+	// Xattrs reports whether extended attributes in the user namespace are
+	// supported (see Xattr).
+	Xattrs bool
+	// Reflink reports whether files can be cloned, so that copying the
+	// contents from another file in the same filesystem is instantaneous.
+	Reflink bool
+	// Verity reports whether fs-verity can be enabled on the files in the
+	// filesystem, i.e. whether both the filesystem driver and the
+	// filesystem itself support it.
+	Verity bool
+	// RenameNoReplace reports whether RENAME_NOREPLACE is supported (see
+	// NoReplace).
+	RenameNoReplace bool
+	// RenameExchange reports whether RENAME_EXCHANGE is supported (see
+	// Backup).
+	RenameExchange bool
+}
+
+// RetryPolicy specifies how transient failures are retried (see Retry).
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts, including the first one.
+	Attempts int
+	// Backoff is the delay before the first retry. The delay is doubled
+	// after each retry.
+	Backoff time.Duration
+	// MaxBackoff, if positive, is the maximum delay between retries.
+	MaxBackoff time.Duration
+	// NoSpace makes failures caused by the filesystem being full (ENOSPC) or
+	// by an exceeded disk quota (EDQUOT) retryable, e.g. in case space is
+	// expected to be freed by some concurrent cleanup process.
+	NoSpace bool
+}
+
+// FileSpec specifies one of the files created by CreateMany.
+type FileSpec struct {
+	// Name is the name of the file, relative to the directory passed to
+	// CreateMany. It must not contain any "/".
+	Name string
+	// Options are the options used to create the file, in addition to the
+	// ones passed to CreateMany.
+	Options []Option
+}
+
+// BatchResult is the outcome of the creation of one of the files of a Batch.
+type BatchResult struct {
+	// Name is the name of the file, as passed to Add.
+	Name string
+	// Result describes the created file (see Report).
+	Result Result
+	// Err is the error that prevented the creation of the file, if any.
+	Err error
+}
+
+// ErrLockTimeout is returned when the lock file specified with WithLockfile
+// can not be locked within the timeout.
+var ErrLockTimeout = errors.New("lock file timeout")
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CreateUnique creates a new file in dir, with a name that does not conflict
+// with any existing file, and returns its path. The name is generated from
+// pattern like os.CreateTemp does: a random string replaces the last "*" in
+// pattern, or is appended to it if pattern does not contain "*".
+// The file is created atomically in a fully-formed state, honoring all the
+// options accepted by Create (except for Replace and the related options):
+// the contents are written only once, regardless of the number of names that
+// have to be tried.
+func CreateUnique(dir, pattern string, options ...Option) (string, error) {
+	if strings.Contains(pattern, "/") {
+		return "", &werror{"invalid pattern", nil}
+	}
+	cfg, err := newConfig(options)
+	if err != nil {
+		return "", err
+	}
+	if cfg.replace {
+		return "", &werror{"options", &werror{"Replace not supported by CreateUnique", nil}}
+	}
+
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	filename := path.Join(dir, pattern)
+	if pattern == "" {
+		// keep the (empty) pattern as the base name
+		filename += "/"
+	}
+	var name string
+	cfg.unique = &name
+	err = create(unix.AT_FDCWD, filename, cfg)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// linkUnique links the staged file s with a unique name generated from
+// pattern, and returns the chosen name.
+func linkUnique(s Staged, pattern string) (string, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	for i := 0; ; i++ {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", err
+		}
+		name := prefix + hex.EncodeToString(b[:]) + suffix
+		err := s.Link(name)
+		if err == nil {
+			return name, nil
+		} else if !errors.Is(err, unix.EEXIST) || i >= 100 {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestCreateUnique(t *testing.T) {
+	dir := t.TempDir()
+
+	names := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		name, err := atomicfile.CreateUnique(dir, "file-*.txt",
+			atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := filepath.Base(name)
+		if filepath.Dir(name) != dir || !strings.HasPrefix(base, "file-") || !strings.HasSuffix(base, ".txt") || names[base] {
+			t.Fatalf("unexpected name %q", name)
+		}
+		names[base] = true
+		checkFile(t, name, "hello")
+	}
+	if entries := len(names); entries != 10 {
+		t.Fatalf("%d unique names, expected 10", entries)
+	}
+
+	name, err := atomicfile.CreateUnique(dir, "prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base := filepath.Base(name); !strings.HasPrefix(base, "prefix") || base == "prefix" {
+		t.Fatalf("unexpected name %q", name)
+	}
+
+	if _, err := atomicfile.CreateUnique(dir, "a/*"); err == nil {
+		t.Fatal("invalid pattern accepted")
+	}
+	if _, err := atomicfile.CreateUnique(dir, "*", atomicfile.Replace()); err == nil {
+		t.Fatal("Replace accepted")
+	}
+}
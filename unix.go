@@ -0,0 +1,127 @@
+//go:build linux || freebsd || netbsd || openbsd || solaris
+// +build linux freebsd netbsd openbsd solaris
+
+package atomicfile
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// unixMode converts the permission and special bits of mode to the
+// corresponding Unix mode bits.
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unix.S_ISVTX
+	}
+	return m
+}
+
+// ModificationTime specifies the modification time of the target file.
+func ModificationTime(t time.Time) Option {
+	return optionFunc(func(c *config) error {
+		if c.mtime != defaultConfig().mtime {
+			return &werror{"multiple modification times", nil}
+		}
+		ts, err := unix.TimeToTimespec(t)
+		if err != nil {
+			return &werror{"invalid modification time", err}
+		}
+		c.mtime = ts
+		return nil
+	})
+}
+
+// AccessTime specifies the access time of the target file.
+func AccessTime(t time.Time) Option {
+	return optionFunc(func(c *config) error {
+		if c.atime != defaultConfig().atime {
+			return &werror{"multiple access times", nil}
+		}
+		ts, err := unix.TimeToTimespec(t)
+		if err != nil {
+			return &werror{"invalid access time", err}
+		}
+		c.atime = ts
+		return nil
+	})
+}
+
+// openAt opens name, resolved relative to dirfd.
+func openAt(dirfd int, name string, flag int, perm uint32) (*os.File, error) {
+	for {
+		fd, err := unix.Openat(dirfd, name, flag|unix.O_CLOEXEC, perm)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: "openat", Path: name, Err: err}
+		}
+		return os.NewFile(uintptr(fd), name), nil
+	}
+}
+
+// umask returns the umask of the process.
+func umask() uint32 {
+	// reading the umask from /proc does not require changing it, that would
+	// be racy in multi-threaded processes
+	if buf, err := os.ReadFile("/proc/self/status"); err == nil {
+		for _, line := range strings.Split(string(buf), "\n") {
+			if v := strings.TrimPrefix(line, "Umask:"); v != line {
+				if m, err := strconv.ParseUint(strings.TrimSpace(v), 8, 32); err == nil {
+					return uint32(m)
+				}
+			}
+		}
+	}
+	m := unix.Umask(0)
+	unix.Umask(m)
+	return uint32(m)
+}
+
+// syncParentsAt is like syncParents, but operates on the directory dirfd.
+func syncParentsAt(dirfd int) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(dirfd, &st); err != nil {
+		return err
+	}
+	// only the directory being walked up from is kept open, and it is closed
+	// once its parent has been opened
+	var prev *os.File
+	defer func() {
+		if prev != nil {
+			_ = prev.Close()
+		}
+	}()
+	for {
+		parent, err := openAt(dirfd, "..", unix.O_DIRECTORY|os.O_RDONLY, 0)
+		if prev != nil {
+			_ = prev.Close()
+		}
+		prev = parent
+		if err != nil {
+			return err
+		}
+		var pst unix.Stat_t
+		if err := unix.Fstat(int(parent.Fd()), &pst); err != nil {
+			return err
+		}
+		if pst.Dev != st.Dev || pst.Ino == st.Ino {
+			return nil // dirfd is the mount point, or the root directory
+		}
+		if err := parent.Sync(); err != nil {
+			return err
+		}
+		dirfd, st = int(parent.Fd()), pst
+	}
+}
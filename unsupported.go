@@ -0,0 +1,441 @@
+//go:build !linux
+// +build !linux
+
+package atomicfile
+
+import (
+	"crypto"
+	"os"
+	"sync"
+	"time"
+)
+
+// Preallocate is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Preallocate(size int64) Option {
+	return unsupported("Preallocate")
+}
+
+// Sparse is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Sparse() Option {
+	return unsupported("Sparse")
+}
+
+// SELinuxContext is not supported on this platform: it always fails with
+// ErrUnsupported.
+func SELinuxContext(label string) Option {
+	return unsupported("SELinuxContext")
+}
+
+// DontNeed is not supported on this platform: it always fails with
+// ErrUnsupported.
+func DontNeed() Option {
+	return unsupported("DontNeed")
+}
+
+// FadviseDontNeed is not supported on this platform: it always fails with
+// ErrUnsupported.
+func FadviseDontNeed() Option {
+	return unsupported("FadviseDontNeed")
+}
+
+// FadviseWillNeed is not supported on this platform: it always fails with
+// ErrUnsupported.
+func FadviseWillNeed() Option {
+	return unsupported("FadviseWillNeed")
+}
+
+// FadviseSequential is not supported on this platform: it always fails with
+// ErrUnsupported.
+func FadviseSequential() Option {
+	return unsupported("FadviseSequential")
+}
+
+// FlushEvery is not supported on this platform: it always fails with
+// ErrUnsupported.
+func FlushEvery(n int64) Option {
+	return unsupported("FlushEvery")
+}
+
+// ForceStrategy is not supported on this platform: it always fails with
+// ErrUnsupported.
+func ForceStrategy(s BuiltinStrategy) Option {
+	return unsupported("ForceStrategy")
+}
+
+// IOUring is not supported on this platform: it always fails with
+// ErrUnsupported.
+func IOUring() Option {
+	return unsupported("IOUring")
+}
+
+// InjectFault is not supported on this platform: it always fails with
+// ErrUnsupported.
+func InjectFault(fn func(stage Stage) Fault) Option {
+	return unsupported("InjectFault")
+}
+
+// KeepOnError is not supported on this platform: it always fails with
+// ErrUnsupported.
+func KeepOnError() Option {
+	return unsupported("KeepOnError")
+}
+
+// KeepOpen is not supported on this platform: it always fails with
+// ErrUnsupported.
+func KeepOpen() Option {
+	return unsupported("KeepOpen")
+}
+
+// Lock is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Lock() Option {
+	return unsupported("Lock")
+}
+
+// MetadataFrom is not supported on this platform: it always fails with
+// ErrUnsupported.
+func MetadataFrom(path string) Option {
+	return unsupported("MetadataFrom")
+}
+
+// NoForeignSymlinks is not supported on this platform: it always fails with
+// ErrUnsupported.
+func NoForeignSymlinks() Option {
+	return unsupported("NoForeignSymlinks")
+}
+
+// NoProcLink is not supported on this platform: it always fails with
+// ErrUnsupported.
+func NoProcLink() Option {
+	return unsupported("NoProcLink")
+}
+
+// Observe is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Observe(fn func(stage Stage, d time.Duration, err error)) Option {
+	return unsupported("Observe")
+}
+
+// OnlyIfChanged is not supported on this platform: it always fails with
+// ErrUnsupported.
+func OnlyIfChanged() Option {
+	return unsupported("OnlyIfChanged")
+}
+
+// ParallelCopy is not supported on this platform: it always fails with
+// ErrUnsupported.
+func ParallelCopy(n int) Option {
+	return unsupported("ParallelCopy")
+}
+
+// PreallocateChunks is not supported on this platform: it always fails with
+// ErrUnsupported.
+func PreallocateChunks(n int64) Option {
+	return unsupported("PreallocateChunks")
+}
+
+// PreallocateMode is not supported on this platform: it always fails with
+// ErrUnsupported.
+func PreallocateMode(mode PreallocMode) Option {
+	return unsupported("PreallocateMode")
+}
+
+// PreserveMetadata is not supported on this platform: it always fails with
+// ErrUnsupported.
+func PreserveMetadata() Option {
+	return unsupported("PreserveMetadata")
+}
+
+// PreserveTimes is not supported on this platform: it always fails with
+// ErrUnsupported.
+func PreserveTimes() Option {
+	return unsupported("PreserveTimes")
+}
+
+// ProcMount is not supported on this platform: it always fails with
+// ErrUnsupported.
+func ProcMount(dir string) Option {
+	return unsupported("ProcMount")
+}
+
+// Progress is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Progress(fn func(written, total int64)) Option {
+	return unsupported("Progress")
+}
+
+// RateLimit is not supported on this platform: it always fails with
+// ErrUnsupported.
+func RateLimit(bytesPerSec int64) Option {
+	return unsupported("RateLimit")
+}
+
+// ReplaceIf is not supported on this platform: it always fails with
+// ErrUnsupported.
+func ReplaceIf(preconditions ...Precondition) Option {
+	return unsupported("ReplaceIf")
+}
+
+// RequireDirMode is not supported on this platform: it always fails with
+// ErrUnsupported.
+func RequireDirMode(mask os.FileMode) Option {
+	return unsupported("RequireDirMode")
+}
+
+// RequireDirOwner is not supported on this platform: it always fails with
+// ErrUnsupported.
+func RequireDirOwner(uid int) Option {
+	return unsupported("RequireDirOwner")
+}
+
+// ReserveSpace is not supported on this platform: it always fails with
+// ErrUnsupported.
+func ReserveSpace(n int64) Option {
+	return unsupported("ReserveSpace")
+}
+
+// Retry is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Retry(policy RetryPolicy) Option {
+	return unsupported("Retry")
+}
+
+// SecureResolve is not supported on this platform: it always fails with
+// ErrUnsupported.
+func SecureResolve() Option {
+	return unsupported("SecureResolve")
+}
+
+// StageDir is not supported on this platform: it always fails with
+// ErrUnsupported.
+func StageDir(dir string) Option {
+	return unsupported("StageDir")
+}
+
+// SymlinkOptions is not supported on this platform: it always fails with
+// ErrUnsupported.
+func SymlinkOptions(options ...Option) Option {
+	return unsupported("SymlinkOptions")
+}
+
+// TempPattern is not supported on this platform: it always fails with
+// ErrUnsupported.
+func TempPattern(pattern string) Option {
+	return unsupported("TempPattern")
+}
+
+// TrimPreallocation is not supported on this platform: it always fails with
+// ErrUnsupported.
+func TrimPreallocation(trim bool) Option {
+	return unsupported("TrimPreallocation")
+}
+
+// Validate is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Validate(fn func(f *os.File) error) Option {
+	return unsupported("Validate")
+}
+
+// VerifyAfterWrite is not supported on this platform: it always fails with
+// ErrUnsupported.
+func VerifyAfterWrite() Option {
+	return unsupported("VerifyAfterWrite")
+}
+
+// VerifyAfterWriteDirect is not supported on this platform: it always fails with
+// ErrUnsupported.
+func VerifyAfterWriteDirect() Option {
+	return unsupported("VerifyAfterWriteDirect")
+}
+
+// VerifyChecksum is not supported on this platform: it always fails with
+// ErrUnsupported.
+func VerifyChecksum(algo crypto.Hash, expected []byte) Option {
+	return unsupported("VerifyChecksum")
+}
+
+// VerifyCommit is not supported on this platform: it always fails with
+// ErrUnsupported.
+func VerifyCommit() Option {
+	return unsupported("VerifyCommit")
+}
+
+// WithLockfile is not supported on this platform: it always fails with
+// ErrUnsupported.
+func WithLockfile(path string, timeout time.Duration) Option {
+	return unsupported("WithLockfile")
+}
+
+// WithStrategy is not supported on this platform: it always fails with
+// ErrUnsupported.
+func WithStrategy(s Strategy) Option {
+	return unsupported("WithStrategy")
+}
+
+// XattrsFrom is not supported on this platform: it always fails with
+// ErrUnsupported.
+func XattrsFrom(path string, prefixes ...string) Option {
+	return unsupported("XattrsFrom")
+}
+
+// Check is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Check(filename string, options ...Option) error {
+	return &werror{"Check", ErrUnsupported}
+}
+
+// Copy is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Copy(dst, src string, options ...Option) error {
+	return &werror{"Copy", ErrUnsupported}
+}
+
+// CreateAt is not supported on this platform: it always fails with
+// ErrUnsupported.
+func CreateAt(dir *os.File, name string, options ...Option) error {
+	return &werror{"CreateAt", ErrUnsupported}
+}
+
+// CreateMany is not supported on this platform: it always fails with
+// ErrUnsupported.
+func CreateMany(dir string, files []FileSpec, options ...Option) error {
+	return &werror{"CreateMany", ErrUnsupported}
+}
+
+// CreateUnique is not supported on this platform: it always fails with
+// ErrUnsupported.
+func CreateUnique(dir, pattern string, options ...Option) (string, error) {
+	return "", &werror{"CreateUnique", ErrUnsupported}
+}
+
+// CreateVersioned is not supported on this platform: it always fails with
+// ErrUnsupported.
+func CreateVersioned(dir, name string, options ...Option) (string, error) {
+	return "", &werror{"CreateVersioned", ErrUnsupported}
+}
+
+// NewCreator is not supported on this platform: it always fails with
+// ErrUnsupported.
+func NewCreator(dir string, options ...Option) (*Creator, error) {
+	return nil, &werror{"NewCreator", ErrUnsupported}
+}
+
+// Prepare is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Prepare(filename string, options ...Option) (*Pending, error) {
+	return nil, &werror{"Prepare", ErrUnsupported}
+}
+
+// Probe is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Probe(dir string) (Capabilities, error) {
+	return Capabilities{}, &werror{"Probe", ErrUnsupported}
+}
+
+// PruneVersions is not supported on this platform: it always fails with
+// ErrUnsupported.
+func PruneVersions(dir, name string, keep int) error {
+	return &werror{"PruneVersions", ErrUnsupported}
+}
+
+// ReadFileVerified is not supported on this platform: it always fails with
+// ErrUnsupported.
+func ReadFileVerified(filename string) ([]byte, error) {
+	return nil, &werror{"ReadFileVerified", ErrUnsupported}
+}
+
+// Swap is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Swap(path1, path2 string, options ...Option) error {
+	return &werror{"Swap", ErrUnsupported}
+}
+
+// Versions is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Versions(dir, name string) ([]string, error) {
+	return nil, &werror{"Versions", ErrUnsupported}
+}
+
+// TmpFileStrategy is not supported on this platform: it returns nil, so that
+// WithStrategy (that is not supported either) fails.
+func TmpFileStrategy() Strategy {
+	return nil
+}
+
+// RenameStrategy is not supported on this platform: it returns nil, so that
+// WithStrategy (that is not supported either) fails.
+func RenameStrategy() Strategy {
+	return nil
+}
+
+// Pending is not supported on this platform, as Prepare always fails with
+// ErrUnsupported.
+type Pending struct{}
+
+// Commit always fails with ErrUnsupported.
+func (p *Pending) Commit() error {
+	return &werror{"Commit", ErrUnsupported}
+}
+
+// Discard does nothing.
+func (p *Pending) Discard() error {
+	return nil
+}
+
+// Creator is not supported on this platform, as NewCreator always fails with
+// ErrUnsupported.
+type Creator struct{}
+
+// Create always fails with ErrUnsupported.
+func (c *Creator) Create(name string, options ...Option) error {
+	return &werror{"Create", ErrUnsupported}
+}
+
+// Close does nothing.
+func (c *Creator) Close() error {
+	return nil
+}
+
+// WriteFile always fails with ErrUnsupported.
+func (c *Creator) WriteFile(name string, options ...Option) error {
+	return c.Create(name, options...)
+}
+
+// Batch is not supported on this platform: the creation of each file added
+// to it fails with ErrUnsupported.
+type Batch struct {
+	mu    sync.Mutex
+	names []string
+}
+
+// NewBatch returns a Batch, whose files are never created on this platform.
+func NewBatch(concurrency int, options ...Option) *Batch {
+	return &Batch{}
+}
+
+// Add records filename, whose creation fails with ErrUnsupported.
+func (b *Batch) Add(filename string, options ...Option) {
+	b.mu.Lock()
+	b.names = append(b.names, filename)
+	b.mu.Unlock()
+}
+
+// Wait returns, for each file added to b, a BatchResult whose Err is
+// ErrUnsupported.
+func (b *Batch) Wait() []BatchResult {
+	results := make([]BatchResult, len(b.names))
+	for i, name := range b.names {
+		results[i] = BatchResult{Name: name, Err: &werror{"Batch", ErrUnsupported}}
+	}
+	return results
+}
+
+// unsupported returns an Option that fails with ErrUnsupported, for the
+// options that can not be implemented on this platform.
+func unsupported(name string) Option {
+	return optionFunc(func(c *config) error {
+		return &werror{name, ErrUnsupported}
+	})
+}
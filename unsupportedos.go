@@ -0,0 +1,34 @@
+//go:build !linux && !freebsd && !netbsd && !openbsd && !solaris && !js && !plan9
+// +build !linux,!freebsd,!netbsd,!openbsd,!solaris,!js,!plan9
+
+package atomicfile
+
+// The platforms that are not explicitly supported (e.g. darwin and windows)
+// offer primitives, like renames that do not replace the target, that the
+// portable fallback does not use: rather than providing weaker guarantees
+// than the platform allows, the functions that write to the filesystem fail
+// with ErrUnsupported.
+
+// Create is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Create(filename string, options ...Option) error {
+	return &werror{"Create", ErrUnsupported}
+}
+
+// Rename is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Rename(oldpath, newpath string, options ...Option) error {
+	return &werror{"Rename", ErrUnsupported}
+}
+
+// Remove is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Remove(name string, options ...Option) error {
+	return &werror{"Remove", ErrUnsupported}
+}
+
+// Symlink is not supported on this platform: it always fails with
+// ErrUnsupported.
+func Symlink(target, linkname string, options ...Option) error {
+	return &werror{"Symlink", ErrUnsupported}
+}
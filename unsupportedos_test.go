@@ -0,0 +1,36 @@
+//go:build !linux && !freebsd && !netbsd && !openbsd && !solaris && !js && !plan9
+// +build !linux,!freebsd,!netbsd,!openbsd,!solaris,!js,!plan9
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestUnsupportedOS(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	err := atomicfile.Create(name, atomicfile.Contents(bytes.NewReader([]byte("hello"))))
+	if !errors.Is(err, atomicfile.ErrUnsupported) {
+		t.Fatalf("expected an error wrapping ErrUnsupported, got %v", err)
+	}
+	if err := atomicfile.Symlink("target", name); !errors.Is(err, atomicfile.ErrUnsupported) {
+		t.Fatalf("expected an error wrapping ErrUnsupported, got %v", err)
+	}
+	if err := atomicfile.Rename(name, name+".new"); !errors.Is(err, atomicfile.ErrUnsupported) {
+		t.Fatalf("expected an error wrapping ErrUnsupported, got %v", err)
+	}
+	if err := atomicfile.Remove(name); !errors.Is(err, atomicfile.ErrUnsupported) {
+		t.Fatalf("expected an error wrapping ErrUnsupported, got %v", err)
+	}
+	if _, err := os.Lstat(name); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected no file, got %v", err)
+	}
+}
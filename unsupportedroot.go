@@ -0,0 +1,24 @@
+//go:build !linux && go1.24
+// +build !linux,go1.24
+
+package atomicfile
+
+import "os"
+
+// CreateInRoot is not supported on this platform: it always fails with
+// ErrUnsupported.
+func CreateInRoot(root *os.Root, name string, options ...Option) error {
+	return &werror{"CreateInRoot", ErrUnsupported}
+}
+
+// RootFS is not supported on this platform: it returns a WriteFS whose
+// WriteFile always fails with ErrUnsupported.
+func RootFS(root *os.Root) WriteFS {
+	return rootFS{}
+}
+
+type rootFS struct{}
+
+func (rootFS) WriteFile(name string, options ...Option) error {
+	return CreateInRoot(nil, name, options...)
+}
@@ -0,0 +1,12 @@
+//go:build !linux && go1.21
+// +build !linux,go1.21
+
+package atomicfile
+
+import "log/slog"
+
+// WithLogger is not supported on this platform: it always fails with
+// ErrUnsupported.
+func WithLogger(l *slog.Logger) Option {
+	return unsupported("WithLogger")
+}
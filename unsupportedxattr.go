@@ -0,0 +1,12 @@
+//go:build !linux && !freebsd && !netbsd
+// +build !linux,!freebsd,!netbsd
+
+package atomicfile
+
+import "crypto"
+
+// ChecksumXattr is not supported on this platform: it always fails with
+// ErrUnsupported.
+func ChecksumXattr(algo crypto.Hash) Option {
+	return unsupported("ChecksumXattr")
+}
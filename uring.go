@@ -0,0 +1,326 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// IOUring makes Create use io_uring (instead of write and fsync) to populate
+// the target file and to fsync it: the contents are read into a set of
+// buffers whose writes are submitted asynchronously, so that reading the
+// contents overlaps with writing them. Only the writes and the fsync of the
+// target file are submitted to io_uring: all other operations (e.g. linking
+// the target file, or fsyncing its directory) use the regular system calls.
+// io_uring is only used when the contents can not be written with zero-copy
+// mechanisms, and when no option requires observing the data as it is
+// written (e.g. Hash, VerifyChecksum, FlushEvery, RateLimit, Progress or
+// Transform). If io_uring is not supported by the kernel (or is disabled),
+// Create silently falls back to the regular system calls.
+// IOUring is experimental, and may be changed or removed in the future.
+func IOUring() Option {
+	return optionFunc(func(c *config) error {
+		c.ioUring = true
+		return nil
+	})
+}
+
+const (
+	uringEntries = 8
+	// uringBuffers is the number of buffers used to populate the file, and
+	// therefore the maximum number of writes in flight.
+	uringBuffers = 4
+	// uringBufferSize is the size of each buffer used to populate the file.
+	uringBufferSize = 1 << 20
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringEnterGetEvents = 1
+
+	uringOpFsync = 3
+	uringOpWrite = 23
+
+	uringFsyncDatasync = 1
+)
+
+// uringParams is struct io_uring_params.
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        struct{ head, tail, ringMask, ringEntries, flags, dropped, array, resv1, userAddrLo, userAddrHi uint32 }
+	cqOff        struct{ head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1, userAddrLo, userAddrHi uint32 }
+}
+
+// uringSQE is struct io_uring_sqe.
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// uringCQE is struct io_uring_cqe.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is a minimal io_uring instance, used by a single goroutine.
+type uring struct {
+	fd          int
+	sqRing      []byte
+	cqRing      []byte
+	sqeMem      []byte
+	sqTail      *uint32
+	sqMask      uint32
+	sqArray     unsafe.Pointer
+	cqHead      *uint32
+	cqTail      *uint32
+	cqMask      uint32
+	cqes        unsafe.Pointer
+	unsubmitted uint32
+}
+
+// newURing creates an io_uring instance.
+func newURing() (*uring, error) {
+	var params uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uringEntries, uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	r := &uring{fd: int(fd)}
+
+	var err error
+	sqSize := int(params.sqOff.array + params.sqEntries*4)
+	r.sqRing, err = unix.Mmap(r.fd, uringOffSQRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	cqSize := int(params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	r.cqRing, err = unix.Mmap(r.fd, uringOffCQRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.sqeMem, err = unix.Mmap(r.fd, uringOffSQEs, int(params.sqEntries)*int(unsafe.Sizeof(uringSQE{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+
+	sq, cq := unsafe.Pointer(&r.sqRing[0]), unsafe.Pointer(&r.cqRing[0])
+	r.sqTail = (*uint32)(unsafe.Add(sq, params.sqOff.tail))
+	r.sqMask = *(*uint32)(unsafe.Add(sq, params.sqOff.ringMask))
+	r.sqArray = unsafe.Add(sq, params.sqOff.array)
+	r.cqHead = (*uint32)(unsafe.Add(cq, params.cqOff.head))
+	r.cqTail = (*uint32)(unsafe.Add(cq, params.cqOff.tail))
+	r.cqMask = *(*uint32)(unsafe.Add(cq, params.cqOff.ringMask))
+	r.cqes = unsafe.Add(cq, params.cqOff.cqes)
+	return r, nil
+}
+
+// close releases the resources of r. All submitted operations must have
+// completed.
+func (r *uring) close() {
+	for _, m := range [][]byte{r.sqeMem, r.cqRing, r.sqRing} {
+		if m != nil {
+			_ = unix.Munmap(m)
+		}
+	}
+	_ = unix.Close(r.fd)
+}
+
+// push queues an operation, that is submitted by the next call to enter.
+// The caller must make sure that the submission queue is not full.
+func (r *uring) push(sqe uringSQE) {
+	tail := *r.sqTail
+	idx := tail & r.sqMask
+	*(*uringSQE)(unsafe.Pointer(&r.sqeMem[uintptr(idx)*unsafe.Sizeof(sqe)])) = sqe
+	*(*uint32)(unsafe.Add(r.sqArray, idx*4)) = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.unsubmitted++
+}
+
+// enter submits the queued operations, and waits for at least wait
+// operations to complete.
+func (r *uring) enter(wait uint32) error {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(r.unsubmitted), uintptr(wait), uringEnterGetEvents, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		} else if errno != 0 {
+			return errno
+		}
+		r.unsubmitted -= uint32(n)
+		return nil
+	}
+}
+
+// reap returns the next completed operation, if any.
+func (r *uring) reap() (cqe uringCQE, ok bool) {
+	head := atomic.LoadUint32(r.cqHead)
+	if head == atomic.LoadUint32(r.cqTail) {
+		return cqe, false
+	}
+	cqe = *(*uringCQE)(unsafe.Add(r.cqes, uintptr(head&r.cqMask)*unsafe.Sizeof(cqe)))
+	atomic.StoreUint32(r.cqHead, head+1)
+	return cqe, true
+}
+
+// wait submits the queued operations, and returns the next completed one.
+func (r *uring) wait() (uringCQE, error) {
+	for {
+		if cqe, ok := r.reap(); ok {
+			return cqe, nil
+		}
+		if err := r.enter(1); err != nil {
+			return uringCQE{}, err
+		}
+	}
+}
+
+// drain waits for the completion of n operations, that have been pushed and
+// not yet reaped, so that the kernel no longer accesses the memory they
+// reference. As completions are posted to the completion queue even if
+// io_uring_enter fails, in that case drain polls it until the submitted
+// operations have completed: the operations that could not be submitted are
+// not waited for, and are never submitted as the ring must then be closed.
+func (r *uring) drain(n int) {
+	for n > 0 {
+		if _, ok := r.reap(); ok {
+			n--
+			continue
+		}
+		if err := r.enter(1); err != nil {
+			if n <= int(r.unsubmitted) {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// fsync fsyncs (or fdatasyncs, if datasync is true) the file fd.
+func (r *uring) fsync(fd int, datasync bool) error {
+	sqe := uringSQE{opcode: uringOpFsync, fd: int32(fd)}
+	if datasync {
+		sqe.opFlags = uringFsyncDatasync
+	}
+	r.push(sqe)
+	cqe, err := r.wait()
+	if err != nil {
+		return err
+	}
+	if cqe.res < 0 {
+		return unix.Errno(-cqe.res)
+	}
+	return nil
+}
+
+// uringCopy copies the data from r to the file, reading it into a set of
+// buffers whose writes are submitted to ring, so that reading the data
+// overlaps with writing it.
+func (p *populator) uringCopy(ring *uring, r io.Reader) error {
+	type slot struct {
+		buf []byte
+		off int64
+		n   int
+	}
+	var slots [uringBuffers]slot
+	free := make([]int, 0, uringBuffers)
+	for i := range slots {
+		free = append(free, i)
+	}
+	inflight := 0
+	// the kernel may still be reading from the buffers: wait for all writes
+	// to complete before returning, so that the buffers are not reused (or
+	// freed) while they are being written, even if waiting failed
+	defer func() { ring.drain(inflight) }()
+
+	if p.limit >= 0 {
+		r = io.LimitReader(r, p.limit-p.written)
+	}
+	off, eof := p.written, false
+	for !eof || inflight > 0 {
+		if !eof && len(free) > 0 {
+			i := free[len(free)-1]
+			free = free[:len(free)-1]
+			s := &slots[i]
+			if s.buf == nil {
+				s.buf = make([]byte, uringBufferSize)
+			}
+			n, err := io.ReadFull(r, s.buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof, err = true, nil
+			}
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				free = append(free, i)
+				continue
+			}
+			s.off, s.n = off, n
+			off += int64(n)
+			ring.push(uringSQE{
+				opcode:   uringOpWrite,
+				fd:       int32(p.f.Fd()),
+				off:      uint64(s.off),
+				addr:     uint64(uintptr(unsafe.Pointer(&s.buf[0]))),
+				len:      uint32(n),
+				userData: uint64(i),
+			})
+			inflight++
+			continue
+		}
+
+		cqe, err := ring.wait()
+		if err != nil {
+			return err
+		}
+		inflight--
+		s := &slots[cqe.userData]
+		if cqe.res < 0 {
+			return unix.Errno(-cqe.res)
+		}
+		for done := int(cqe.res); done < s.n; {
+			// short write: write the rest synchronously
+			n, err := unix.Pwrite(int(p.f.Fd()), s.buf[done:s.n], s.off+int64(done))
+			if err != nil {
+				return err
+			} else if n == 0 {
+				return io.ErrShortWrite
+			}
+			done += n
+		}
+		p.written += int64(s.n)
+		free = append(free, int(cqe.userData))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestIOUring(t *testing.T) {
+	dir := t.TempDir()
+	contents := make([]byte, 3<<20+12345)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+
+	for _, opts := range [][]atomicfile.Option{
+		nil,
+		{atomicfile.Fsync()},
+		{atomicfile.Durability(atomicfile.DurabilityData), atomicfile.Preallocate(int64(len(contents)))},
+	} {
+		name := filepath.Join(dir, "file")
+		// the reader hides the io.WriterTo of bytes.Reader, so that the
+		// contents are not written with zero-copy mechanisms
+		reader := struct{ io.Reader }{bytes.NewReader(contents)}
+		opts = append(opts, atomicfile.Contents(reader), atomicfile.IOUring(), atomicfile.Replace())
+		if err := atomicfile.Create(name, opts...); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, name, string(contents))
+		checkDirEntries(t, dir, "file")
+	}
+}
+
+func TestIOUringReadError(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	readErr := errors.New("read error")
+
+	// the read fails while the writes of the previous buffers are in flight:
+	// they must complete before Create returns
+	reader := io.MultiReader(bytes.NewReader(make([]byte, 3<<20+12345)), &errReader{readErr})
+	err := atomicfile.Create(name, atomicfile.Contents(reader), atomicfile.IOUring())
+	if !errors.Is(err, readErr) {
+		t.Fatalf("expected an error wrapping the read error, got %v", err)
+	}
+	checkDirEntries(t, dir)
+}
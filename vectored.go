@@ -0,0 +1,141 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// ContentsSlices specifies the contents to be written to the target file, as
+// the concatenation of bufs. When possible, the buffers are written with as
+// few writev(2) calls as possible, so that they do not need to be
+// concatenated (e.g. when writing a header, a payload and a footer).
+// The buffers must not be modified until Create returns.
+func ContentsSlices(bufs ...[]byte) Option {
+	return Contents(&slicesReader{bufs: bufs})
+}
+
+// slicesReader reads the concatenation of a list of buffers.
+type slicesReader struct {
+	bufs [][]byte
+	// pos is the current offset in the concatenation of bufs.
+	pos int64
+}
+
+func (r *slicesReader) size() int64 {
+	var n int64
+	for _, b := range r.bufs {
+		n += int64(len(b))
+	}
+	return n
+}
+
+// remaining returns the buffers that have not been read yet.
+func (r *slicesReader) remaining() [][]byte {
+	pos := r.pos
+	for i, b := range r.bufs {
+		if pos < int64(len(b)) {
+			return append([][]byte{b[pos:]}, r.bufs[i+1:]...)
+		}
+		pos -= int64(len(b))
+	}
+	return nil
+}
+
+func (r *slicesReader) Read(p []byte) (int, error) {
+	var n int
+	pos := r.pos
+	for _, b := range r.bufs {
+		if n == len(p) {
+			break
+		} else if pos >= int64(len(b)) {
+			pos -= int64(len(b))
+			continue
+		}
+		n += copy(p[n:], b[pos:])
+		pos = 0
+	}
+	r.pos += int64(n)
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Len returns the number of bytes that have not been read yet, so that the
+// size of the contents is known (see ContentSize).
+func (r *slicesReader) Len() int {
+	return int(r.size() - r.pos)
+}
+
+func (r *slicesReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// maxIovecs is the maximum number of buffers passed to a single call to
+// writev (IOV_MAX).
+const maxIovecs = 1024
+
+// writeSlices writes the remaining buffers of src to the file with writev.
+func (p *populator) writeSlices(src *slicesReader) error {
+	bufs := src.remaining()
+	if p.limit >= 0 {
+		// truncate the buffers to the limit
+		left := p.limit - p.written
+		for i, b := range bufs {
+			if int64(len(b)) >= left {
+				bufs = append(bufs[:i:i], b[:left])
+				break
+			}
+			left -= int64(len(b))
+		}
+	}
+	for {
+		for len(bufs) > 0 && len(bufs[0]) == 0 {
+			bufs = bufs[1:]
+		}
+		if len(bufs) == 0 {
+			return nil
+		}
+		iov := bufs
+		if len(iov) > maxIovecs {
+			iov = iov[:maxIovecs]
+		}
+		n, err := unix.Writev(int(p.f.Fd()), iov)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		} else if n == 0 {
+			return io.ErrShortWrite
+		}
+		p.written += int64(n)
+		src.pos += int64(n)
+		// skip the buffers (or the part of them) that have been written
+		for n > 0 && len(bufs) > 0 {
+			if n < len(bufs[0]) {
+				bufs[0] = bufs[0][n:]
+				break
+			}
+			n -= len(bufs[0])
+			bufs = bufs[1:]
+		}
+	}
+}
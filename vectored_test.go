@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestContentsSlices(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	// more buffers than can be written with a single writev
+	var bufs [][]byte
+	var contents []byte
+	for i := 0; i < 3000; i++ {
+		buf := bytes.Repeat([]byte{byte(i)}, i%7)
+		bufs = append(bufs, buf)
+		contents = append(contents, buf...)
+	}
+	h := sha256.New()
+	var r atomicfile.Result
+	err := atomicfile.Create(name, atomicfile.ContentsSlices(bufs...), atomicfile.Report(&r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, string(contents))
+	if r.Written != int64(len(contents)) {
+		t.Fatalf("Written is %d, expected %d", r.Written, len(contents))
+	}
+
+	// options observing the data make the buffers be read in userspace
+	err = atomicfile.Create(name,
+		atomicfile.ContentsSlices([]byte("hel"), nil, []byte("lo")),
+		atomicfile.Hash(h),
+		atomicfile.Replace(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "hello")
+	sum := sha256.Sum256([]byte("hello"))
+	if !bytes.Equal(h.Sum(nil), sum[:]) {
+		t.Fatal("wrong digest")
+	}
+
+	if err := atomicfile.Create(name, atomicfile.ContentsSlices(), atomicfile.Replace()); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name, "")
+	checkDirEntries(t, dir, "file")
+}
@@ -0,0 +1,187 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// VerifyAfterWrite makes Create read back the temporary file once it has
+// been populated and, depending on the durability level, synced, and compare
+// it with the digest of the data that was written to it, before linking it
+// as the target file. If they do not match, the target file is not created
+// and a *CorruptionError is returned. See VerifyAfterWriteDirect to bypass the
+// page cache when reading the file back.
+// As the data needs to be read in userspace to compute its digest, specifying
+// VerifyAfterWrite prevents the use of zero-copy mechanisms to populate the
+// target file.
+func VerifyAfterWrite() Option {
+	return optionFunc(func(c *config) error {
+		c.verifyWrite = true
+		return nil
+	})
+}
+
+// VerifyAfterWriteDirect is like VerifyAfterWrite, but the file is read back
+// with O_DIRECT, so that the data is read from the storage device instead of
+// from the page cache. On filesystems that do not support O_DIRECT (e.g.
+// tmpfs) the cached pages of the file are dropped before reading it back,
+// which has the same effect only if they have already been synced.
+func VerifyAfterWriteDirect() Option {
+	return optionFunc(func(c *config) error {
+		c.verifyWrite = true
+		c.verifyDirect = true
+		return nil
+	})
+}
+
+// verifyFile reads back the file f, that will be linked as filename, and
+// compares its digest with the one of the data written to it.
+func verifyFile(f *os.File, filename string, cfg *config) error {
+	const bufSize = 1 << 20
+	fd := int(f.Fd())
+	if cfg.verifyDirect {
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+		if err != nil {
+			return err
+		}
+		_, err = unix.FcntlInt(uintptr(fd), unix.F_SETFL, flags|unix.O_DIRECT)
+		if err == unix.EINVAL {
+			cfg.debug("O_DIRECT not supported, dropping cached pages", "error", err)
+			_ = unix.Fadvise(fd, 0, 0, unix.FADV_DONTNEED)
+		} else if err != nil {
+			return err
+		} else {
+			defer unix.FcntlInt(uintptr(fd), unix.F_SETFL, flags)
+		}
+	}
+
+	// the buffer is mapped so that it is aligned as required by O_DIRECT
+	buf, err := unix.Mmap(-1, 0, bufSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return err
+	}
+	defer unix.Munmap(buf)
+
+	h := sha256.New()
+	for off := int64(0); ; {
+		n, err := unix.Pread(fd, buf, off)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		} else if n == 0 {
+			break
+		}
+		h.Write(buf[:n])
+		off += int64(n)
+	}
+
+	if expected, actual := cfg.verifyHash.Sum(nil), h.Sum(nil); !bytes.Equal(expected, actual) {
+		return &CorruptionError{
+			Path:      filename,
+			Algorithm: crypto.SHA256,
+			Expected:  expected,
+			Actual:    actual,
+		}
+	}
+	return nil
+}
+
+// VerifyCommit makes Create check, once the target file has been linked
+// (and, depending on the durability level, synced), that the target path
+// still refers to the file that was created. If it does not, e.g. because
+// another process replaced or removed the target file in the meantime, Create
+// returns an error wrapping ErrTargetChanged; the Result is reported anyway
+// (see Report), as the file was committed.
+func VerifyCommit() Option {
+	return optionFunc(func(c *config) error {
+		c.verifyCommit = true
+		return nil
+	})
+}
+
+// checkLinked returns ErrTargetChanged if name, in the
+// directory dirfd, is not the file f.
+func checkLinked(dirfd int, name string, f *os.File) error {
+	var want, got unix.Statx_t
+	if err := unix.Statx(int(f.Fd()), "", unix.AT_EMPTY_PATH, unix.STATX_INO, &want); err != nil {
+		return err
+	}
+	err := unix.Statx(dirfd, name, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_INO, &got)
+	if err == unix.ENOENT {
+		return ErrTargetChanged
+	} else if err != nil {
+		return err
+	}
+	if got.Ino != want.Ino || got.Dev_major != want.Dev_major || got.Dev_minor != want.Dev_minor {
+		return ErrTargetChanged
+	}
+	return nil
+}
+
+// ReadFileVerified reads the contents of the specified file, and verifies them
+// against the digests stored in its extended attributes by ChecksumXattr.
+// If any digest does not match, a *CorruptionError is returned.
+// Digests computed with hash functions that are not linked into the binary
+// are ignored; if no digest can be verified, an error is returned.
+func ReadFileVerified(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, &werror{"opening file", err}
+	}
+	defer f.Close()
+
+	var checksums []checksum
+	for algo := crypto.MD4; algo <= crypto.BLAKE2b_512; algo++ {
+		name := checksumXattrName(algo)
+		if name == "" || !algo.Available() {
+			continue
+		}
+		expected := make([]byte, algo.Size())
+		n, err := unix.Fgetxattr(int(f.Fd()), name, expected)
+		if err == unix.ENODATA {
+			continue
+		} else if err == unix.ERANGE {
+			n = -1 // the stored digest is longer than expected
+		} else if err != nil {
+			return nil, &werror{"reading checksum xattr", err}
+		}
+		if n != algo.Size() {
+			return nil, &werror{"invalid checksum xattr " + name, nil}
+		}
+		checksums = append(checksums, checksum{algo, algo.New(), expected})
+	}
+	if len(checksums) == 0 {
+		return nil, &werror{"no checksum xattr", nil}
+	}
+
+	var buf bytes.Buffer
+	w := []io.Writer{&buf}
+	for _, c := range checksums {
+		w = append(w, c.h)
+	}
+	if _, err := io.Copy(io.MultiWriter(w...), f); err != nil {
+		return nil, &werror{"reading file", err}
+	}
+
+	for _, c := range checksums {
+		if actual := c.h.Sum(nil); !bytes.Equal(actual, c.expected) {
+			return nil, &CorruptionError{
+				Path:      filename,
+				Algorithm: c.algo,
+				Expected:  c.expected,
+				Actual:    actual,
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
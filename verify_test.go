@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestVerifyAfterWrite(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	for _, verify := range []atomicfile.Option{atomicfile.VerifyAfterWrite(), atomicfile.VerifyAfterWriteDirect()} {
+		err := atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+			atomicfile.Fsync(),
+			atomicfile.Replace(),
+			verify,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, name, "hello")
+
+		// corrupt the temporary file before it is read back
+		err = atomicfile.Create(name,
+			atomicfile.Contents(bytes.NewReader([]byte("new"))),
+			atomicfile.Fsync(),
+			atomicfile.Replace(),
+			atomicfile.Validate(func(f *os.File) error {
+				_, err := f.WriteAt([]byte("N"), 0)
+				return err
+			}),
+			verify,
+		)
+		var cerr *atomicfile.CorruptionError
+		if !errors.As(err, &cerr) || !errors.Is(err, atomicfile.ErrChecksumMismatch) {
+			t.Fatalf("expected a *CorruptionError, got %v", err)
+		}
+		checkFile(t, name, "hello")
+		checkDirEntries(t, dir, "file")
+	}
+}
+
+func TestVerifyCommit(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	err := atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.VerifyCommit(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replace the target file as soon as it has been linked
+	var r atomicfile.Result
+	err = atomicfile.Create(name,
+		atomicfile.Contents(bytes.NewReader([]byte("new"))),
+		atomicfile.Replace(),
+		atomicfile.VerifyCommit(),
+		atomicfile.Report(&r),
+		atomicfile.Observe(func(s atomicfile.Stage, _ time.Duration, err error) {
+			if s == atomicfile.StageReplace {
+				writeFile(t, name+".other", "other")
+				if err := os.Rename(name+".other", name); err != nil {
+					t.Error(err)
+				}
+			}
+		}),
+	)
+	if !errors.Is(err, atomicfile.ErrTargetChanged) {
+		t.Fatalf("expected an error wrapping ErrTargetChanged, got %v", err)
+	}
+	if r.Written != 3 {
+		t.Fatalf("Written is %d, expected 3", r.Written)
+	}
+	checkFile(t, name, "other")
+	checkDirEntries(t, dir, "file")
+}
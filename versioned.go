@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package atomicfile
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// versionTimeFormat is the format of the timestamps used in the names of
+// the versions created by CreateVersioned. Names in this format sort in
+// chronological order.
+const versionTimeFormat = "20060102T150405.000000000Z"
+
+// CreateVersioned creates a new version of the file name in dir, and then
+// atomically updates name to point to it.
+// The new version is created with Create (honoring all options) using a name
+// derived from the current time (e.g. "name.20221015T150405.123456789Z"),
+// and name is then atomically replaced by a relative symbolic link to it
+// using Symlink, with the options specified with SymlinkOptions. Unless
+// they specify the durability (see Durability and SyncParentDirs), the
+// symbolic link is updated with the same durability as the new version.
+// Readers opening name therefore observe either the previous or the new
+// version.
+// The name of the new version (relative to dir) is returned.
+// Old versions can be listed with Versions and removed with PruneVersions.
+func CreateVersioned(dir, name string, options ...Option) (string, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return "", &werror{"invalid name", nil}
+	}
+	cfg, err := newConfig(options)
+	if err != nil {
+		return "", err
+	}
+	linkCfg, err := newConfig(cfg.symlinkOptions)
+	if err != nil {
+		return "", err
+	}
+	if linkCfg.durability == defaultConfig().durability && !linkCfg.syncParents {
+		linkCfg.durability, linkCfg.syncParents = cfg.durability, cfg.syncParents
+	}
+
+	var version string
+	for i := 0; ; i++ {
+		version = name + "." + time.Now().UTC().Format(versionTimeFormat)
+		err := Create(path.Join(dir, version), options...)
+		if err == nil {
+			break
+		} else if !errors.Is(err, os.ErrExist) || i >= 100 {
+			return "", err
+		}
+	}
+
+	err = symlink(version, path.Join(dir, name), linkCfg)
+	if err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// SymlinkOptions specifies the options used by CreateVersioned to update the
+// symbolic link to the new version (see Symlink for the options that are
+// honored). It is ignored by all other functions.
+func SymlinkOptions(options ...Option) Option {
+	return optionFunc(func(c *config) error {
+		c.symlinkOptions = append(c.symlinkOptions, options...)
+		return nil
+	})
+}
+
+// Versions returns the names (relative to dir) of the versions of the file
+// name in dir created by CreateVersioned, from the oldest to the newest.
+func Versions(dir, name string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, &werror{"listing versions", err}
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, &werror{"listing versions", err}
+	}
+
+	prefix := name + "."
+	var versions []string
+	for _, n := range names {
+		if !strings.HasPrefix(n, prefix) {
+			continue
+		}
+		if _, err := time.Parse(versionTimeFormat, n[len(prefix):]); err != nil {
+			continue
+		}
+		versions = append(versions, n)
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// PruneVersions removes the versions of the file name in dir created by
+// CreateVersioned, except for the newest keep versions and for the version
+// name currently points to. The directory is then fsynced so that the
+// removal is durable once PruneVersions returns.
+func PruneVersions(dir, name string, keep int) error {
+	if keep < 0 {
+		return &werror{"invalid number of versions", nil}
+	}
+	versions, err := Versions(dir, name)
+	if err != nil {
+		return err
+	}
+	current, err := os.Readlink(path.Join(dir, name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return &werror{"reading current version", err}
+	}
+
+	if len(versions) <= keep {
+		return nil
+	}
+	for _, v := range versions[:len(versions)-keep] {
+		if v == current {
+			continue
+		}
+		err := os.Remove(path.Join(dir, v))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return &werror{"removing version", err}
+		}
+	}
+
+	if err := syncDir(dir); err != nil {
+		return &werror{"fsync directory", err}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+func TestCreateVersioned(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	var versions []string
+	for _, contents := range []string{"v1", "v2", "v3"} {
+		v, err := atomicfile.CreateVersioned(dir, "file",
+			atomicfile.Contents(bytes.NewReader([]byte(contents))),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, name, contents)
+		checkSymlink(t, name, v)
+		versions = append(versions, v)
+	}
+	got, err := atomicfile.Versions(dir, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0] != versions[0] || got[1] != versions[1] || got[2] != versions[2] {
+		t.Fatalf("Versions returned %q, expected %q", got, versions)
+	}
+
+	// the current version is never pruned
+	if err := os.Symlink(versions[0], name+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomicfile.PruneVersions(dir, "file", 1); err != nil {
+		t.Fatal(err)
+	}
+	checkDirEntries(t, dir, "file", versions[0], versions[2])
+	checkFile(t, name, "v1")
+
+	if _, err := atomicfile.CreateVersioned(dir, "sub/file"); err == nil {
+		t.Fatal("invalid name accepted")
+	}
+	if err := atomicfile.PruneVersions(dir, "file", -1); err == nil {
+		t.Fatal("invalid number of versions accepted")
+	}
+}
+
+func TestSymlinkOptions(t *testing.T) {
+	dir := t.TempDir()
+
+	v, err := atomicfile.CreateVersioned(dir, "file",
+		atomicfile.Contents(bytes.NewReader([]byte("hello"))),
+		atomicfile.Permissions(0o600),
+		atomicfile.SymlinkOptions(atomicfile.SyncParentDirs()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "file"), "hello")
+	checkSymlink(t, filepath.Join(dir, "file"), v)
+
+	// the options of the symbolic link are validated
+	_, err = atomicfile.CreateVersioned(dir, "file",
+		atomicfile.SymlinkOptions(atomicfile.Replace(), atomicfile.NoReplace()),
+	)
+	if err == nil {
+		t.Fatal("invalid symbolic link options accepted")
+	}
+}
@@ -0,0 +1,33 @@
+package atomicfile
+
+import (
+	"io/fs"
+	"path"
+)
+
+// WriteFS is the interface implemented by file systems in which files can be
+// created atomically, with the options accepted by Create. Code that creates
+// files can accept a WriteFS, so that it can be tested against an in-memory
+// implementation.
+type WriteFS interface {
+	// WriteFile creates the file name, as Create does.
+	WriteFile(name string, options ...Option) error
+}
+
+// DirFS returns a WriteFS that creates files in the directory dir. As for
+// os.DirFS, names must be valid according to fs.ValidPath, and they are
+// resolved relative to dir each time WriteFile is called; DirFS does not
+// prevent symbolic links in dir from referring to files outside of it (see
+// RootFS).
+func DirFS(dir string) WriteFS {
+	return dirFS(dir)
+}
+
+type dirFS string
+
+func (d dirFS) WriteFile(name string, options ...Option) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &werror{"invalid file name", nil}
+	}
+	return Create(path.Join(string(d), name), options...)
+}
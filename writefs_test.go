@@ -0,0 +1,35 @@
+//go:build linux || freebsd || netbsd || openbsd || solaris || js || plan9
+// +build linux freebsd netbsd openbsd solaris js plan9
+
+package atomicfile_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CAFxX/atomicfile"
+)
+
+var _ atomicfile.WriteFS = (*atomicfile.Creator)(nil)
+
+func TestDirFS(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := atomicfile.DirFS(dir)
+	if err := fsys.WriteFile("sub/file", atomicfile.Contents(bytes.NewReader([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "sub", "file"), "hello")
+
+	for _, name := range []string{"../file", "/file", ".", "sub/../file", ""} {
+		if err := fsys.WriteFile(name); err == nil {
+			t.Fatalf("invalid name %q accepted", name)
+		}
+	}
+	checkDirEntries(t, dir, "sub")
+}